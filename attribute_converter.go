@@ -0,0 +1,43 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import "go.opencensus.io/trace"
+
+// AttributeConverter converts the values of span, annotation and link
+// attributes of types the exporter does not support, or whose default
+// conversion is not wanted.
+//
+// It returns the value to upload instead of v and true, or false to keep
+// v. The returned value is then converted like any other: booleans and
+// integers keep their type; floats, durations, times, errors and
+// fmt.Stringers become strings; slices of them become JSON arrays. The
+// attributes with values of other types are dropped, and counted in the
+// dropped attributes count of the uploaded spans.
+type AttributeConverter func(v interface{}) (interface{}, bool)
+
+// convertAttributes returns a copy of s with its attribute values, and the
+// ones of its annotations and links, replaced by convert.
+func convertAttributes(s *trace.SpanData, convert AttributeConverter) *trace.SpanData {
+	c := copySpanData(s)
+	forEachAttributes(c, func(attrs map[string]interface{}) {
+		for k, v := range attrs {
+			if cv, ok := convert(v); ok {
+				attrs[k] = cv
+			}
+		}
+	})
+	return c
+}
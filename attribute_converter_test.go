@@ -0,0 +1,143 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/trace/apiv2/tracepb"
+	"go.opencensus.io/trace"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestAttributeValue(t *testing.T) {
+	intValue := func(i int64) *tracepb.AttributeValue {
+		return &tracepb.AttributeValue{Value: &tracepb.AttributeValue_IntValue{IntValue: i}}
+	}
+	stringValue := func(s string) *tracepb.AttributeValue {
+		return &tracepb.AttributeValue{Value: &tracepb.AttributeValue_StringValue{StringValue: trunc(s, maxAttributeStringValue)}}
+	}
+	var nilErr *net.OpError
+	tests := []struct {
+		v    interface{}
+		want *tracepb.AttributeValue
+	}{
+		{true, &tracepb.AttributeValue{Value: &tracepb.AttributeValue_BoolValue{BoolValue: true}}},
+		{int64(-1), intValue(-1)},
+		{42, intValue(42)},
+		{int8(-8), intValue(-8)},
+		{int16(16), intValue(16)},
+		{int32(32), intValue(32)},
+		{uint8(8), intValue(8)},
+		{uint16(16), intValue(16)},
+		{uint32(32), intValue(32)},
+		{uint(64), intValue(64)},
+		{uint64(math.MaxUint64), stringValue("18446744073709551615")},
+		{float32(1.5), stringValue("1.5")},
+		{100.001, stringValue("100.001")},
+		{"str", stringValue("str")},
+		{1500 * time.Millisecond, stringValue("1.5s")},
+		{time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), stringValue("2020-01-02T03:04:05Z")},
+		{errors.New("boom"), stringValue("boom")},
+		{net.IPv4(10, 0, 0, 1), stringValue("10.0.0.1")},
+		{[]string{"a", "b"}, stringValue(`["a","b"]`)},
+		{[2]int{1, 2}, stringValue(`[1,2]`)},
+		{[]interface{}{true, time.Second}, stringValue(`[true,"1s"]`)},
+		{nil, nil},
+		{nilErr, nil},
+		{struct{}{}, nil},
+		{[]struct{}{{}}, nil},
+		{map[string]string{}, nil},
+	}
+	for _, tt := range tests {
+		if got := attributeValue(tt.v, maxAttributeStringValue); !proto.Equal(got, tt.want) {
+			t.Errorf("attributeValue(%#v) = %v; want %v", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestUnsupportedAttributesCounted(t *testing.T) {
+	sd := &trace.SpanData{
+		Attributes: map[string]interface{}{
+			"ok":          "v",
+			"unsupported": struct{}{},
+		},
+	}
+	s := protoFromSpanData(sd, "testproject", nil, defaultUserAgent)
+	if _, ok := s.Attributes.AttributeMap["unsupported"]; ok {
+		t.Error("unsupported attribute uploaded")
+	}
+	if got := s.Attributes.DroppedAttributesCount; got != 1 {
+		t.Errorf("DroppedAttributesCount = %d; want 1", got)
+	}
+}
+
+type point struct{ x, y int }
+
+func TestAttributeConverter(t *testing.T) {
+	e := newTraceExporterWithClient(Options{
+		Context: context.Background(),
+		Timeout: 10 * time.Millisecond,
+		AttributeConverter: func(v interface{}) (interface{}, bool) {
+			switch v := v.(type) {
+			case point:
+				return []int{v.x, v.y}, true
+			case time.Duration:
+				return v.Milliseconds(), true
+			}
+			return nil, false
+		},
+	}, nil)
+	var got []*tracepb.Span
+	e.uploadFn = func(spans []*tracepb.Span) {
+		got = append(got, spans...)
+	}
+	attrs := map[string]interface{}{
+		"point":   point{1, 2},
+		"latency": 2 * time.Second,
+		"name":    "n",
+	}
+	e.ExportSpan(&trace.SpanData{
+		Attributes:  attrs,
+		Annotations: []trace.Annotation{{Attributes: map[string]interface{}{"point": point{3, 4}}}},
+	})
+	e.Flush()
+
+	if len(got) != 1 {
+		t.Fatalf("uploaded %d spans; want 1", len(got))
+	}
+	m := got[0].Attributes.AttributeMap
+	if v := m["point"].GetStringValue().GetValue(); v != "[1,2]" {
+		t.Errorf("point = %q; want [1,2]", v)
+	}
+	if v := m["latency"].GetIntValue(); v != 2000 {
+		t.Errorf("latency = %d; want 2000", v)
+	}
+	if v := m["name"].GetStringValue().GetValue(); v != "n" {
+		t.Errorf("name = %q; want n", v)
+	}
+	annotation := got[0].TimeEvents.TimeEvent[0].GetAnnotation()
+	if v := annotation.Attributes.AttributeMap["point"].GetStringValue().GetValue(); v != "[3,4]" {
+		t.Errorf("annotation point = %q; want [3,4]", v)
+	}
+	if _, ok := attrs["point"].(point); !ok {
+		t.Error("exported span modified")
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"math"
+
+	distributionpb "google.golang.org/genproto/googleapis/api/distribution"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// boundsTolerance is the relative error allowed between a bound and the
+// bound of a linear or exponential sequence.
+const boundsTolerance = 1e-9
+
+// compactDistributions replaces the explicit bucket bounds of the
+// distribution points of ts with linear or exponential bucket options, when
+// Options.CompactBucketOptions is set and the bounds form such a sequence.
+func (se *statsExporter) compactDistributions(ts *monitoringpb.TimeSeries) {
+	if !se.o.CompactBucketOptions {
+		return
+	}
+	for _, pt := range ts.GetPoints() {
+		if d := pt.GetValue().GetDistributionValue(); d != nil {
+			compactBucketOptions(d)
+		}
+	}
+}
+
+// compactBucketOptions replaces the explicit bucket bounds of d with linear
+// or exponential bucket options describing the same buckets.
+//
+// The first bucket of every layout is an underflow bucket starting at
+// -infinity. Exponential bounds cannot include the zero bound added before
+// positive explicit bounds, so when the other bounds are exponential, the
+// buckets below and above zero are merged into the underflow bucket. They
+// hold the same values for the distributions of non-negative values
+// recorded by OpenCensus.
+func compactBucketOptions(d *distributionpb.Distribution) {
+	bounds := d.GetBucketOptions().GetExplicitBuckets().GetBounds()
+	if len(d.BucketCounts) > len(bounds)+1 {
+		return
+	}
+	if width, ok := linearBounds(bounds); ok {
+		d.BucketOptions = &distributionpb.Distribution_BucketOptions{
+			Options: &distributionpb.Distribution_BucketOptions_LinearBuckets{
+				LinearBuckets: &distributionpb.Distribution_BucketOptions_Linear{
+					NumFiniteBuckets: int32(len(bounds) - 1),
+					Width:            width,
+					Offset:           bounds[0],
+				},
+			},
+		}
+		return
+	}
+
+	zeroBound := len(bounds) > 0 && bounds[0] == 0
+	if zeroBound {
+		bounds = bounds[1:]
+	}
+	growth, ok := exponentialBounds(bounds)
+	if !ok {
+		return
+	}
+	d.BucketOptions = &distributionpb.Distribution_BucketOptions{
+		Options: &distributionpb.Distribution_BucketOptions_ExponentialBuckets{
+			ExponentialBuckets: &distributionpb.Distribution_BucketOptions_Exponential{
+				NumFiniteBuckets: int32(len(bounds) - 1),
+				GrowthFactor:     growth,
+				Scale:            bounds[0],
+			},
+		},
+	}
+	if zeroBound && len(d.BucketCounts) > 1 {
+		counts := make([]int64, len(d.BucketCounts)-1)
+		counts[0] = d.BucketCounts[0] + d.BucketCounts[1]
+		copy(counts[1:], d.BucketCounts[2:])
+		d.BucketCounts = counts
+	}
+}
+
+// linearBounds reports whether bounds, at least 3 of them, are spaced by
+// a constant width, and returns it.
+func linearBounds(bounds []float64) (width float64, ok bool) {
+	if len(bounds) < 3 {
+		return 0, false
+	}
+	width = bounds[1] - bounds[0]
+	if !(width > 0) || math.IsInf(width, 0) {
+		return 0, false
+	}
+	for i, b := range bounds {
+		want := bounds[0] + float64(i)*width
+		if math.Abs(b-want) > boundsTolerance*math.Max(math.Abs(want), width) {
+			return 0, false
+		}
+	}
+	return width, true
+}
+
+// exponentialBounds reports whether bounds, at least 3 positive ones, grow
+// by a constant factor, and returns it.
+func exponentialBounds(bounds []float64) (growth float64, ok bool) {
+	if len(bounds) < 3 || !(bounds[0] > 0) {
+		return 0, false
+	}
+	growth = bounds[1] / bounds[0]
+	if !(growth > 1) || math.IsInf(growth, 0) {
+		return 0, false
+	}
+	for i, b := range bounds {
+		want := bounds[0] * math.Pow(growth, float64(i))
+		if math.Abs(b-want) > boundsTolerance*want {
+			return 0, false
+		}
+	}
+	return growth, true
+}
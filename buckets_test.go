@@ -0,0 +1,174 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"go.opencensus.io/metric/metricdata"
+	distributionpb "google.golang.org/genproto/googleapis/api/distribution"
+)
+
+func explicitDistribution(bounds []float64, counts ...int64) *distributionpb.Distribution {
+	return &distributionpb.Distribution{
+		BucketOptions: &distributionpb.Distribution_BucketOptions{
+			Options: &distributionpb.Distribution_BucketOptions_ExplicitBuckets{
+				ExplicitBuckets: &distributionpb.Distribution_BucketOptions_Explicit{Bounds: bounds},
+			},
+		},
+		BucketCounts: counts,
+	}
+}
+
+func linearOptions(n int32, width, offset float64) *distributionpb.Distribution_BucketOptions {
+	return &distributionpb.Distribution_BucketOptions{
+		Options: &distributionpb.Distribution_BucketOptions_LinearBuckets{
+			LinearBuckets: &distributionpb.Distribution_BucketOptions_Linear{NumFiniteBuckets: n, Width: width, Offset: offset},
+		},
+	}
+}
+
+func exponentialOptions(n int32, growth, scale float64) *distributionpb.Distribution_BucketOptions {
+	return &distributionpb.Distribution_BucketOptions{
+		Options: &distributionpb.Distribution_BucketOptions_ExponentialBuckets{
+			ExponentialBuckets: &distributionpb.Distribution_BucketOptions_Exponential{NumFiniteBuckets: n, GrowthFactor: growth, Scale: scale},
+		},
+	}
+}
+
+func TestCompactBucketOptions(t *testing.T) {
+	tests := []struct {
+		name       string
+		in         *distributionpb.Distribution
+		wantOpts   *distributionpb.Distribution_BucketOptions
+		wantCounts []int64
+	}{
+		{
+			name:       "linear with zero bound",
+			in:         explicitDistribution([]float64{0, 10, 20, 30, 40}, 0, 1, 2, 3, 4, 5),
+			wantOpts:   linearOptions(4, 10, 0),
+			wantCounts: []int64{0, 1, 2, 3, 4, 5},
+		},
+		{
+			name:       "linear with offset",
+			in:         explicitDistribution([]float64{-5, 0, 5}, 1, 2, 3, 4),
+			wantOpts:   linearOptions(2, 5, -5),
+			wantCounts: []int64{1, 2, 3, 4},
+		},
+		{
+			name:       "inexact linear",
+			in:         explicitDistribution([]float64{0.1, 0.2, 0.30000000000000004}, 1, 2, 3, 4),
+			wantOpts:   linearOptions(2, 0.1, 0.1),
+			wantCounts: []int64{1, 2, 3, 4},
+		},
+		{
+			name:       "exponential",
+			in:         explicitDistribution([]float64{1, 2, 4, 8}, 1, 2, 3, 4, 5),
+			wantOpts:   exponentialOptions(3, 2, 1),
+			wantCounts: []int64{1, 2, 3, 4, 5},
+		},
+		{
+			name:       "exponential with zero bound",
+			in:         explicitDistribution([]float64{0, 100, 1000, 10000}, 0, 1, 2, 3, 4),
+			wantOpts:   exponentialOptions(2, 10, 100),
+			wantCounts: []int64{1, 2, 3, 4},
+		},
+		{
+			name:       "exponential with trailing counts omitted",
+			in:         explicitDistribution([]float64{0, 1, 3, 9}, 0, 7),
+			wantOpts:   exponentialOptions(2, 3, 1),
+			wantCounts: []int64{7},
+		},
+		{
+			name:       "irregular",
+			in:         explicitDistribution([]float64{0, 2, 4, 7}, 1, 2, 3, 4, 5),
+			wantOpts:   explicitDistribution([]float64{0, 2, 4, 7}).BucketOptions,
+			wantCounts: []int64{1, 2, 3, 4, 5},
+		},
+		{
+			name:       "too few bounds",
+			in:         explicitDistribution([]float64{1, 2}, 1, 2, 3),
+			wantOpts:   explicitDistribution([]float64{1, 2}).BucketOptions,
+			wantCounts: []int64{1, 2, 3},
+		},
+		{
+			name:       "too many counts",
+			in:         explicitDistribution([]float64{1, 2, 3}, 1, 2, 3, 4, 5),
+			wantOpts:   explicitDistribution([]float64{1, 2, 3}).BucketOptions,
+			wantCounts: []int64{1, 2, 3, 4, 5},
+		},
+		{
+			name: "no bucket options",
+			in:   &distributionpb.Distribution{Count: 1},
+		},
+	}
+	for _, tt := range tests {
+		compactBucketOptions(tt.in)
+		if !proto.Equal(tt.in.BucketOptions, tt.wantOpts) {
+			t.Errorf("%s: bucket options = %v; want %v", tt.name, tt.in.BucketOptions, tt.wantOpts)
+		}
+		if !equalCounts(tt.in.BucketCounts, tt.wantCounts) {
+			t.Errorf("%s: bucket counts = %v; want %v", tt.name, tt.in.BucketCounts, tt.wantCounts)
+		}
+	}
+}
+
+func equalCounts(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMetricToMpbTsCompactBucketOptions(t *testing.T) {
+	metric := &metricdata.Metric{
+		Descriptor: metricdata.Descriptor{Name: "latency", Type: metricdata.TypeCumulativeDistribution},
+		TimeSeries: []*metricdata.TimeSeries{{
+			StartTime: time.Unix(1000, 0),
+			Points: []metricdata.Point{metricdata.NewDistributionPoint(time.Unix(1060, 0), &metricdata.Distribution{
+				Count:         3,
+				Sum:           35,
+				BucketOptions: &metricdata.BucketOptions{Bounds: []float64{10, 100, 1000}},
+				Buckets:       []metricdata.Bucket{{Count: 1}, {Count: 2}, {}, {}},
+			})},
+		}},
+	}
+
+	for _, compact := range []bool{false, true} {
+		se := &statsExporter{o: Options{ProjectID: "foo", CompactBucketOptions: compact}}
+		tsl, err := se.metricToMpbTs(context.Background(), metric)
+		if err != nil || len(tsl) != 1 {
+			t.Fatalf("metricToMpbTs() = %v, %v; want one time series", tsl, err)
+		}
+		d := tsl[0].Points[0].Value.GetDistributionValue()
+		wantOpts := explicitDistribution([]float64{0, 10, 100, 1000}).BucketOptions
+		wantCounts := []int64{0, 1, 2, 0, 0}
+		if compact {
+			wantOpts = exponentialOptions(2, 10, 10)
+			wantCounts = []int64{1, 2, 0, 0}
+		}
+		if !proto.Equal(d.BucketOptions, wantOpts) || !equalCounts(d.BucketCounts, wantCounts) {
+			t.Errorf("CompactBucketOptions %v: distribution = %v; want bucket options %v and counts %v", compact, d, wantOpts, wantCounts)
+		}
+	}
+}
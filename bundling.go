@@ -0,0 +1,177 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"fmt"
+	"time"
+
+	"google.golang.org/api/support/bundler"
+)
+
+// BundleOptions configures how the spans, view data or metrics are batched
+// before being uploaded. The unset fields default to the values derived
+// from BundleDelayThreshold, BundleCountThreshold, NumberOfWorkers and
+// TraceSpansBufferMaxBytes in Options, as before BundleOptions existed.
+//
+// The size of a span is the size of its encoding. The size of view data or
+// of a metric is its number of rows or time series if one of ByteThreshold,
+// ByteLimit and BufferedByteLimit is set, and 1 otherwise.
+type BundleOptions struct {
+	// DelayThreshold is the maximum time an item waits before its bundle
+	// is uploaded. It defaults to Options.BundleDelayThreshold, or to 2s
+	// for spans and 1s for view data and metrics.
+	DelayThreshold time.Duration
+
+	// CountThreshold is the number of items triggering the upload of a
+	// bundle. It defaults to Options.BundleCountThreshold, or to 50 for
+	// spans and 10 for view data and metrics.
+	CountThreshold int
+
+	// ByteThreshold is the size of the items triggering the upload of a
+	// bundle. It defaults to 200 times CountThreshold for spans, and to
+	// 1000000 for view data and metrics.
+	ByteThreshold int
+
+	// ByteLimit is the maximum size of a bundle. Bigger items are dropped.
+	// It defaults to 1000 times CountThreshold for spans, and is not
+	// limited for view data and metrics.
+	ByteLimit int
+
+	// BufferedByteLimit is the maximum size of the items waiting to be
+	// uploaded; the items exceeding it are dropped. It defaults to
+	// Options.TraceSpansBufferMaxBytes, or 8MB, for spans, and to 1e9
+	// for view data and metrics.
+	BufferedByteLimit int
+
+	// HandlerLimit is the maximum number of bundles uploaded concurrently.
+	// It defaults to Options.NumberOfWorkers for spans, and to 1.
+	HandlerLimit int
+}
+
+// validate returns an error if b is invalid. signal names the data it
+// applies to in the error.
+func (b BundleOptions) validate(signal string) error {
+	switch {
+	case b.DelayThreshold < 0, b.CountThreshold < 0, b.ByteThreshold < 0,
+		b.ByteLimit < 0, b.BufferedByteLimit < 0, b.HandlerLimit < 0:
+		return fmt.Errorf("stackdriver: %s bundle options must not be negative", signal)
+	case b.ByteLimit > 0 && b.ByteThreshold > b.ByteLimit:
+		return fmt.Errorf("stackdriver: %s bundle ByteThreshold (%d) exceeds ByteLimit (%d)", signal, b.ByteThreshold, b.ByteLimit)
+	case b.BufferedByteLimit > 0 && b.ByteLimit > b.BufferedByteLimit:
+		return fmt.Errorf("stackdriver: %s bundle ByteLimit (%d) exceeds BufferedByteLimit (%d)", signal, b.ByteLimit, b.BufferedByteLimit)
+	}
+	return nil
+}
+
+// validateBundleOptions returns an error if one of the bundle options of o,
+// or its overflow policy, is invalid.
+func (o *Options) validateBundleOptions() error {
+	if o.OverflowPolicy < OverflowDropNewest || o.OverflowPolicy > OverflowBlock {
+		return fmt.Errorf("stackdriver: unknown overflow policy %d", o.OverflowPolicy)
+	}
+	if err := o.TraceBundleOptions.validate("trace"); err != nil {
+		return err
+	}
+	if err := o.ViewDataBundleOptions.validate("view data"); err != nil {
+		return err
+	}
+	return o.MetricsBundleOptions.validate("metrics")
+}
+
+// traceBundleOptions returns the bundle options of spans, with the
+// defaults applied.
+func (o *Options) traceBundleOptions() BundleOptions {
+	b := o.TraceBundleOptions
+	b.applyShared(o, 2*time.Second, 50)
+	if b.ByteThreshold == 0 {
+		b.ByteThreshold = b.CountThreshold * 200
+	}
+	if b.ByteLimit == 0 {
+		b.ByteLimit = b.CountThreshold * 1000
+	}
+	if b.BufferedByteLimit == 0 {
+		b.BufferedByteLimit = o.TraceSpansBufferMaxBytes
+	}
+	if b.BufferedByteLimit <= 0 {
+		b.BufferedByteLimit = defaultBufferedByteLimit
+	}
+	if b.HandlerLimit == 0 {
+		b.HandlerLimit = o.NumberOfWorkers
+	}
+	return b.withBundlerDefaults()
+}
+
+// statsBundleOptions returns b, the bundle options of view data or metrics,
+// with the defaults applied.
+func (o *Options) statsBundleOptions(b BundleOptions) BundleOptions {
+	b.applyShared(o, bundler.DefaultDelayThreshold, bundler.DefaultBundleCountThreshold)
+	if b.BufferedByteLimit == 0 {
+		b.BufferedByteLimit = bundler.DefaultBufferedByteLimit
+	}
+	return b.withBundlerDefaults()
+}
+
+// statsItemSize returns the bundler size of view data or of a metric with n
+// rows or time series, b being the bundle options set by the user: n if one
+// of their byte sizes is set, and 1 otherwise, as before BundleOptions
+// existed.
+func (b BundleOptions) statsItemSize(n int) int {
+	if n == 0 || b.ByteThreshold == 0 && b.ByteLimit == 0 && b.BufferedByteLimit == 0 {
+		return 1
+	}
+	return n
+}
+
+// applyShared sets the delay and count thresholds of b from the options
+// shared by all signals, or from the given defaults.
+func (b *BundleOptions) applyShared(o *Options, delay time.Duration, count int) {
+	if b.DelayThreshold == 0 {
+		b.DelayThreshold = o.BundleDelayThreshold
+	}
+	if b.DelayThreshold <= 0 {
+		b.DelayThreshold = delay
+	}
+	if b.CountThreshold == 0 {
+		b.CountThreshold = o.BundleCountThreshold
+	}
+	if b.CountThreshold <= 0 {
+		b.CountThreshold = count
+	}
+}
+
+// withBundlerDefaults returns b with the defaults of the bundler package
+// applied to its remaining unset fields.
+func (b BundleOptions) withBundlerDefaults() BundleOptions {
+	if b.ByteThreshold <= 0 {
+		b.ByteThreshold = bundler.DefaultBundleByteThreshold
+	}
+	if b.HandlerLimit <= 0 {
+		b.HandlerLimit = 1
+	}
+	return b
+}
+
+// newBundler returns a bundler of itemExample items configured with b.
+func (b BundleOptions) newBundler(itemExample interface{}, handler func(interface{})) *bundler.Bundler {
+	bu := bundler.NewBundler(itemExample, handler)
+	bu.DelayThreshold = b.DelayThreshold
+	bu.BundleCountThreshold = b.CountThreshold
+	bu.BundleByteThreshold = b.ByteThreshold
+	bu.BundleByteLimit = b.ByteLimit
+	bu.BufferedByteLimit = b.BufferedByteLimit
+	bu.HandlerLimit = b.HandlerLimit
+	return bu
+}
@@ -0,0 +1,123 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/api/support/bundler"
+)
+
+func TestBundleOptionsDefaults(t *testing.T) {
+	var o Options
+	if got, want := o.traceBundleOptions(), (BundleOptions{
+		DelayThreshold:    2 * time.Second,
+		CountThreshold:    50,
+		ByteThreshold:     10000,
+		ByteLimit:         50000,
+		BufferedByteLimit: defaultBufferedByteLimit,
+		HandlerLimit:      1,
+	}); got != want {
+		t.Errorf("traceBundleOptions() = %+v; want %+v", got, want)
+	}
+	if got, want := o.statsBundleOptions(o.ViewDataBundleOptions), (BundleOptions{
+		DelayThreshold:    time.Second,
+		CountThreshold:    10,
+		ByteThreshold:     1e6,
+		BufferedByteLimit: bundler.DefaultBufferedByteLimit,
+		HandlerLimit:      1,
+	}); got != want {
+		t.Errorf("statsBundleOptions() = %+v; want %+v", got, want)
+	}
+}
+
+func TestBundleOptionsShared(t *testing.T) {
+	o := Options{
+		BundleDelayThreshold:     time.Minute,
+		BundleCountThreshold:     5,
+		NumberOfWorkers:          3,
+		TraceSpansBufferMaxBytes: 1 << 20,
+		TraceBundleOptions:       BundleOptions{CountThreshold: 7},
+		MetricsBundleOptions:     BundleOptions{DelayThreshold: time.Second, HandlerLimit: 2},
+	}
+	if got, want := o.traceBundleOptions(), (BundleOptions{
+		DelayThreshold:    time.Minute,
+		CountThreshold:    7,
+		ByteThreshold:     1400,
+		ByteLimit:         7000,
+		BufferedByteLimit: 1 << 20,
+		HandlerLimit:      3,
+	}); got != want {
+		t.Errorf("traceBundleOptions() = %+v; want %+v", got, want)
+	}
+	if got, want := o.statsBundleOptions(o.ViewDataBundleOptions), (BundleOptions{
+		DelayThreshold:    time.Minute,
+		CountThreshold:    5,
+		ByteThreshold:     1e6,
+		BufferedByteLimit: bundler.DefaultBufferedByteLimit,
+		HandlerLimit:      1,
+	}); got != want {
+		t.Errorf("view data statsBundleOptions() = %+v; want %+v", got, want)
+	}
+	if got, want := o.statsBundleOptions(o.MetricsBundleOptions), (BundleOptions{
+		DelayThreshold:    time.Second,
+		CountThreshold:    5,
+		ByteThreshold:     1e6,
+		BufferedByteLimit: bundler.DefaultBufferedByteLimit,
+		HandlerLimit:      2,
+	}); got != want {
+		t.Errorf("metrics statsBundleOptions() = %+v; want %+v", got, want)
+	}
+}
+
+func TestStatsItemSize(t *testing.T) {
+	tests := []struct {
+		name string
+		b    BundleOptions
+		n    int
+		want int
+	}{
+		{"unset", BundleOptions{}, 500, 1},
+		{"count only", BundleOptions{CountThreshold: 5}, 500, 1},
+		{"byte threshold", BundleOptions{ByteThreshold: 1000}, 500, 500},
+		{"buffered limit", BundleOptions{BufferedByteLimit: 1000}, 500, 500},
+		{"empty", BundleOptions{ByteLimit: 1000}, 0, 1},
+	}
+	for _, tt := range tests {
+		if got := tt.b.statsItemSize(tt.n); got != tt.want {
+			t.Errorf("%s: statsItemSize(%d) = %d; want %d", tt.name, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestBundleOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		o       Options
+		wantErr bool
+	}{
+		{"zero", Options{}, false},
+		{"valid", Options{TraceBundleOptions: BundleOptions{ByteThreshold: 10, ByteLimit: 20, BufferedByteLimit: 30}}, false},
+		{"negative", Options{ViewDataBundleOptions: BundleOptions{CountThreshold: -1}}, true},
+		{"threshold above limit", Options{MetricsBundleOptions: BundleOptions{ByteThreshold: 30, ByteLimit: 20}}, true},
+		{"limit above buffer", Options{TraceBundleOptions: BundleOptions{ByteLimit: 30, BufferedByteLimit: 20}}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.o.validateBundleOptions(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: validateBundleOptions() = %v; want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	distributionpb "google.golang.org/genproto/googleapis/api/distribution"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// CumulativeOptions configures how the exporter keeps the cumulative time
+// series written to Stackdriver Monitoring consistent. Stackdriver rejects
+// the cumulative points whose start time moves back, and the points whose
+// value goes down without a new start time, so the exporter tracks the
+// interval of each series:
+//
+//   - when the value of a series goes down, or its start time changes, as
+//     when the reporting process restarts, a new interval is started after
+//     the last point written;
+//   - the points older than the last point written are dropped.
+//
+// Points must be exported in order; with more than one HandlerLimit in
+// MetricsBundleOptions, concurrent uploads may drop some of them.
+type CumulativeOptions struct {
+	// IsDelta reports whether the points of the cumulative metric with the
+	// given name hold deltas, the change since the previous point, rather
+	// than cumulative values. These points are summed into a cumulative
+	// series starting at the start time of its first point. If nil, no
+	// metric holds deltas.
+	IsDelta func(metricName string) bool
+
+	// MaxIdle is the time after which the state of a series that received
+	// no point is forgotten. Its next point starts a new series. If unset,
+	// a default of 1 hour is used.
+	MaxIdle time.Duration
+}
+
+const defaultCumulativeMaxIdle = time.Hour
+
+var errPointsOutOfOrder = errors.New("cumulative points older than the last point written")
+
+// cumulativeSeries is the state of one cumulative time series.
+type cumulativeSeries struct {
+	// start and end are the interval of the last point written.
+	start, end time.Time
+	// reportedStart and reported are the start time and value of the last
+	// point received.
+	reportedStart time.Time
+	reported      *monitoringpb.TypedValue
+	// total is the sum of the points received, for delta metrics.
+	total    *monitoringpb.TypedValue
+	lastSeen time.Time
+}
+
+// cumulativeTracker adjusts the points of cumulative time series so that
+// they form valid cumulative series. A nil *cumulativeTracker leaves the
+// points unchanged.
+type cumulativeTracker struct {
+	isDelta func(string) bool
+	maxIdle time.Duration
+	now     func() time.Time
+
+	mu        sync.Mutex
+	series    map[string]*cumulativeSeries
+	lastSweep time.Time
+}
+
+func newCumulativeTracker(o *CumulativeOptions) *cumulativeTracker {
+	if o == nil {
+		return nil
+	}
+	t := &cumulativeTracker{
+		isDelta: o.IsDelta,
+		maxIdle: o.MaxIdle,
+		now:     time.Now,
+		series:  make(map[string]*cumulativeSeries),
+	}
+	if t.maxIdle <= 0 {
+		t.maxIdle = defaultCumulativeMaxIdle
+	}
+	return t
+}
+
+// adjust rewrites the points of ts, a time series of the metric with the
+// given name, and removes the points that cannot be written. It returns the
+// number of points removed. Gauge points, which have no start time, are
+// left unchanged.
+func (t *cumulativeTracker) adjust(metricName string, ts *monitoringpb.TimeSeries) (dropped int) {
+	if t == nil {
+		return 0
+	}
+	delta := t.isDelta != nil && t.isDelta(metricName)
+	key := seriesKey(ts)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	t.sweep(now)
+
+	points := ts.Points[:0]
+	for _, pt := range ts.Points {
+		if pt.GetInterval().GetStartTime() == nil || pt.GetValue() == nil {
+			points = append(points, pt)
+			continue
+		}
+		s := t.series[key]
+		if s == nil {
+			s = &cumulativeSeries{}
+			t.series[key] = s
+		}
+		s.lastSeen = now
+		if delta {
+			if !s.addDelta(pt) {
+				dropped++
+				continue
+			}
+		} else if !s.addCumulative(pt) {
+			dropped++
+			continue
+		}
+		points = append(points, pt)
+	}
+	for i := len(points); i < len(ts.Points); i++ {
+		ts.Points[i] = nil
+	}
+	ts.Points = points
+	return dropped
+}
+
+// sweep forgets the series idle for more than maxIdle. It runs at most once
+// per maxIdle.
+func (t *cumulativeTracker) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < t.maxIdle {
+		return
+	}
+	t.lastSweep = now
+	for key, s := range t.series {
+		if now.Sub(s.lastSeen) > t.maxIdle {
+			delete(t.series, key)
+		}
+	}
+}
+
+// addCumulative records pt, a point holding a cumulative value, and moves
+// its start time to the interval of the series. It returns false if pt is
+// out of order and must be dropped.
+func (s *cumulativeSeries) addCumulative(pt *monitoringpb.Point) bool {
+	start := pt.Interval.StartTime.AsTime()
+	end := pt.Interval.EndTime.AsTime()
+	switch {
+	case s.reported == nil:
+		s.start = start
+	case !end.After(s.end):
+		return false
+	case !start.Equal(s.reportedStart) || valueDecreased(pt.Value, s.reported):
+		// The series was reset: start a new interval, which must not
+		// overlap the points already written.
+		s.start = startAfter(s.end, start, end)
+	}
+	s.reportedStart = start
+	s.reported = pt.Value
+	s.end = end
+	pt.Interval.StartTime = timestampProto(s.start)
+	return true
+}
+
+// addDelta adds pt, a point holding a delta, to the series and replaces its
+// value with the total. It returns false if pt is out of order and must be
+// dropped.
+func (s *cumulativeSeries) addDelta(pt *monitoringpb.Point) bool {
+	start := pt.Interval.StartTime.AsTime()
+	end := pt.Interval.EndTime.AsTime()
+	switch {
+	case s.total == nil:
+		s.start = start
+		s.total = proto.Clone(pt.Value).(*monitoringpb.TypedValue)
+	case !end.After(s.end):
+		return false
+	default:
+		total, ok := addValues(s.total, pt.Value)
+		if !ok {
+			// The value type or the buckets changed: start a new series.
+			s.start = startAfter(s.end, start, end)
+			total = proto.Clone(pt.Value).(*monitoringpb.TypedValue)
+		}
+		s.total = total
+	}
+	s.end = end
+	pt.Interval.StartTime = timestampProto(s.start)
+	pt.Value = proto.Clone(s.total).(*monitoringpb.TypedValue)
+	return true
+}
+
+// startAfter returns the start time of a new interval ending at end and
+// following a point ending at prevEnd: start if it is after prevEnd, or
+// shortly after prevEnd otherwise.
+func startAfter(prevEnd, start, end time.Time) time.Time {
+	if start.After(prevEnd) {
+		return start
+	}
+	if next := prevEnd.Add(time.Millisecond); next.Before(end) {
+		return next
+	}
+	return prevEnd
+}
+
+// valueDecreased reports whether v is lower than prev, the previous value of
+// the same series. For distributions, the counts are compared.
+func valueDecreased(v, prev *monitoringpb.TypedValue) bool {
+	switch v := v.Value.(type) {
+	case *monitoringpb.TypedValue_Int64Value:
+		return v.Int64Value < prev.GetInt64Value()
+	case *monitoringpb.TypedValue_DoubleValue:
+		return v.DoubleValue < prev.GetDoubleValue()
+	case *monitoringpb.TypedValue_DistributionValue:
+		return v.DistributionValue.GetCount() < prev.GetDistributionValue().GetCount()
+	}
+	return false
+}
+
+// addValues returns the sum of total and v. It returns false if they have
+// different types, or are distributions with different buckets.
+func addValues(total, v *monitoringpb.TypedValue) (*monitoringpb.TypedValue, bool) {
+	switch v := v.Value.(type) {
+	case *monitoringpb.TypedValue_Int64Value:
+		t, ok := total.Value.(*monitoringpb.TypedValue_Int64Value)
+		if !ok {
+			return nil, false
+		}
+		return &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_Int64Value{Int64Value: t.Int64Value + v.Int64Value}}, true
+	case *monitoringpb.TypedValue_DoubleValue:
+		t, ok := total.Value.(*monitoringpb.TypedValue_DoubleValue)
+		if !ok {
+			return nil, false
+		}
+		return &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: t.DoubleValue + v.DoubleValue}}, true
+	case *monitoringpb.TypedValue_DistributionValue:
+		t, ok := total.Value.(*monitoringpb.TypedValue_DistributionValue)
+		if !ok {
+			return nil, false
+		}
+		d, ok := addDistributions(t.DistributionValue, v.DistributionValue)
+		if !ok {
+			return nil, false
+		}
+		return &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DistributionValue{DistributionValue: d}}, true
+	}
+	return nil, false
+}
+
+// addDistributions returns the distribution of the values of a and b. The
+// exemplars of b are kept.
+func addDistributions(a, b *distributionpb.Distribution) (*distributionpb.Distribution, bool) {
+	if !proto.Equal(a.BucketOptions, b.BucketOptions) {
+		return nil, false
+	}
+	n := a.Count + b.Count
+	d := &distributionpb.Distribution{
+		Count:         n,
+		BucketOptions: a.BucketOptions,
+		Exemplars:     b.Exemplars,
+	}
+	switch {
+	case a.Count == 0:
+		d.Range = b.Range
+	case b.Count == 0:
+		d.Range = a.Range
+	default:
+		d.Range = mergeRanges(a.Range, b.Range)
+	}
+	if n > 0 {
+		ca, cb := float64(a.Count), float64(b.Count)
+		d.Mean = (a.Mean*ca + b.Mean*cb) / float64(n)
+		diff := a.Mean - b.Mean
+		d.SumOfSquaredDeviation = a.SumOfSquaredDeviation + b.SumOfSquaredDeviation + diff*diff*ca*cb/float64(n)
+	}
+	if len(a.BucketCounts) > 0 || len(b.BucketCounts) > 0 {
+		counts := len(a.BucketCounts)
+		if len(b.BucketCounts) > counts {
+			counts = len(b.BucketCounts)
+		}
+		d.BucketCounts = make([]int64, counts)
+		for i, c := range a.BucketCounts {
+			d.BucketCounts[i] += c
+		}
+		for i, c := range b.BucketCounts {
+			d.BucketCounts[i] += c
+		}
+	}
+	return d, true
+}
+
+// seriesKey returns a key identifying the series of ts by its metric type,
+// resource and labels.
+func seriesKey(ts *monitoringpb.TimeSeries) string {
+	var b strings.Builder
+	b.WriteString(ts.GetMetric().GetType())
+	writeLabels(&b, ts.GetMetric().GetLabels())
+	b.WriteByte('\x00')
+	b.WriteString(ts.GetResource().GetType())
+	writeLabels(&b, ts.GetResource().GetLabels())
+	return b.String()
+}
+
+func writeLabels(b *strings.Builder, labels map[string]string) {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b.WriteByte('\x00')
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(labels[k])
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"go.opencensus.io/metric/metricdata"
+	distributionpb "google.golang.org/genproto/googleapis/api/distribution"
+	googlemetricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+var cumulativeEpoch = time.Unix(1000, 0)
+
+// at returns the time sec seconds after cumulativeEpoch.
+func at(sec int) time.Time {
+	return cumulativeEpoch.Add(time.Duration(sec) * time.Second)
+}
+
+func cumulativeInt64Series(start, end time.Time, v int64) *monitoringpb.TimeSeries {
+	return &monitoringpb.TimeSeries{
+		Metric: &googlemetricpb.Metric{Type: "custom.googleapis.com/opencensus/requests", Labels: map[string]string{"method": "GET"}},
+		Points: []*monitoringpb.Point{{
+			Interval: &monitoringpb.TimeInterval{StartTime: timestampProto(start), EndTime: timestampProto(end)},
+			Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_Int64Value{Int64Value: v}},
+		}},
+	}
+}
+
+func pointStart(ts *monitoringpb.TimeSeries) time.Time {
+	return ts.Points[0].Interval.StartTime.AsTime()
+}
+
+func TestCumulativeTrackerResets(t *testing.T) {
+	ct := newCumulativeTracker(&CumulativeOptions{})
+	tests := []struct {
+		name        string
+		start, end  time.Time
+		value       int64
+		wantStart   time.Time
+		wantDropped bool
+	}{
+		{"first point", at(0), at(10), 5, at(0), false},
+		{"increase", at(0), at(20), 8, at(0), false},
+		{"out of order", at(0), at(15), 9, time.Time{}, true},
+		{"counter reset", at(0), at(30), 2, at(20).Add(time.Millisecond), false},
+		{"after reset", at(0), at(40), 4, at(20).Add(time.Millisecond), false},
+		{"process restart", at(45), at(50), 1, at(45), false},
+		{"start moved back", at(5), at(60), 3, at(50).Add(time.Millisecond), false},
+	}
+	for _, tt := range tests {
+		ts := cumulativeInt64Series(tt.start, tt.end, tt.value)
+		dropped := ct.adjust("requests", ts)
+		if tt.wantDropped {
+			if dropped != 1 || len(ts.Points) != 0 {
+				t.Errorf("%s: adjust() dropped %d points, left %d; want the point dropped", tt.name, dropped, len(ts.Points))
+			}
+			continue
+		}
+		if dropped != 0 || len(ts.Points) != 1 {
+			t.Fatalf("%s: adjust() dropped %d points, left %d; want the point kept", tt.name, dropped, len(ts.Points))
+		}
+		if got := pointStart(ts); !got.Equal(tt.wantStart) {
+			t.Errorf("%s: start time = %v; want %v", tt.name, got, tt.wantStart)
+		}
+		if got := ts.Points[0].Value.GetInt64Value(); got != tt.value {
+			t.Errorf("%s: value = %d; want %d", tt.name, got, tt.value)
+		}
+	}
+}
+
+func TestCumulativeTrackerDeltas(t *testing.T) {
+	ct := newCumulativeTracker(&CumulativeOptions{
+		IsDelta: func(name string) bool { return name == "requests" },
+	})
+	deltas := []struct {
+		start, end time.Time
+		value      int64
+		want       int64
+	}{
+		{at(0), at(10), 5, 5},
+		{at(10), at(20), 3, 8},
+		{at(20), at(30), 0, 8},
+		{at(30), at(40), 4, 12},
+	}
+	for i, d := range deltas {
+		ts := cumulativeInt64Series(d.start, d.end, d.value)
+		if dropped := ct.adjust("requests", ts); dropped != 0 {
+			t.Fatalf("#%d: adjust() dropped %d points", i, dropped)
+		}
+		if got := pointStart(ts); !got.Equal(at(0)) {
+			t.Errorf("#%d: start time = %v; want %v", i, got, at(0))
+		}
+		if got := ts.Points[0].Value.GetInt64Value(); got != d.want {
+			t.Errorf("#%d: value = %d; want %d", i, got, d.want)
+		}
+	}
+
+	// A repeated delta must not be counted twice.
+	ts := cumulativeInt64Series(at(30), at(40), 4)
+	if dropped := ct.adjust("requests", ts); dropped != 1 {
+		t.Errorf("adjust() of a repeated delta dropped %d points; want 1", dropped)
+	}
+
+	// Other metrics hold cumulative values.
+	for i, v := range []int64{5, 3} {
+		ts := cumulativeInt64Series(at(0), at(10*(i+1)), v)
+		ct.adjust("latency", ts)
+		if got := ts.Points[0].Value.GetInt64Value(); got != v {
+			t.Errorf("latency #%d: value = %d; want %d", i, got, v)
+		}
+	}
+}
+
+func TestCumulativeTrackerDistributionDeltas(t *testing.T) {
+	ct := newCumulativeTracker(&CumulativeOptions{IsDelta: func(string) bool { return true }})
+	buckets := &distributionpb.Distribution_BucketOptions{
+		Options: &distributionpb.Distribution_BucketOptions_ExplicitBuckets{
+			ExplicitBuckets: &distributionpb.Distribution_BucketOptions_Explicit{Bounds: []float64{10}},
+		},
+	}
+	// Values 2 and 4, then 20.
+	dists := []*distributionpb.Distribution{
+		{Count: 2, Mean: 3, SumOfSquaredDeviation: 2, BucketOptions: buckets, BucketCounts: []int64{2, 0}},
+		{Count: 1, Mean: 20, BucketOptions: buckets, BucketCounts: []int64{0, 1}},
+	}
+	var got *distributionpb.Distribution
+	for i, d := range dists {
+		ts := &monitoringpb.TimeSeries{
+			Metric: &googlemetricpb.Metric{Type: "custom.googleapis.com/opencensus/latency"},
+			Points: []*monitoringpb.Point{{
+				Interval: &monitoringpb.TimeInterval{StartTime: timestampProto(at(10 * i)), EndTime: timestampProto(at(10 * (i + 1)))},
+				Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DistributionValue{DistributionValue: d}},
+			}},
+		}
+		ct.adjust("latency", ts)
+		got = ts.Points[0].Value.GetDistributionValue()
+	}
+
+	// The mean of 2, 4 and 20 is 26/3.
+	mean := 26.0 / 3
+	ssd := (2-mean)*(2-mean) + (4-mean)*(4-mean) + (20-mean)*(20-mean)
+	if got.Count != 3 || math.Abs(got.Mean-mean) > 1e-9 || math.Abs(got.SumOfSquaredDeviation-ssd) > 1e-9 {
+		t.Errorf("distribution = count %d, mean %v, ssd %v; want count 3, mean %v, ssd %v", got.Count, got.Mean, got.SumOfSquaredDeviation, mean, ssd)
+	}
+	if len(got.BucketCounts) != 2 || got.BucketCounts[0] != 2 || got.BucketCounts[1] != 1 {
+		t.Errorf("bucket counts = %v; want [2 1]", got.BucketCounts)
+	}
+}
+
+func TestCumulativeTrackerIdle(t *testing.T) {
+	now := at(0)
+	ct := newCumulativeTracker(&CumulativeOptions{IsDelta: func(string) bool { return true }, MaxIdle: time.Minute})
+	ct.now = func() time.Time { return now }
+
+	ct.adjust("requests", cumulativeInt64Series(at(0), at(10), 5))
+	now = now.Add(2 * time.Minute)
+	ts := cumulativeInt64Series(at(120), at(130), 3)
+	ct.adjust("requests", ts)
+	if got := ts.Points[0].Value.GetInt64Value(); got != 3 {
+		t.Errorf("value after idle series = %d; want 3", got)
+	}
+	if got := pointStart(ts); !got.Equal(at(120)) {
+		t.Errorf("start time after idle series = %v; want %v", got, at(120))
+	}
+}
+
+func TestMetricToMpbTsCumulative(t *testing.T) {
+	se := &statsExporter{
+		o:          Options{ProjectID: "foo"},
+		cumulative: newCumulativeTracker(&CumulativeOptions{IsDelta: func(string) bool { return true }}),
+	}
+	metric := func(start, end time.Time, v int64) *metricdata.Metric {
+		return &metricdata.Metric{
+			Descriptor: metricdata.Descriptor{Name: "requests", Type: metricdata.TypeCumulativeInt64},
+			TimeSeries: []*metricdata.TimeSeries{{
+				StartTime: start,
+				Points:    []metricdata.Point{metricdata.NewInt64Point(end, v)},
+			}},
+		}
+	}
+
+	for i, want := range []int64{5, 7} {
+		tsl, err := se.metricToMpbTs(context.Background(), metric(at(10*i), at(10*(i+1)), 5-int64(3*i)))
+		if err != nil || len(tsl) != 1 {
+			t.Fatalf("#%d: metricToMpbTs() = %v, %v; want one time series", i, tsl, err)
+		}
+		if got := tsl[0].Points[0].Value.GetInt64Value(); got != want {
+			t.Errorf("#%d: value = %d; want %d", i, got, want)
+		}
+		if got := pointStart(tsl[0]); !got.Equal(at(0)) {
+			t.Errorf("#%d: start time = %v; want %v", i, got, at(0))
+		}
+	}
+
+	tsl, err := se.metricToMpbTs(context.Background(), metric(at(0), at(5), 1))
+	if err != nil || len(tsl) != 0 {
+		t.Errorf("metricToMpbTs() of an old point = %v, %v; want no time series", tsl, err)
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+	"cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	labelpb "google.golang.org/genproto/googleapis/api/label"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DescriptorReconciliation is the policy applied when the metric descriptor
+// of a custom metric already exists in Stackdriver Monitoring.
+//
+// Unless the policy is ReconcileNone, the exporter fetches the existing
+// descriptor the first time it exports a metric, and compares its labels,
+// metric kind, value type and unit with the descriptor it would create.
+type DescriptorReconciliation int
+
+const (
+	// ReconcileNone creates the metric descriptors without checking the
+	// existing ones. Exports of a metric whose descriptor differs fail when
+	// its time series are written.
+	ReconcileNone DescriptorReconciliation = iota
+	// ReconcileReport passes a *DescriptorDriftError describing the
+	// differences to Options.OnError, and keeps exporting the metric.
+	ReconcileReport
+	// ReconcileUpdate deletes the existing descriptor and creates the new
+	// one. Deleting a metric descriptor deletes the data of the metric.
+	ReconcileUpdate
+	// ReconcileRefuse does not export the metric. Each export of its data
+	// fails with a *DescriptorDriftError.
+	ReconcileRefuse
+)
+
+// DescriptorDriftError describes how an existing metric descriptor differs
+// from the one the exporter would create.
+type DescriptorDriftError struct {
+	// MetricType is the type of the metric.
+	MetricType string
+
+	// Diffs lists the differences, for instance
+	// `label "method" is missing from the existing descriptor`.
+	Diffs []string
+}
+
+func (e *DescriptorDriftError) Error() string {
+	return fmt.Sprintf("metric descriptor of %q differs from the exported metric: %s", e.MetricType, strings.Join(e.Diffs, "; "))
+}
+
+var getMetricDescriptor = func(ctx context.Context, c *monitoring.MetricClient, req *monitoringpb.GetMetricDescriptorRequest) (*metricpb.MetricDescriptor, error) {
+	return c.GetMetricDescriptor(ctx, req)
+}
+
+var deleteMetricDescriptor = func(ctx context.Context, c *monitoring.MetricClient, req *monitoringpb.DeleteMetricDescriptorRequest) error {
+	return c.DeleteMetricDescriptor(ctx, req)
+}
+
+// reconcileMetricDescriptor creates md in Stackdriver Monitoring, after
+// applying Options.DescriptorReconciliation to the existing descriptor.
+func (e *statsExporter) reconcileMetricDescriptor(ctx context.Context, md *metricpb.MetricDescriptor) error {
+	policy := e.o.DescriptorReconciliation
+	if policy == ReconcileNone {
+		return e.createMetricDescriptor(ctx, md)
+	}
+
+	e.driftMu.Lock()
+	defer e.driftMu.Unlock()
+	if err, refused := e.refusedDescriptors[md.Type]; refused {
+		return err
+	}
+
+	var existing *metricpb.MetricDescriptor
+	err := e.o.RetryPolicy.invoke(ctx, e.o.Timeout, func(ctx context.Context) error {
+		start := time.Now()
+		var err error
+		existing, err = getMetricDescriptor(ctx, e.c, &monitoringpb.GetMetricDescriptorRequest{Name: md.Name})
+		e.sm.recordRPC(methodGetMetricDescriptor, start, err)
+		return err
+	})
+	if status.Code(err) == codes.NotFound {
+		return e.createMetricDescriptor(ctx, md)
+	}
+	if err != nil {
+		return err
+	}
+	diffs := diffMetricDescriptors(existing, md)
+	if len(diffs) == 0 {
+		return nil
+	}
+	drift := &DescriptorDriftError{MetricType: md.Type, Diffs: diffs}
+
+	switch policy {
+	case ReconcileReport:
+		e.o.handleError(drift)
+		return nil
+	case ReconcileUpdate:
+		err := e.o.RetryPolicy.invoke(ctx, e.o.Timeout, func(ctx context.Context) error {
+			start := time.Now()
+			err := deleteMetricDescriptor(ctx, e.c, &monitoringpb.DeleteMetricDescriptorRequest{Name: md.Name})
+			e.sm.recordRPC(methodDeleteMetricDescriptor, start, err)
+			return err
+		})
+		if err != nil && status.Code(err) != codes.NotFound {
+			return fmt.Errorf("%v: couldn't delete it: %v", drift, err)
+		}
+		return e.createMetricDescriptor(ctx, md)
+	default:
+		if e.refusedDescriptors == nil {
+			e.refusedDescriptors = make(map[string]*DescriptorDriftError)
+		}
+		e.refusedDescriptors[md.Type] = drift
+		return drift
+	}
+}
+
+// diffMetricDescriptors lists the differences between the existing
+// descriptor got and the descriptor want the exporter would create.
+func diffMetricDescriptors(got, want *metricpb.MetricDescriptor) []string {
+	var diffs []string
+	if got.MetricKind != want.MetricKind {
+		diffs = append(diffs, fmt.Sprintf("metric kind is %v, want %v", got.MetricKind, want.MetricKind))
+	}
+	if got.ValueType != want.ValueType {
+		diffs = append(diffs, fmt.Sprintf("value type is %v, want %v", got.ValueType, want.ValueType))
+	}
+	if got.Unit != want.Unit {
+		diffs = append(diffs, fmt.Sprintf("unit is %q, want %q", got.Unit, want.Unit))
+	}
+
+	gotLabels := labelTypes(got.Labels)
+	wantLabels := labelTypes(want.Labels)
+	for _, k := range sortedLabelKeys(wantLabels) {
+		gotType, ok := gotLabels[k]
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("label %q is missing from the existing descriptor", k))
+		case gotType != wantLabels[k]:
+			diffs = append(diffs, fmt.Sprintf("label %q is of type %v, want %v", k, gotType, wantLabels[k]))
+		}
+	}
+	for _, k := range sortedLabelKeys(gotLabels) {
+		if _, ok := wantLabels[k]; !ok {
+			diffs = append(diffs, fmt.Sprintf("label %q is no longer exported", k))
+		}
+	}
+	return diffs
+}
+
+func labelTypes(labels []*labelpb.LabelDescriptor) map[string]labelpb.LabelDescriptor_ValueType {
+	m := make(map[string]labelpb.LabelDescriptor_ValueType, len(labels))
+	for _, l := range labels {
+		m[l.Key] = l.ValueType
+	}
+	return m
+}
+
+func sortedLabelKeys(m map[string]labelpb.LabelDescriptor_ValueType) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,258 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+	"cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	"go.opencensus.io/metric/metricdata"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	labelpb "google.golang.org/genproto/googleapis/api/label"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDiffMetricDescriptors(t *testing.T) {
+	want := &metricpb.MetricDescriptor{
+		MetricKind: metricpb.MetricDescriptor_CUMULATIVE,
+		ValueType:  metricpb.MetricDescriptor_INT64,
+		Unit:       "1",
+		Labels: []*labelpb.LabelDescriptor{
+			{Key: "method"},
+			{Key: "status"},
+		},
+	}
+	if diffs := diffMetricDescriptors(want, want); len(diffs) != 0 {
+		t.Errorf("diffMetricDescriptors(want, want) = %q; want none", diffs)
+	}
+
+	got := &metricpb.MetricDescriptor{
+		MetricKind: metricpb.MetricDescriptor_GAUGE,
+		ValueType:  metricpb.MetricDescriptor_DOUBLE,
+		Unit:       "ms",
+		Labels: []*labelpb.LabelDescriptor{
+			{Key: "host"},
+			{Key: "status", ValueType: labelpb.LabelDescriptor_INT64},
+		},
+	}
+	wantDiffs := []string{
+		"metric kind is GAUGE, want CUMULATIVE",
+		"value type is DOUBLE, want INT64",
+		`unit is "ms", want "1"`,
+		`label "method" is missing from the existing descriptor`,
+		`label "status" is of type INT64, want STRING`,
+		`label "host" is no longer exported`,
+	}
+	if diffs := diffMetricDescriptors(got, want); !reflect.DeepEqual(diffs, wantDiffs) {
+		t.Errorf("diffMetricDescriptors() = %q; want %q", diffs, wantDiffs)
+	}
+}
+
+func TestReconcileMetricDescriptor(t *testing.T) {
+	oldCreate, oldGet, oldDelete := createMetricDescriptor, getMetricDescriptor, deleteMetricDescriptor
+	defer func() {
+		createMetricDescriptor, getMetricDescriptor, deleteMetricDescriptor = oldCreate, oldGet, oldDelete
+	}()
+
+	key, _ := tag.NewKey("method")
+	v := &view.View{
+		Name:        "test_view_drift",
+		TagKeys:     []tag.Key{key},
+		Measure:     stats.Int64("test-measure/TestReconcileMetricDescriptor", "measure desc", stats.UnitDimensionless),
+		Aggregation: view.Count(),
+	}
+	// The existing descriptor was created before the method tag was added.
+	existing := &metricpb.MetricDescriptor{
+		Type:       "custom.googleapis.com/opencensus/test_view_drift",
+		MetricKind: metricpb.MetricDescriptor_CUMULATIVE,
+		ValueType:  metricpb.MetricDescriptor_INT64,
+		Unit:       stats.UnitDimensionless,
+	}
+
+	tests := []struct {
+		name        string
+		policy      DescriptorReconciliation
+		getErr      error
+		wantErr     bool
+		wantReports int
+		wantGets    int
+		wantDeletes int
+		wantCreates int
+	}{
+		{name: "none", policy: ReconcileNone, wantCreates: 1},
+		{name: "not found", policy: ReconcileRefuse, getErr: status.Error(codes.NotFound, "not found"), wantGets: 1, wantCreates: 1},
+		{name: "report", policy: ReconcileReport, wantReports: 1, wantGets: 1},
+		{name: "update", policy: ReconcileUpdate, wantGets: 1, wantDeletes: 1, wantCreates: 1},
+		{name: "refuse", policy: ReconcileRefuse, wantErr: true, wantGets: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gets, deletes, creates int
+			getMetricDescriptor = func(ctx context.Context, c *monitoring.MetricClient, req *monitoringpb.GetMetricDescriptorRequest) (*metricpb.MetricDescriptor, error) {
+				gets++
+				if got, want := req.Name, "projects/test_project/metricDescriptors/custom.googleapis.com/opencensus/test_view_drift"; got != want {
+					t.Errorf("GetMetricDescriptorRequest.Name = %q; want %q", got, want)
+				}
+				if tt.getErr != nil {
+					return nil, tt.getErr
+				}
+				return existing, nil
+			}
+			deleteMetricDescriptor = func(ctx context.Context, c *monitoring.MetricClient, req *monitoringpb.DeleteMetricDescriptorRequest) error {
+				deletes++
+				return nil
+			}
+			createMetricDescriptor = func(ctx context.Context, c *monitoring.MetricClient, mdr *monitoringpb.CreateMetricDescriptorRequest) (*metricpb.MetricDescriptor, error) {
+				creates++
+				return mdr.MetricDescriptor, nil
+			}
+
+			var reported []error
+			e := &statsExporter{
+				metricDescriptors: make(map[string]bool),
+				o: Options{
+					ProjectID:                "test_project",
+					DescriptorReconciliation: tt.policy,
+					OnError:                  func(err error) { reported = append(reported, err) },
+				},
+			}
+			ctx := context.Background()
+			for i := 0; i < 2; i++ {
+				err := e.createMetricDescriptorFromView(ctx, v)
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("createMetricDescriptorFromView() error = %v; wantErr %v", err, tt.wantErr)
+				}
+				var drift *DescriptorDriftError
+				if tt.wantErr && !errors.As(err, &drift) {
+					t.Errorf("createMetricDescriptorFromView() error = %v; want a *DescriptorDriftError", err)
+				}
+			}
+			if len(reported) != tt.wantReports {
+				t.Errorf("OnError called with %v; want %d errors", reported, tt.wantReports)
+			}
+			for _, err := range reported {
+				var drift *DescriptorDriftError
+				if !errors.As(err, &drift) || len(drift.Diffs) != 1 {
+					t.Errorf("OnError called with %v; want a *DescriptorDriftError with one difference", err)
+				}
+			}
+			if gets != tt.wantGets || deletes != tt.wantDeletes || creates != tt.wantCreates {
+				t.Errorf("calls = %d get, %d delete, %d create; want %d, %d, %d",
+					gets, deletes, creates, tt.wantGets, tt.wantDeletes, tt.wantCreates)
+			}
+		})
+	}
+}
+
+func TestReconcileRefuseSkipsTimeSeries(t *testing.T) {
+	oldCreate, oldGet, oldCreateTS := createMetricDescriptor, getMetricDescriptor, createTimeSeries
+	defer func() {
+		createMetricDescriptor, getMetricDescriptor, createTimeSeries = oldCreate, oldGet, oldCreateTS
+	}()
+
+	const refusedType = "custom.googleapis.com/opencensus/refused"
+	getMetricDescriptor = func(ctx context.Context, c *monitoring.MetricClient, req *monitoringpb.GetMetricDescriptorRequest) (*metricpb.MetricDescriptor, error) {
+		if strings.HasSuffix(req.Name, "/"+refusedType) {
+			// The existing descriptor has another value type.
+			return &metricpb.MetricDescriptor{
+				Type:       refusedType,
+				MetricKind: metricpb.MetricDescriptor_CUMULATIVE,
+				ValueType:  metricpb.MetricDescriptor_DOUBLE,
+				Unit:       stats.UnitDimensionless,
+			}, nil
+		}
+		return nil, status.Error(codes.NotFound, "not found")
+	}
+	createMetricDescriptor = func(ctx context.Context, c *monitoring.MetricClient, mdr *monitoringpb.CreateMetricDescriptorRequest) (*metricpb.MetricDescriptor, error) {
+		return mdr.MetricDescriptor, nil
+	}
+	var written []string
+	createTimeSeries = func(ctx context.Context, c *monitoring.MetricClient, req *monitoringpb.CreateTimeSeriesRequest) error {
+		for _, ts := range req.TimeSeries {
+			written = append(written, ts.Metric.Type)
+		}
+		return nil
+	}
+	newExporter := func() *statsExporter {
+		return &statsExporter{
+			metricDescriptors: make(map[string]bool),
+			o: Options{
+				ProjectID:                "test_project",
+				DescriptorReconciliation: ReconcileRefuse,
+			},
+		}
+	}
+	wantWritten := []string{"custom.googleapis.com/opencensus/valid"}
+
+	t.Run("metrics", func(t *testing.T) {
+		written = nil
+		now := time.Now()
+		metric := func(name string) *metricdata.Metric {
+			return &metricdata.Metric{
+				Descriptor: metricdata.Descriptor{Name: name, Type: metricdata.TypeCumulativeInt64, Unit: metricdata.UnitDimensionless},
+				TimeSeries: []*metricdata.TimeSeries{{
+					StartTime: now.Add(-time.Minute),
+					Points:    []metricdata.Point{metricdata.NewInt64Point(now, 1)},
+				}},
+			}
+		}
+		err := newExporter().uploadMetrics([]*metricdata.Metric{metric("refused"), metric("valid")})
+		var drift *DescriptorDriftError
+		if !errors.As(err, &drift) {
+			t.Errorf("uploadMetrics() error = %v; want a *DescriptorDriftError", err)
+		}
+		if !reflect.DeepEqual(written, wantWritten) {
+			t.Errorf("time series written for %q; want %q", written, wantWritten)
+		}
+	})
+
+	t.Run("views", func(t *testing.T) {
+		written = nil
+		data := func(name string) *view.Data {
+			return &view.Data{
+				View: &view.View{
+					Name:        name,
+					Measure:     stats.Int64("test-measure/TestReconcileRefuseSkipsTimeSeries/"+name, "measure desc", stats.UnitDimensionless),
+					Aggregation: view.Count(),
+				},
+				Start: time.Now().Add(-time.Minute),
+				End:   time.Now(),
+				Rows:  []*view.Row{{Data: &view.CountData{Value: 1}}},
+			}
+		}
+		err := newExporter().uploadStats([]*view.Data{data("refused"), data("valid")})
+		var ee *ExportError
+		if !errors.As(err, &ee) || ee.Dropped != 1 {
+			t.Errorf("uploadStats() error = %v; want an *ExportError with 1 dropped time series", err)
+		}
+		var drift *DescriptorDriftError
+		if !errors.As(err, &drift) || drift.MetricType != refusedType {
+			t.Errorf("uploadStats() error = %v; want a *DescriptorDriftError for %s", err, refusedType)
+		}
+		if !reflect.DeepEqual(written, wantWritten) {
+			t.Errorf("time series written for %q; want %q", written, wantWritten)
+		}
+	})
+}
@@ -0,0 +1,199 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"contrib.go.opencensus.io/exporter/stackdriver/internal/diskqueue"
+)
+
+const defaultDiskQueueDrainInterval = 5 * time.Second
+
+// DiskSyncPolicy controls when the records written to the disk queue are
+// flushed to stable storage.
+type DiskSyncPolicy int
+
+const (
+	// DiskSyncInterval flushes the disk queue every DiskQueueOptions.SyncInterval.
+	DiskSyncInterval DiskSyncPolicy = iota
+	// DiskSyncAlways flushes every record before the write returns.
+	DiskSyncAlways
+	// DiskSyncNever leaves flushing to the operating system.
+	DiskSyncNever
+)
+
+// DiskQueueOptions configures the on-disk queue used to keep spans and time
+// series that could not be uploaded.
+//
+// Spans and time series exported through ExportSpan, ExportView and
+// ExportMetrics whose upload fails with a retryable error, as well as spans
+// that do not fit in the trace buffer, are written to the queue instead of
+// being dropped. The queue is drained in the background once Stackdriver can
+// be reached again, and records left by a previous process are replayed when
+// the exporter is created. PushTraceSpans and PushMetricsProto report their
+// failures to the caller and do not use the queue.
+//
+// Each queue directory must be used by a single exporter at a time.
+type DiskQueueOptions struct {
+	// Dir is the directory holding the queue. Spans and time series are
+	// kept in the "trace" and "metrics" subdirectories.
+	Dir string
+
+	// MaxBytes caps the size of each of the trace and metrics queues.
+	// Data that does not fit is dropped. If unset, a default of 256MiB is used.
+	MaxBytes int64
+
+	// SegmentBytes is the size of the files the queues are split into.
+	// Files are deleted once all their records have been uploaded.
+	// If unset, a default of 16MiB is used.
+	SegmentBytes int64
+
+	// Sync is the policy used to flush the queues to stable storage.
+	Sync DiskSyncPolicy
+
+	// SyncInterval is the flush period of the DiskSyncInterval policy.
+	// If unset, a default of 1s is used.
+	SyncInterval time.Duration
+
+	// DrainInterval is the period at which uploading the queued data is
+	// attempted. If unset, a default of 5s is used.
+	DrainInterval time.Duration
+}
+
+// diskSpool keeps serialized API requests in a disk queue and sends them in
+// order from a background goroutine.
+type diskSpool struct {
+	q *diskqueue.Queue
+	// send uploads a record; errors for which retryable returns true leave
+	// the record at the head of the queue until the next drain.
+	send      func(rec []byte) error
+	retryable func(err error) bool
+	onError   func(err error)
+	interval  time.Duration
+
+	drainMu  sync.Mutex
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newDiskSpool(
+	o *DiskQueueOptions,
+	name string,
+	send func(rec []byte) error,
+	retryable func(err error) bool,
+	onError func(err error),
+) (*diskSpool, error) {
+	q, err := diskqueue.Open(diskqueue.Options{
+		Dir:          filepath.Join(o.Dir, name),
+		MaxBytes:     o.MaxBytes,
+		SegmentBytes: o.SegmentBytes,
+		Sync:         diskqueue.SyncPolicy(o.Sync),
+		SyncInterval: o.SyncInterval,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("stackdriver: couldn't open %s disk queue: %v", name, err)
+	}
+	s := &diskSpool{
+		q:         q,
+		send:      send,
+		retryable: retryable,
+		onError:   onError,
+		interval:  o.DrainInterval,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if s.interval <= 0 {
+		s.interval = defaultDiskQueueDrainInterval
+	}
+	go s.loop()
+	return s, nil
+}
+
+// add appends m to the queue.
+func (s *diskSpool) add(m proto.Message) error {
+	rec, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return s.q.Append(rec)
+}
+
+// pending reports whether the queue holds records that were not sent yet.
+func (s *diskSpool) pending() bool {
+	return s.q.Len() > 0
+}
+
+func (s *diskSpool) loop() {
+	defer close(s.done)
+	t := time.NewTicker(s.interval)
+	defer t.Stop()
+	for {
+		// Drain first, in order to replay what was left by a previous process.
+		s.drain()
+		select {
+		case <-s.stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// drain sends the queued records until the queue is empty, a record fails
+// with a retryable error or the spool is closed.
+func (s *diskSpool) drain() {
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+	for {
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+		rec, err := s.q.Peek()
+		if err == diskqueue.ErrEmpty || err == diskqueue.ErrClosed {
+			return
+		}
+		if err != nil {
+			s.onError(err)
+			return
+		}
+		if err := s.send(rec); err != nil {
+			if s.retryable(err) {
+				return
+			}
+			// The record can never be written, drop it.
+			s.onError(err)
+		}
+		if err := s.q.Pop(); err != nil {
+			s.onError(err)
+			return
+		}
+	}
+}
+
+// close stops the background drain and closes the queue. The records that
+// were not sent are kept for the next process.
+func (s *diskSpool) close() error {
+	s.stopOnce.Do(func() { close(s.stop) })
+	<-s.done
+	return s.q.Close()
+}
@@ -0,0 +1,192 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+	"cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	"contrib.go.opencensus.io/exporter/stackdriver/internal/diskqueue"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestDiskSpoolDrain(t *testing.T) {
+	var mu sync.Mutex
+	var sendErr error
+	var sent []string
+	var reported []error
+	send := func(rec []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if sendErr != nil {
+			return sendErr
+		}
+		sent = append(sent, string(rec))
+		return nil
+	}
+	onError := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		reported = append(reported, err)
+	}
+
+	dir := t.TempDir()
+	o := &DiskQueueOptions{Dir: dir, DrainInterval: time.Hour}
+	s, err := newDiskSpool(o, "test", send, (*RetryPolicy)(nil).retryable, onError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	sendErr = status.Error(codes.Unavailable, "unavailable")
+	mu.Unlock()
+	for _, rec := range []string{"a", "b", "c"} {
+		if err := s.q.Append([]byte(rec)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.drain()
+	mu.Lock()
+	if !s.pending() || len(sent) != 0 || len(reported) != 0 {
+		t.Fatalf("after unavailable: pending = %v, sent = %v, reported = %v; want records kept", s.pending(), sent, reported)
+	}
+	mu.Unlock()
+
+	// Records are replayed by the next process.
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	sendErr = nil
+	mu.Unlock()
+	s, err = newDiskSpool(o, "test", send, (*RetryPolicy)(nil).retryable, onError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	s.drain()
+	if s.pending() {
+		t.Error("pending() = true after drain; want false")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if got, want := len(sent), 3; got != want {
+		t.Errorf("sent %d records; want %d", got, want)
+	}
+}
+
+func TestDiskSpoolDropsNonRetryable(t *testing.T) {
+	var reported []error
+	send := func(rec []byte) error {
+		return status.Error(codes.InvalidArgument, "invalid")
+	}
+	s, err := newDiskSpool(&DiskQueueOptions{Dir: t.TempDir(), DrainInterval: time.Hour}, "test", send,
+		(*RetryPolicy)(nil).retryable, func(err error) { reported = append(reported, err) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	s.q.Append([]byte("a"))
+	s.drain()
+	if s.pending() {
+		t.Error("pending() = true; want the record dropped")
+	}
+	if len(reported) != 1 {
+		t.Errorf("reported %d errors; want 1", len(reported))
+	}
+}
+
+func TestStatsExporterSpoolsTimeSeries(t *testing.T) {
+	persistedCreateTimeSeries := createTimeSeries
+	defer func() {
+		createTimeSeries = persistedCreateTimeSeries
+	}()
+	var mu sync.Mutex
+	var sent []*monitoringpb.CreateTimeSeriesRequest
+	unavailable := true
+	createTimeSeries = func(ctx context.Context, c *monitoring.MetricClient, req *monitoringpb.CreateTimeSeriesRequest) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if unavailable {
+			return status.Error(codes.Unavailable, "unavailable")
+		}
+		sent = append(sent, req)
+		return nil
+	}
+
+	e := &statsExporter{o: Options{ProjectID: "test"}}
+	e.spool, _ = newDiskSpool(&DiskQueueOptions{Dir: t.TempDir(), DrainInterval: time.Hour}, "metrics",
+		e.sendSpooledTimeSeries, e.o.RetryPolicy.retryable, func(err error) { t.Error(err) })
+	defer e.spool.close()
+
+	req1 := &monitoringpb.CreateTimeSeriesRequest{Name: "projects/test", TimeSeries: makeTs(1, false)}
+	req2 := &monitoringpb.CreateTimeSeriesRequest{Name: "projects/test", TimeSeries: makeTs(2, false)}
+	if err := e.writeTimeSeries(context.Background(), false, req1); err != nil {
+		t.Fatalf("writeTimeSeries() error = %v; want the request queued", err)
+	}
+	mu.Lock()
+	unavailable = false
+	mu.Unlock()
+	// req2 must not overtake the queued req1.
+	if err := e.writeTimeSeries(context.Background(), false, req2); err != nil {
+		t.Fatalf("writeTimeSeries() error = %v", err)
+	}
+	mu.Lock()
+	if len(sent) != 0 {
+		t.Errorf("sent %d requests while older time series are queued; want 0", len(sent))
+	}
+	mu.Unlock()
+
+	e.spool.drain()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sent) != 2 || !proto.Equal(sent[0], req1) || !proto.Equal(sent[1], req2) {
+		t.Errorf("sent = %v; want [%v %v]", sent, req1, req2)
+	}
+}
+
+func TestStatsExporterSpoolFullKeepsError(t *testing.T) {
+	persistedCreateTimeSeries := createTimeSeries
+	defer func() {
+		createTimeSeries = persistedCreateTimeSeries
+	}()
+	createTimeSeries = func(ctx context.Context, c *monitoring.MetricClient, req *monitoringpb.CreateTimeSeriesRequest) error {
+		return status.Error(codes.Unavailable, "unavailable")
+	}
+
+	e := &statsExporter{o: Options{ProjectID: "test"}}
+	e.spool, _ = newDiskSpool(&DiskQueueOptions{Dir: t.TempDir(), MaxBytes: 1, DrainInterval: time.Hour}, "metrics",
+		e.sendSpooledTimeSeries, e.o.RetryPolicy.retryable, func(err error) { t.Error(err) })
+	defer e.spool.close()
+
+	req := &monitoringpb.CreateTimeSeriesRequest{Name: "projects/test", TimeSeries: makeTs(1, false)}
+	err := e.writeTimeSeries(context.Background(), false, req)
+	if got := status.Code(err); got != codes.Unavailable {
+		t.Errorf("status.Code(%v) = %v; want Unavailable", err, got)
+	}
+	if !errors.Is(err, diskqueue.ErrFull) {
+		t.Errorf("errors.Is(%v, ErrFull) = false; want true", err)
+	}
+	var tsErr *TimeSeriesError
+	if !errors.As(err, &tsErr) || len(tsErr.Rejected) != 1 {
+		t.Errorf("errors.As(%v, *TimeSeriesError) = %v; want the rejected time series", err, tsErr)
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	distributionpb "google.golang.org/genproto/googleapis/api/distribution"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// setDistributionRanges sets the range of the distribution points of ts,
+// converted from metricdata or proto metrics, when Options.DistributionRange
+// is set. These distributions carry no minimum and maximum, so the range is
+// only set when it is known exactly: when the sum of squared deviations is
+// zero, all the values are equal to the mean.
+func (se *statsExporter) setDistributionRanges(ts *monitoringpb.TimeSeries) {
+	if !se.o.DistributionRange {
+		return
+	}
+	for _, pt := range ts.GetPoints() {
+		d := pt.GetValue().GetDistributionValue()
+		if d == nil || d.Range != nil || d.Count <= 0 || d.SumOfSquaredDeviation != 0 {
+			continue
+		}
+		d.Range = &distributionpb.Distribution_Range{Min: d.Mean, Max: d.Mean}
+	}
+}
+
+// mergeRanges returns the range of the union of two populations with the
+// ranges a and b, or nil if one of them is unknown.
+func mergeRanges(a, b *distributionpb.Distribution_Range) *distributionpb.Distribution_Range {
+	if a == nil || b == nil {
+		return nil
+	}
+	r := &distributionpb.Distribution_Range{Min: a.Min, Max: a.Max}
+	if b.Min < r.Min {
+		r.Min = b.Min
+	}
+	if b.Max > r.Max {
+		r.Max = b.Max
+	}
+	return r
+}
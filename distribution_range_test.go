@@ -0,0 +1,119 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"go.opencensus.io/metric/metricdata"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	distributionpb "google.golang.org/genproto/googleapis/api/distribution"
+)
+
+func TestViewDistributionRange(t *testing.T) {
+	v := &view.View{
+		Name:        "rangeview",
+		Measure:     stats.Float64("test-measure/range", "measure desc", "ms"),
+		Aggregation: view.Distribution(10, 100),
+	}
+	vd := &view.Data{
+		View:  v,
+		Start: time.Unix(1000, 0),
+		End:   time.Unix(1060, 0),
+		Rows: []*view.Row{{Data: &view.DistributionData{
+			Count:          3,
+			Min:            4,
+			Max:            250,
+			Mean:           90,
+			CountPerBucket: []int64{1, 1, 1},
+		}}},
+	}
+
+	for _, withRange := range []bool{false, true} {
+		e := &statsExporter{o: Options{ProjectID: "foo", DistributionRange: withRange}}
+		reqs := e.makeReq([]*view.Data{vd}, maxTimeSeriesPerUpload)
+		if len(reqs) != 1 || len(reqs[0].TimeSeries) != 1 {
+			t.Fatalf("makeReq() = %v; want one time series", reqs)
+		}
+		got := reqs[0].TimeSeries[0].Points[0].Value.GetDistributionValue().Range
+		var want *distributionpb.Distribution_Range
+		if withRange {
+			want = &distributionpb.Distribution_Range{Min: 4, Max: 250}
+		}
+		if !proto.Equal(got, want) {
+			t.Errorf("DistributionRange %v: range = %v; want %v", withRange, got, want)
+		}
+	}
+}
+
+func TestMetricDistributionRange(t *testing.T) {
+	metric := func(d *metricdata.Distribution) *metricdata.Metric {
+		return &metricdata.Metric{
+			Descriptor: metricdata.Descriptor{Name: "latency", Type: metricdata.TypeCumulativeDistribution},
+			TimeSeries: []*metricdata.TimeSeries{{
+				StartTime: time.Unix(1000, 0),
+				Points:    []metricdata.Point{metricdata.NewDistributionPoint(time.Unix(1060, 0), d)},
+			}},
+		}
+	}
+	tests := []struct {
+		name string
+		in   *metricdata.Distribution
+		want *distributionpb.Distribution_Range
+	}{
+		{"equal values", &metricdata.Distribution{Count: 2, Sum: 14}, &distributionpb.Distribution_Range{Min: 7, Max: 7}},
+		{"different values", &metricdata.Distribution{Count: 2, Sum: 14, SumOfSquaredDeviation: 8}, nil},
+		{"empty", &metricdata.Distribution{}, nil},
+	}
+
+	se := &statsExporter{o: Options{ProjectID: "foo", DistributionRange: true}}
+	for _, tt := range tests {
+		tsl, err := se.metricToMpbTs(context.Background(), metric(tt.in))
+		if err != nil || len(tsl) != 1 {
+			t.Fatalf("%s: metricToMpbTs() = %v, %v; want one time series", tt.name, tsl, err)
+		}
+		if got := tsl[0].Points[0].Value.GetDistributionValue().Range; !proto.Equal(got, tt.want) {
+			t.Errorf("%s: range = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAddDistributionsRange(t *testing.T) {
+	r := func(min, max float64) *distributionpb.Distribution_Range {
+		return &distributionpb.Distribution_Range{Min: min, Max: max}
+	}
+	tests := []struct {
+		name string
+		a, b *distributionpb.Distribution
+		want *distributionpb.Distribution_Range
+	}{
+		{"both known", &distributionpb.Distribution{Count: 1, Range: r(5, 5)}, &distributionpb.Distribution{Count: 2, Range: r(1, 3)}, r(1, 5)},
+		{"one unknown", &distributionpb.Distribution{Count: 1, Range: r(5, 5)}, &distributionpb.Distribution{Count: 2}, nil},
+		{"empty delta", &distributionpb.Distribution{Count: 1, Range: r(5, 5)}, &distributionpb.Distribution{}, r(5, 5)},
+	}
+	for _, tt := range tests {
+		d, ok := addDistributions(tt.a, tt.b)
+		if !ok {
+			t.Fatalf("%s: addDistributions() failed", tt.name)
+		}
+		if !proto.Equal(d.Range, tt.want) {
+			t.Errorf("%s: range = %v; want %v", tt.name, d.Range, tt.want)
+		}
+	}
+}
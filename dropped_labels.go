@@ -0,0 +1,125 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"github.com/golang/protobuf/ptypes/any"
+	"go.opencensus.io/metric/metricdata"
+	"google.golang.org/protobuf/proto"
+
+	"cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+)
+
+// attachmentKeyDroppedLabels is the exemplar attachment key of the labels
+// dropped from the time series of the exemplar.
+const attachmentKeyDroppedLabels = "DroppedLabels"
+
+// labelKeysCollide reports whether two of labelKeys have the same sanitized
+// key, in which case the label of the first one is dropped from the time
+// series.
+func labelKeysCollide(labelKeys []metricdata.LabelKey) bool {
+	if len(labelKeys) < 2 {
+		return false
+	}
+	seen := make(map[string]bool, len(labelKeys))
+	for _, k := range labelKeys {
+		s := sanitize(k.Key)
+		if seen[s] {
+			return true
+		}
+		seen[s] = true
+	}
+	return false
+}
+
+// sanitizationDroppedLabels returns the labels overwritten, in the labels of
+// a time series, by a later label with the same sanitized key.
+func sanitizationDroppedLabels(labelKeys []metricdata.LabelKey, labelValues []metricdata.LabelValue) map[string]string {
+	var dropped map[string]string
+	last := make(map[string]int, len(labelKeys))
+	for i, k := range labelKeys {
+		if i >= len(labelValues) || !labelValues[i].Present {
+			continue
+		}
+		s := sanitize(k.Key)
+		if j, ok := last[s]; ok {
+			if dropped == nil {
+				dropped = make(map[string]string)
+			}
+			dropped[labelKeys[j].Key] = labelValues[j].Value
+		}
+		last[s] = i
+	}
+	return dropped
+}
+
+// addDroppedLabels attaches dropped, the labels dropped from a time series,
+// to the exemplars of its distribution points. They are merged into the
+// DroppedLabels attachment of an exemplar that already has one, as Stackdriver
+// Monitoring accepts a single one.
+func addDroppedLabels(points []*monitoringpb.Point, dropped map[string]string) {
+	if len(dropped) == 0 {
+		return
+	}
+	var a *any.Any
+	for _, pt := range points {
+		for _, e := range pt.GetValue().GetDistributionValue().GetExemplars() {
+			if i := droppedLabelsIndex(e.Attachments); i >= 0 {
+				e.Attachments[i] = mergeDroppedLabels(e.Attachments[i], dropped)
+				continue
+			}
+			if a == nil {
+				a = toPbDroppedLabelsAttachment(dropped)
+			}
+			e.Attachments = append(e.Attachments, a)
+		}
+	}
+}
+
+// droppedLabelsIndex returns the index of the DroppedLabels attachment in
+// attachments, or -1 if there is none.
+func droppedLabelsIndex(attachments []*any.Any) int {
+	for i, a := range attachments {
+		if a.GetTypeUrl() == exemplarAttachmentTypeDroppedLabels {
+			return i
+		}
+	}
+	return -1
+}
+
+// mergeDroppedLabels returns a DroppedLabels attachment holding the labels of
+// a and dropped. The values of a are kept for the keys found in both.
+func mergeDroppedLabels(a *any.Any, dropped map[string]string) *any.Any {
+	var existing monitoringpb.DroppedLabels
+	if err := proto.Unmarshal(a.GetValue(), &existing); err != nil {
+		return a
+	}
+	labels := make(map[string]string, len(existing.Label)+len(dropped))
+	for k, v := range dropped {
+		labels[k] = v
+	}
+	for k, v := range existing.Label {
+		labels[k] = v
+	}
+	return toPbDroppedLabelsAttachment(labels)
+}
+
+func toPbDroppedLabelsAttachment(labels map[string]string) *any.Any {
+	bytes, _ := proto.Marshal(&monitoringpb.DroppedLabels{Label: labels})
+	return &any.Any{
+		TypeUrl: exemplarAttachmentTypeDroppedLabels,
+		Value:   bytes,
+	}
+}
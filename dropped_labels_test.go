@@ -0,0 +1,212 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/any"
+	"go.opencensus.io/metric/metricdata"
+	"go.opencensus.io/trace"
+	distributionpb "google.golang.org/genproto/googleapis/api/distribution"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+)
+
+// droppedLabelsOf returns the dropped labels attached to an exemplar, or nil.
+func droppedLabelsOf(t *testing.T, attachments []*any.Any) map[string]string {
+	t.Helper()
+	for _, a := range attachments {
+		if a.TypeUrl != exemplarAttachmentTypeDroppedLabels {
+			continue
+		}
+		var dl monitoringpb.DroppedLabels
+		if err := proto.Unmarshal(a.Value, &dl); err != nil {
+			t.Fatalf("Unmarshal(DroppedLabels) = %v", err)
+		}
+		return dl.Label
+	}
+	return nil
+}
+
+func TestAttachmentsToPbAttachments(t *testing.T) {
+	unmarshal := func(a *any.Any, m proto.Message) proto.Message {
+		if err := a.UnmarshalTo(m); err != nil {
+			t.Fatalf("UnmarshalTo(%T) of %s = %v", m, a.TypeUrl, err)
+		}
+		return m
+	}
+	dropped := &monitoringpb.DroppedLabels{Label: map[string]string{"user": "alice"}}
+	got := attachmentsToPbAttachments(metricdata.Attachments{
+		"a_int":     int32(7),
+		"b_uint":    uint64(8),
+		"c_float":   2.5,
+		"d_bool":    true,
+		"e_dropped": dropped,
+		"f_string":  "value",
+		"g_any":     &any.Any{TypeUrl: "type.googleapis.com/example", Value: []byte("x")},
+	}, "foo")
+	if len(got) != 7 {
+		t.Fatalf("got %d attachments; want 7", len(got))
+	}
+
+	if m := unmarshal(got[0], &wrapperspb.Int64Value{}); m.(*wrapperspb.Int64Value).Value != 7 {
+		t.Errorf("int attachment = %v; want 7", m)
+	}
+	if m := unmarshal(got[1], &wrapperspb.UInt64Value{}); m.(*wrapperspb.UInt64Value).Value != 8 {
+		t.Errorf("uint attachment = %v; want 8", m)
+	}
+	if m := unmarshal(got[2], &wrapperspb.DoubleValue{}); m.(*wrapperspb.DoubleValue).Value != 2.5 {
+		t.Errorf("float attachment = %v; want 2.5", m)
+	}
+	if m := unmarshal(got[3], &wrapperspb.BoolValue{}); !m.(*wrapperspb.BoolValue).Value {
+		t.Errorf("bool attachment = %v; want true", m)
+	}
+	if got[4].TypeUrl != exemplarAttachmentTypeDroppedLabels {
+		t.Errorf("dropped labels attachment type = %q; want %q", got[4].TypeUrl, exemplarAttachmentTypeDroppedLabels)
+	}
+	if m := unmarshal(got[4], &monitoringpb.DroppedLabels{}); !proto.Equal(m, dropped) {
+		t.Errorf("dropped labels attachment = %v; want %v", m, dropped)
+	}
+	if got[5].TypeUrl != exemplarAttachmentTypeString || string(got[5].Value) != "value" {
+		t.Errorf("string attachment = %v", got[5])
+	}
+	if got[6].TypeUrl != "type.googleapis.com/example" {
+		t.Errorf("Any attachment = %v; want it unchanged", got[6])
+	}
+}
+
+func TestSanitizationDroppedLabels(t *testing.T) {
+	keys := []metricdata.LabelKey{{Key: "user.id"}, {Key: "user_id"}, {Key: "method"}}
+	if !labelKeysCollide(keys) {
+		t.Fatal("labelKeysCollide() = false; want true")
+	}
+	if labelKeysCollide(keys[1:]) {
+		t.Error("labelKeysCollide() without colliding keys = true; want false")
+	}
+
+	metric := &metricdata.Metric{
+		Descriptor: metricdata.Descriptor{Name: "latency", Type: metricdata.TypeCumulativeDistribution, LabelKeys: keys},
+		TimeSeries: []*metricdata.TimeSeries{{
+			StartTime:   time.Unix(1000, 0),
+			LabelValues: []metricdata.LabelValue{metricdata.NewLabelValue("1"), metricdata.NewLabelValue("2"), metricdata.NewLabelValue("GET")},
+			Points: []metricdata.Point{metricdata.NewDistributionPoint(time.Unix(1060, 0), &metricdata.Distribution{
+				Count:         1,
+				Sum:           5,
+				BucketOptions: &metricdata.BucketOptions{Bounds: []float64{10}},
+				Buckets: []metricdata.Bucket{
+					{Count: 1, Exemplar: &metricdata.Exemplar{Value: 5, Timestamp: time.Unix(1050, 0)}},
+					{},
+				},
+			})},
+		}},
+	}
+	se := &statsExporter{o: Options{ProjectID: "foo"}}
+	tsl, err := se.metricToMpbTs(context.Background(), metric)
+	if err != nil || len(tsl) != 1 {
+		t.Fatalf("metricToMpbTs() = %v, %v; want one time series", tsl, err)
+	}
+	if got, want := tsl[0].Metric.Labels["user_id"], "2"; got != want {
+		t.Errorf("user_id label = %q; want %q", got, want)
+	}
+	exemplars := tsl[0].Points[0].Value.GetDistributionValue().Exemplars
+	if len(exemplars) != 1 {
+		t.Fatalf("got %d exemplars; want 1", len(exemplars))
+	}
+	if got, want := droppedLabelsOf(t, exemplars[0].Attachments), map[string]string{"user.id": "1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("dropped labels = %v; want %v", got, want)
+	}
+}
+
+func TestAddDroppedLabelsMerges(t *testing.T) {
+	existing := metricExemplarToPbExemplar(&metricdata.Exemplar{
+		Value:       5,
+		Timestamp:   time.Unix(1050, 0),
+		Attachments: metricdata.Attachments{attachmentKeyDroppedLabels: &monitoringpb.DroppedLabels{Label: map[string]string{"span_name": "/orders", "user.id": "0"}}},
+	}, "foo")
+	other := metricExemplarToPbExemplar(&metricdata.Exemplar{Value: 7, Timestamp: time.Unix(1050, 0)}, "foo")
+	points := []*monitoringpb.Point{{Value: &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DistributionValue{
+		DistributionValue: &distributionpb.Distribution{Exemplars: []*distributionpb.Distribution_Exemplar{existing, other}},
+	}}}}
+
+	addDroppedLabels(points, map[string]string{"user.id": "1", "method": "GET"})
+	for _, tt := range []struct {
+		e    *distributionpb.Distribution_Exemplar
+		want map[string]string
+	}{
+		{existing, map[string]string{"span_name": "/orders", "user.id": "0", "method": "GET"}},
+		{other, map[string]string{"user.id": "1", "method": "GET"}},
+	} {
+		n := 0
+		for _, a := range tt.e.Attachments {
+			if a.TypeUrl == exemplarAttachmentTypeDroppedLabels {
+				n++
+			}
+		}
+		if n != 1 {
+			t.Errorf("exemplar %v: %d DroppedLabels attachments; want 1", tt.e.Value, n)
+		}
+		if got := droppedLabelsOf(t, tt.e.Attachments); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("exemplar %v: dropped labels = %v; want %v", tt.e.Value, got, tt.want)
+		}
+	}
+}
+
+func TestSpanMetricsOverflowDroppedLabels(t *testing.T) {
+	sm := newSpanMetrics(SpanMetricsOptions{MaxTimeSeries: 1, LatencyBounds: []float64{10}})
+	start := time.Now()
+	for _, name := range []string{"/users", "/orders"} {
+		sm.record(&trace.SpanData{
+			SpanContext: trace.SpanContext{TraceID: trace.TraceID{1}, SpanID: trace.SpanID{2}},
+			Name:        name,
+			SpanKind:    trace.SpanKindServer,
+			StartTime:   start,
+			EndTime:     start.Add(20 * time.Millisecond),
+		})
+	}
+
+	var latency *metricdata.Metric
+	for _, m := range sm.Read() {
+		if m.Descriptor.Name == spanMetricLatency {
+			latency = m
+		}
+	}
+	if latency == nil || len(latency.TimeSeries) != 2 {
+		t.Fatalf("latency metric = %v; want 2 time series", latency)
+	}
+	// Time series are sorted by label values: "/users" comes before "other".
+	for i, wantExemplar := range []bool{false, true} {
+		ts := latency.TimeSeries[i]
+		d := ts.Points[0].Value.(*metricdata.Distribution)
+		e := d.Buckets[1].Exemplar
+		if (e != nil) != wantExemplar {
+			t.Errorf("series %v: exemplar = %v; want exemplar %v", ts.LabelValues, e, wantExemplar)
+			continue
+		}
+		if e == nil {
+			continue
+		}
+		pb := metricExemplarToPbExemplar(e, "foo")
+		want := map[string]string{"span_name": "/orders", "span_kind": "SERVER", "status": "OK"}
+		if got := droppedLabelsOf(t, pb.Attachments); !reflect.DeepEqual(got, want) {
+			t.Errorf("dropped labels = %v; want %v", got, want)
+		}
+	}
+}
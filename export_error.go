@@ -0,0 +1,145 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"strings"
+
+	"cloud.google.com/go/trace/apiv2/tracepb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Signal is the kind of data an ExportError relates to.
+type Signal string
+
+const (
+	// SignalTrace is used for errors uploading spans to Stackdriver Trace.
+	SignalTrace Signal = "trace"
+	// SignalMetrics is used for errors writing time series to Stackdriver Monitoring.
+	SignalMetrics Signal = "metrics"
+	// SignalMetricDescriptor is used for errors creating metric descriptors.
+	SignalMetricDescriptor Signal = "metric_descriptor"
+)
+
+// ExportError is the error passed to Options.OnError and returned by
+// PushTraceSpans, PushMetricsProto and ExportMetricsProto when data could not
+// be exported.
+//
+// The underlying errors are available in Errs, and can be inspected with
+// errors.Is and errors.As from Go 1.20. They may themselves be *ExportError or
+// *TimeSeriesError values describing a part of the failure.
+type ExportError struct {
+	// Signal is the kind of data that could not be exported.
+	Signal Signal
+
+	// Code is the gRPC status code of the first failure, or codes.Unknown
+	// if it was not caused by an API call.
+	Code codes.Code
+
+	// MetricTypes lists the types of the metrics whose descriptors or time
+	// series could not be written.
+	MetricTypes []string
+
+	// SpanIDs lists the IDs of the spans that could not be uploaded.
+	SpanIDs []string
+
+	// Dropped is the number of spans or time series that were dropped.
+	Dropped int
+
+	// Errs are the underlying errors.
+	Errs []error
+}
+
+// Error returns the message of the underlying error, or the messages of all
+// the underlying errors in brackets.
+func (e *ExportError) Error() string {
+	if len(e.Errs) == 1 {
+		return e.Errs[0].Error()
+	}
+	msgs := make([]string, 0, len(e.Errs))
+	for _, err := range e.Errs {
+		msgs = append(msgs, err.Error())
+	}
+	return "[" + strings.Join(msgs, "; ") + "]"
+}
+
+// Unwrap returns the underlying errors.
+func (e *ExportError) Unwrap() []error {
+	return e.Errs
+}
+
+// GRPCStatus returns a status with e.Code, so that status.Code(e) returns it.
+func (e *ExportError) GRPCStatus() *status.Status {
+	return status.New(e.Code, e.Error())
+}
+
+// newExportError returns an *ExportError wrapping errs, which must not be
+// empty. The metric types, span IDs and dropped counts of the errs that are
+// *ExportError or *TimeSeriesError values are merged into the result.
+func newExportError(signal Signal, errs []error) *ExportError {
+	e := &ExportError{
+		Signal: signal,
+		Code:   status.Code(errs[0]),
+		Errs:   errs,
+	}
+	seenTypes := make(map[string]bool)
+	addType := func(t string) {
+		if t != "" && !seenTypes[t] {
+			seenTypes[t] = true
+			e.MetricTypes = append(e.MetricTypes, t)
+		}
+	}
+	for _, err := range errs {
+		switch err := err.(type) {
+		case *ExportError:
+			for _, t := range err.MetricTypes {
+				addType(t)
+			}
+			e.SpanIDs = append(e.SpanIDs, err.SpanIDs...)
+			e.Dropped += err.Dropped
+		case *TimeSeriesError:
+			for _, r := range err.Rejected {
+				addType(r.MetricType)
+			}
+			e.Dropped += len(err.Rejected)
+		}
+	}
+	return e
+}
+
+// metricError returns an *ExportError for a failure affecting dropped time
+// series of the metric type.
+func metricError(signal Signal, metricType string, dropped int, err error) *ExportError {
+	e := newExportError(signal, []error{err})
+	if len(e.MetricTypes) == 0 && metricType != "" {
+		e.MetricTypes = []string{metricType}
+	}
+	if e.Dropped == 0 {
+		e.Dropped = dropped
+	}
+	return e
+}
+
+// spansError returns an *ExportError for a failure to upload spans.
+func spansError(spans []*tracepb.Span, err error) *ExportError {
+	e := newExportError(SignalTrace, []error{err})
+	e.Dropped = len(spans)
+	e.SpanIDs = make([]string, 0, len(spans))
+	for _, s := range spans {
+		e.SpanIDs = append(e.SpanIDs, s.GetSpanId())
+	}
+	return e
+}
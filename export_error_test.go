@@ -0,0 +1,107 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+	"cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	"cloud.google.com/go/trace/apiv2/tracepb"
+	"github.com/google/go-cmp/cmp"
+	"go.opencensus.io/metric/metricdata"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestExportError(t *testing.T) {
+	errSentinel := errors.New("sentinel")
+	tsErr := &TimeSeriesError{
+		Rejected: []RejectedTimeSeries{{MetricType: "custom.googleapis.com/a"}, {MetricType: "custom.googleapis.com/b"}},
+		Err:      status.Error(codes.InvalidArgument, "invalid"),
+	}
+	err := newExportError(SignalMetrics, []error{
+		tsErr,
+		metricError(SignalMetricDescriptor, "custom.googleapis.com/c", 3, fmt.Errorf("wrapped: %w", errSentinel)),
+	})
+
+	if got, want := err.Error(), "[rpc error: code = InvalidArgument desc = invalid; wrapped: sentinel]"; got != want {
+		t.Errorf("Error() = %q; want %q", got, want)
+	}
+	if got := status.Code(err); got != codes.InvalidArgument {
+		t.Errorf("status.Code() = %v; want %v", got, codes.InvalidArgument)
+	}
+	if !errors.Is(err, errSentinel) {
+		t.Error("errors.Is(err, errSentinel) = false; want true")
+	}
+	var gotTsErr *TimeSeriesError
+	if !errors.As(err, &gotTsErr) || gotTsErr != tsErr {
+		t.Errorf("errors.As(err, *TimeSeriesError) = %v; want %v", gotTsErr, tsErr)
+	}
+	var descErr *ExportError
+	if !errors.As(err, &descErr) || descErr != err {
+		t.Errorf("errors.As(err, *ExportError) = %v; want the outer error", descErr)
+	}
+	want := []string{"custom.googleapis.com/a", "custom.googleapis.com/b", "custom.googleapis.com/c"}
+	if diff := cmp.Diff(err.MetricTypes, want); diff != "" {
+		t.Errorf("MetricTypes: -got +want %s", diff)
+	}
+	if err.Dropped != 5 {
+		t.Errorf("Dropped = %d; want 5", err.Dropped)
+	}
+}
+
+func TestSpansError(t *testing.T) {
+	spans := []*tracepb.Span{{SpanId: "0000000000000001"}, {SpanId: "0000000000000002"}}
+	err := spansError(spans, status.Error(codes.PermissionDenied, "denied"))
+	if err.Signal != SignalTrace || err.Code != codes.PermissionDenied || err.Dropped != 2 {
+		t.Errorf("got Signal %v, Code %v, Dropped %d; want trace, PermissionDenied, 2", err.Signal, err.Code, err.Dropped)
+	}
+	if diff := cmp.Diff(err.SpanIDs, []string{"0000000000000001", "0000000000000002"}); diff != "" {
+		t.Errorf("SpanIDs: -got +want %s", diff)
+	}
+}
+
+func TestUploadMetricsExportError(t *testing.T) {
+	persistedCreateTimeSeries := createTimeSeries
+	defer func() {
+		createTimeSeries = persistedCreateTimeSeries
+	}()
+	createTimeSeries = func(ctx context.Context, c *monitoring.MetricClient, ts *monitoringpb.CreateTimeSeriesRequest) error {
+		return status.Error(codes.PermissionDenied, "denied")
+	}
+
+	se := &statsExporter{o: Options{ProjectID: "test", SkipCMD: true}}
+	metric := &metricdata.Metric{
+		Descriptor: metricdata.Descriptor{Name: "m", Type: metricdata.TypeGaugeInt64},
+		TimeSeries: []*metricdata.TimeSeries{{Points: []metricdata.Point{metricdata.NewInt64Point(time.Now(), 1)}}},
+	}
+	err := se.uploadMetrics([]*metricdata.Metric{metric})
+
+	var ee *ExportError
+	if !errors.As(err, &ee) {
+		t.Fatalf("uploadMetrics() error = %v; want an *ExportError", err)
+	}
+	if ee.Signal != SignalMetrics || ee.Code != codes.PermissionDenied || ee.Dropped != 1 {
+		t.Errorf("got Signal %v, Code %v, Dropped %d; want metrics, PermissionDenied, 1", ee.Signal, ee.Code, ee.Dropped)
+	}
+	if diff := cmp.Diff(ee.MetricTypes, []string{"custom.googleapis.com/opencensus/m"}); diff != "" {
+		t.Errorf("MetricTypes: -got +want %s", diff)
+	}
+}
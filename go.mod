@@ -4,6 +4,7 @@ go 1.18
 
 require (
 	cloud.google.com/go/compute/metadata v0.2.3
+	cloud.google.com/go/logging v1.6.1
 	cloud.google.com/go/monitoring v1.10.0
 	cloud.google.com/go/trace v1.5.0
 	github.com/aws/aws-sdk-go-v2/config v1.18.14
@@ -22,7 +23,9 @@ require (
 )
 
 require (
+	cloud.google.com/go v0.107.0 // indirect
 	cloud.google.com/go/compute v1.14.0 // indirect
+	cloud.google.com/go/longrunning v0.3.0 // indirect
 	github.com/aws/aws-sdk-go-v2 v1.17.5 // indirect
 	github.com/aws/aws-sdk-go-v2/credentials v1.13.14 // indirect
 	github.com/aws/aws-sdk-go-v2/internal/configsources v1.1.29 // indirect
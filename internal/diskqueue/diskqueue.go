@@ -0,0 +1,523 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package diskqueue implements a persistent FIFO queue of records stored in
+// rotating segment files.
+//
+// Records are appended to the newest segment and consumed from the oldest
+// one. Fully consumed segments are deleted, and the read position is kept in
+// a cursor file so that a queue reopened after a restart resumes where it
+// stopped.
+package diskqueue // import "contrib.go.opencensus.io/exporter/stackdriver/internal/diskqueue"
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	headerSize       = 8
+	maxRecordSize    = 64 * 1024 * 1024
+	segmentExt       = ".seg"
+	cursorFile       = "cursor"
+	cursorSize       = 16
+	defaultMaxBytes  = 256 * 1024 * 1024
+	defaultSegment   = 16 * 1024 * 1024
+	defaultSyncEvery = time.Second
+)
+
+var (
+	// ErrFull is returned by Append when the record does not fit in the queue.
+	ErrFull = errors.New("diskqueue: queue is full")
+	// ErrEmpty is returned by Peek and Pop when there is no record to read.
+	ErrEmpty = errors.New("diskqueue: queue is empty")
+	// ErrClosed is returned when the queue is used after Close.
+	ErrClosed = errors.New("diskqueue: queue is closed")
+)
+
+// SyncPolicy controls when appended records are flushed to stable storage.
+type SyncPolicy int
+
+const (
+	// SyncInterval flushes appended records periodically.
+	SyncInterval SyncPolicy = iota
+	// SyncAlways flushes every appended record before Append returns.
+	SyncAlways
+	// SyncNever leaves flushing to the operating system.
+	SyncNever
+)
+
+// Options configures a Queue.
+type Options struct {
+	// Dir is the directory holding the segment files. It is created if needed.
+	Dir string
+	// MaxBytes caps the total size of the unconsumed records.
+	MaxBytes int64
+	// SegmentBytes is the size after which a new segment file is started.
+	SegmentBytes int64
+	// Sync is the policy used to flush appended records.
+	Sync SyncPolicy
+	// SyncInterval is the flush period used by the SyncInterval policy.
+	SyncInterval time.Duration
+}
+
+// Queue is a persistent FIFO queue of records. It is safe for concurrent use.
+type Queue struct {
+	opts Options
+
+	mu       sync.Mutex
+	segments []uint64 // sequence numbers of the segment files, oldest first
+	counts   []int    // number of unconsumed records of each segment
+	w        *os.File // newest segment
+	wSize    int64
+	r        *os.File // oldest segment
+	rOff     int64
+	size     int64 // bytes of unconsumed records
+	count    int   // number of unconsumed records
+	dirty    bool
+	closed   bool
+	stopSync chan struct{}
+}
+
+// Open opens the queue stored in opts.Dir, creating it if necessary.
+// Records left by a previous process are kept and will be returned first.
+func Open(opts Options) (*Queue, error) {
+	if opts.Dir == "" {
+		return nil, errors.New("diskqueue: empty directory")
+	}
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = defaultMaxBytes
+	}
+	if opts.SegmentBytes <= 0 {
+		opts.SegmentBytes = defaultSegment
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = defaultSyncEvery
+	}
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	q := &Queue{opts: opts}
+	if err := q.load(); err != nil {
+		q.closeFiles()
+		return nil, err
+	}
+	if opts.Sync == SyncInterval {
+		q.stopSync = make(chan struct{})
+		go q.syncLoop()
+	}
+	return q, nil
+}
+
+// load scans the existing segments, validates them and positions the queue.
+func (q *Queue) load() error {
+	entries, err := os.ReadDir(q.opts.Dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		q.segments = append(q.segments, seq)
+	}
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i] < q.segments[j] })
+
+	cursorSeq, cursorOff := q.readCursor()
+	// Drop the segments that were fully consumed before the cursor was written.
+	for len(q.segments) > 1 && q.segments[0] < cursorSeq {
+		_ = os.Remove(q.segmentPath(q.segments[0]))
+		q.segments = q.segments[1:]
+	}
+	if len(q.segments) == 0 {
+		q.segments = []uint64{cursorSeq}
+		cursorOff = 0
+	} else if q.segments[0] != cursorSeq {
+		cursorOff = 0
+	}
+
+	for i, seq := range q.segments {
+		off := int64(0)
+		if i == 0 {
+			off = cursorOff
+		}
+		valid, fileSize, n, err := scanSegment(q.segmentPath(seq), off)
+		if err != nil {
+			return err
+		}
+		if i == len(q.segments)-1 {
+			// Drop a record torn by a crash in the middle of an append.
+			if err := truncate(q.segmentPath(seq), valid); err != nil {
+				return err
+			}
+			fileSize = valid
+		}
+		if fileSize > off {
+			q.size += fileSize - off
+		}
+		q.counts = append(q.counts, n)
+		q.count += n
+	}
+
+	last := q.segments[len(q.segments)-1]
+	w, err := os.OpenFile(q.segmentPath(last), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	st, err := w.Stat()
+	if err != nil {
+		w.Close()
+		return err
+	}
+	q.w, q.wSize = w, st.Size()
+
+	r, err := os.Open(q.segmentPath(q.segments[0]))
+	if err != nil {
+		return err
+	}
+	q.r, q.rOff = r, cursorOff
+	return nil
+}
+
+// scanSegment returns the offset following the last complete record read
+// from off, the size of the segment file and the number of complete records.
+// The records whose checksum does not match are counted: they are skipped
+// when they are read.
+func scanSegment(path string, off int64) (int64, int64, int, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	n := 0
+	for {
+		rec, err := readRecord(f, off)
+		if ce, ok := err.(*checksumError); ok {
+			off = ce.next
+			n++
+			continue
+		}
+		if err != nil {
+			return off, st.Size(), n, nil
+		}
+		off += headerSize + int64(len(rec))
+		n++
+	}
+}
+
+func truncate(path string, size int64) error {
+	st, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil || st.Size() == size {
+		return err
+	}
+	return os.Truncate(path, size)
+}
+
+// checksumError is returned by readRecord for a complete record whose
+// checksum does not match its data. The next record starts at next.
+type checksumError struct {
+	name      string
+	off, next int64
+}
+
+func (e *checksumError) Error() string {
+	return fmt.Sprintf("diskqueue: corrupted record at offset %d of %s", e.off, e.name)
+}
+
+// readRecord reads and verifies the record stored at off. It returns a
+// *checksumError if the record is complete but its data is corrupted.
+func readRecord(f *os.File, off int64) ([]byte, error) {
+	var hdr [headerSize]byte
+	if _, err := f.ReadAt(hdr[:], off); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[0:4])
+	sum := binary.BigEndian.Uint32(hdr[4:8])
+	if n > maxRecordSize {
+		return nil, fmt.Errorf("diskqueue: invalid record length %d at offset %d of %s", n, off, f.Name())
+	}
+	rec := make([]byte, n)
+	if _, err := f.ReadAt(rec, off+headerSize); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(rec) != sum {
+		return nil, &checksumError{name: f.Name(), off: off, next: off + headerSize + int64(n)}
+	}
+	return rec, nil
+}
+
+// Append adds a record at the end of the queue.
+func (q *Queue) Append(rec []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrClosed
+	}
+	recSize := int64(headerSize + len(rec))
+	if len(rec) > maxRecordSize || q.size+recSize > q.opts.MaxBytes {
+		return ErrFull
+	}
+	if q.wSize > 0 && q.wSize+recSize > q.opts.SegmentBytes {
+		if err := q.rotate(); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, recSize)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(rec)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(rec))
+	copy(buf[headerSize:], rec)
+	if _, err := q.w.Write(buf); err != nil {
+		return err
+	}
+	q.wSize += recSize
+	q.size += recSize
+	q.counts[len(q.counts)-1]++
+	q.count++
+	if q.opts.Sync == SyncAlways {
+		return q.w.Sync()
+	}
+	q.dirty = true
+	return nil
+}
+
+// rotate starts a new segment file.
+func (q *Queue) rotate() error {
+	if err := q.w.Sync(); err != nil {
+		return err
+	}
+	if err := q.w.Close(); err != nil {
+		return err
+	}
+	seq := q.segments[len(q.segments)-1] + 1
+	w, err := os.OpenFile(q.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	q.segments = append(q.segments, seq)
+	q.counts = append(q.counts, 0)
+	q.w, q.wSize, q.dirty = w, 0, false
+	return nil
+}
+
+// Peek returns the oldest record without removing it from the queue.
+func (q *Queue) Peek() ([]byte, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	rec, _, err := q.peek()
+	return rec, err
+}
+
+// Pop removes the oldest record from the queue.
+func (q *Queue) Pop() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	_, next, err := q.peek()
+	if err != nil {
+		return err
+	}
+	q.size -= next - q.rOff
+	q.counts[0]--
+	q.count--
+	q.rOff = next
+	return q.writeCursor()
+}
+
+// peek returns the oldest record and the offset following it. The records
+// whose checksum does not match are skipped, and it moves to the next
+// segment when the current one is exhausted or its tail is unreadable.
+func (q *Queue) peek() ([]byte, int64, error) {
+	if q.closed {
+		return nil, 0, ErrClosed
+	}
+	for {
+		rec, err := readRecord(q.r, q.rOff)
+		if err == nil {
+			return rec, q.rOff + headerSize + int64(len(rec)), nil
+		}
+		if ce, ok := err.(*checksumError); ok {
+			q.size -= ce.next - q.rOff
+			if q.counts[0] > 0 {
+				q.counts[0]--
+				q.count--
+			}
+			q.rOff = ce.next
+			if err := q.writeCursor(); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		if len(q.segments) == 1 {
+			if q.rOff >= q.wSize {
+				return nil, 0, ErrEmpty
+			}
+			// The tail of the only segment is unreadable: start a new
+			// segment so that the corrupted one is dropped below.
+			if err := q.rotate(); err != nil {
+				return nil, 0, err
+			}
+		}
+		// The oldest segment is exhausted, or its tail is unreadable.
+		if err := q.advance(); err != nil {
+			return nil, 0, err
+		}
+	}
+}
+
+// advance deletes the oldest segment and starts reading the next one. The
+// records left in the oldest segment, if it is corrupted, are dropped.
+func (q *Queue) advance() error {
+	old := q.segments[0]
+	if st, err := q.r.Stat(); err == nil && st.Size() > q.rOff {
+		q.size -= st.Size() - q.rOff
+	}
+	q.count -= q.counts[0]
+	q.r.Close()
+	q.segments = q.segments[1:]
+	q.counts = q.counts[1:]
+	r, err := os.Open(q.segmentPath(q.segments[0]))
+	if err != nil {
+		return err
+	}
+	q.r, q.rOff = r, 0
+	if err := q.writeCursor(); err != nil {
+		return err
+	}
+	return os.Remove(q.segmentPath(old))
+}
+
+// Len returns the number of records in the queue.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.count
+}
+
+// Size returns the number of bytes used by the records in the queue.
+func (q *Queue) Size() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size
+}
+
+// Sync flushes the appended records to stable storage.
+func (q *Queue) Sync() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed || !q.dirty {
+		return nil
+	}
+	q.dirty = false
+	return q.w.Sync()
+}
+
+func (q *Queue) syncLoop() {
+	t := time.NewTicker(q.opts.SyncInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			_ = q.Sync()
+		case <-q.stopSync:
+			return
+		}
+	}
+}
+
+// Close flushes and closes the queue.
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	if q.stopSync != nil {
+		close(q.stopSync)
+	}
+	var err error
+	if q.opts.Sync != SyncNever {
+		err = q.w.Sync()
+	}
+	if cerr := q.closeFiles(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (q *Queue) closeFiles() error {
+	var err error
+	if q.w != nil {
+		err = q.w.Close()
+	}
+	if q.r != nil {
+		q.r.Close()
+	}
+	return err
+}
+
+func (q *Queue) segmentPath(seq uint64) string {
+	return filepath.Join(q.opts.Dir, fmt.Sprintf("%020d%s", seq, segmentExt))
+}
+
+// readCursor returns the read position persisted by writeCursor.
+func (q *Queue) readCursor() (uint64, int64) {
+	b, err := os.ReadFile(filepath.Join(q.opts.Dir, cursorFile))
+	if err != nil || len(b) != cursorSize {
+		return 0, 0
+	}
+	return binary.BigEndian.Uint64(b[0:8]), int64(binary.BigEndian.Uint64(b[8:16]))
+}
+
+// writeCursor atomically persists the read position.
+func (q *Queue) writeCursor() error {
+	var b [cursorSize]byte
+	binary.BigEndian.PutUint64(b[0:8], q.segments[0])
+	binary.BigEndian.PutUint64(b[8:16], uint64(q.rOff))
+	tmp := filepath.Join(q.opts.Dir, cursorFile+".tmp")
+	if err := os.WriteFile(tmp, b[:], 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(q.opts.Dir, cursorFile))
+}
@@ -0,0 +1,275 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package diskqueue
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func drain(t *testing.T, q *Queue) []string {
+	t.Helper()
+	var got []string
+	for {
+		rec, err := q.Peek()
+		if err == ErrEmpty {
+			return got
+		}
+		if err != nil {
+			t.Fatalf("Peek() error = %v", err)
+		}
+		got = append(got, string(rec))
+		if err := q.Pop(); err != nil {
+			t.Fatalf("Pop() error = %v", err)
+		}
+	}
+}
+
+func TestQueueFIFO(t *testing.T) {
+	q, err := Open(Options{Dir: t.TempDir(), SegmentBytes: 64, Sync: SyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	var want []string
+	for i := 0; i < 20; i++ {
+		rec := fmt.Sprintf("record-%02d", i)
+		want = append(want, rec)
+		if err := q.Append([]byte(rec)); err != nil {
+			t.Fatalf("Append(%q) error = %v", rec, err)
+		}
+	}
+	if got := q.Len(); got != 20 {
+		t.Errorf("Len() = %d; want 20", got)
+	}
+	got := drain(t, q)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("records = %v; want %v", got, want)
+	}
+	if q.Len() != 0 || q.Size() != 0 {
+		t.Errorf("Len(), Size() = %d, %d; want 0, 0", q.Len(), q.Size())
+	}
+	segments, _ := filepath.Glob(filepath.Join(q.opts.Dir, "*"+segmentExt))
+	if len(segments) != 1 {
+		t.Errorf("got %d segment files after draining; want 1", len(segments))
+	}
+}
+
+func TestQueueReopen(t *testing.T) {
+	dir := t.TempDir()
+	q, err := Open(Options{Dir: dir, SegmentBytes: 64, Sync: SyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := q.Append([]byte(fmt.Sprintf("record-%02d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		if err := q.Pop(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err = Open(Options{Dir: dir, SegmentBytes: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if got := q.Len(); got != 6 {
+		t.Errorf("Len() after reopen = %d; want 6", got)
+	}
+	got := drain(t, q)
+	want := []string{"record-04", "record-05", "record-06", "record-07", "record-08", "record-09"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("records = %v; want %v", got, want)
+	}
+}
+
+func TestQueueTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	q, err := Open(Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range []string{"a", "b"} {
+		if err := q.Append([]byte(rec)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.Close()
+
+	// Simulate a crash in the middle of an append.
+	f, err := os.OpenFile(q.segmentPath(0), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 9, 1, 2})
+	f.Close()
+
+	q, err = Open(Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err := q.Append([]byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(drain(t, q)), "[a b c]"; got != want {
+		t.Errorf("records = %v; want %v", got, want)
+	}
+}
+
+func TestQueueCorruptedRecord(t *testing.T) {
+	for _, segmentBytes := range []int64{0, 2 * (headerSize + 1)} {
+		q, err := Open(Options{Dir: t.TempDir(), SegmentBytes: segmentBytes, Sync: SyncAlways})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rec := range []string{"a", "b", "c", "d"} {
+			if err := q.Append([]byte(rec)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Corrupt the checksum of "b", in the first segment.
+		f, err := os.OpenFile(q.segmentPath(0), os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteAt([]byte{0xff}, headerSize+1+4)
+		f.Close()
+
+		if got := fmt.Sprint(drain(t, q)); got != "[a c d]" {
+			t.Errorf("SegmentBytes %d: records = %v; want [a c d]", segmentBytes, got)
+		}
+		if q.Len() != 0 || q.Size() != 0 {
+			t.Errorf("SegmentBytes %d: Len(), Size() = %d, %d; want 0, 0", segmentBytes, q.Len(), q.Size())
+		}
+		if err := q.Append([]byte("e")); err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(drain(t, q)); got != "[e]" {
+			t.Errorf("SegmentBytes %d: records after corruption = %v; want [e]", segmentBytes, got)
+		}
+		q.Close()
+	}
+}
+
+func TestQueueCorruptedRecordReopen(t *testing.T) {
+	dir := t.TempDir()
+	q, err := Open(Options{Dir: dir, Sync: SyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range []string{"a", "b", "c"} {
+		if err := q.Append([]byte(rec)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.Close()
+	// Corrupt the data of "b", in the middle of the segment.
+	f, err := os.OpenFile(q.segmentPath(0), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{'x'}, 2*headerSize+1)
+	f.Close()
+
+	q, err = Open(Options{Dir: dir, Sync: SyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err := q.Append([]byte("d")); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(drain(t, q)); got != "[a c d]" {
+		t.Errorf("records = %v; want [a c d]", got)
+	}
+	if q.Len() != 0 || q.Size() != 0 {
+		t.Errorf("Len(), Size() = %d, %d; want 0, 0", q.Len(), q.Size())
+	}
+}
+
+func TestQueueUnreadableHeader(t *testing.T) {
+	q, err := Open(Options{Dir: t.TempDir(), Sync: SyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	for _, rec := range []string{"a", "b", "c"} {
+		if err := q.Append([]byte(rec)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Give "b" a length beyond the segment: the records following it cannot
+	// be located.
+	f, err := os.OpenFile(q.segmentPath(0), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{0xff, 0xff}, headerSize+1)
+	f.Close()
+
+	if got := fmt.Sprint(drain(t, q)); got != "[a]" {
+		t.Errorf("records = %v; want [a]", got)
+	}
+	if q.Len() != 0 || q.Size() != 0 {
+		t.Errorf("Len(), Size() = %d, %d; want 0, 0", q.Len(), q.Size())
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	q, err := Open(Options{Dir: t.TempDir(), MaxBytes: 3 * (headerSize + 4)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	for i := 0; i < 3; i++ {
+		if err := q.Append([]byte("abcd")); err != nil {
+			t.Fatalf("Append() error = %v", err)
+		}
+	}
+	if err := q.Append([]byte("abcd")); err != ErrFull {
+		t.Fatalf("Append() error = %v; want %v", err, ErrFull)
+	}
+	if err := q.Pop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Append([]byte("abcd")); err != nil {
+		t.Fatalf("Append() after Pop() error = %v", err)
+	}
+}
+
+func TestQueueClosed(t *testing.T) {
+	q, err := Open(Options{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+	if err := q.Append([]byte("a")); err != ErrClosed {
+		t.Errorf("Append() error = %v; want %v", err, ErrClosed)
+	}
+	if _, err := q.Peek(); err != ErrClosed {
+		t.Errorf("Peek() error = %v; want %v", err, ErrClosed)
+	}
+}
@@ -0,0 +1,344 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package logging contains an exporter that writes log entries to
+// Stackdriver Logging (Cloud Logging).
+//
+// Log entries written within a traced context carry the trace and span IDs
+// of the current span, so that they are shown along with the spans exported
+// to Stackdriver Trace.
+package logging // import "contrib.go.opencensus.io/exporter/stackdriver/logging"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	logging "cloud.google.com/go/logging/apiv2"
+	"cloud.google.com/go/logging/apiv2/loggingpb"
+	"contrib.go.opencensus.io/exporter/stackdriver"
+	"go.opencensus.io/trace"
+	"google.golang.org/api/option"
+	"google.golang.org/api/support/bundler"
+	monitoredrespb "google.golang.org/genproto/googleapis/api/monitoredres"
+	logtypepb "google.golang.org/genproto/googleapis/logging/type"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	defaultLogID             = "opencensus"
+	defaultTimeout           = 12 * time.Second
+	defaultBufferedByteLimit = 8 * 1024 * 1024
+)
+
+// Severity is the severity of a log entry.
+type Severity int
+
+// Severities supported by Stackdriver Logging.
+const (
+	Default   = Severity(logtypepb.LogSeverity_DEFAULT)
+	Debug     = Severity(logtypepb.LogSeverity_DEBUG)
+	Info      = Severity(logtypepb.LogSeverity_INFO)
+	Notice    = Severity(logtypepb.LogSeverity_NOTICE)
+	Warning   = Severity(logtypepb.LogSeverity_WARNING)
+	Error     = Severity(logtypepb.LogSeverity_ERROR)
+	Critical  = Severity(logtypepb.LogSeverity_CRITICAL)
+	Alert     = Severity(logtypepb.LogSeverity_ALERT)
+	Emergency = Severity(logtypepb.LogSeverity_EMERGENCY)
+)
+
+// Record is a log record.
+type Record struct {
+	// Timestamp is the time of the record. If unset, the time Log is called
+	// is used.
+	Timestamp time.Time
+
+	// Severity is the severity of the record.
+	Severity Severity
+
+	// Message is the message of the record. If Fields is nil, it is written
+	// as a text payload.
+	Message string
+
+	// Fields, if not nil, are written as a JSON payload along with Message,
+	// which is stored in the "message" field. Values must be supported by
+	// structpb.NewValue.
+	Fields map[string]interface{}
+
+	// Labels are added to the labels of the log entry.
+	Labels map[string]string
+}
+
+// Options contains options for configuring the exporter.
+type Options struct {
+	// ProjectID is the identifier of the Stackdriver project the logs and
+	// traces are written to. It is required.
+	ProjectID string
+
+	// LogID is the name of the log the entries are written to.
+	// If unset, "opencensus" is used.
+	LogID string
+
+	// Resource is the monitored resource of the log entries.
+	// If unset, the "global" resource is used.
+	Resource *monitoredrespb.MonitoredResource
+
+	// DefaultLabels are added to the labels of every log entry.
+	DefaultLabels map[string]string
+
+	// ClientOptions are additional options to be passed
+	// to the underlying Stackdriver Logging API client.
+	// Optional.
+	ClientOptions []option.ClientOption
+
+	// Context allows you to provide a custom context for API calls.
+	//
+	// This context will be used several times: first, to create Stackdriver
+	// logging client, and then every time a new batch of log entries needs
+	// to be uploaded.
+	//
+	// Do not set a timeout on this context. Instead, set the Timeout option.
+	//
+	// If unset, context.Background() will be used.
+	Context context.Context
+
+	// Timeout for all API calls. If not set, defaults to 12 seconds.
+	Timeout time.Duration
+
+	// OnError is the hook to be called when there is an error uploading log
+	// entries. If no custom hook is set, errors are logged.
+	// Optional.
+	OnError func(err error)
+
+	// BundleDelayThreshold determines the max amount of time the exporter
+	// can wait before uploading log entries.
+	// If unset, a default of 2s is used.
+	BundleDelayThreshold time.Duration
+
+	// BundleCountThreshold determines how many log entries can be buffered
+	// before batch uploading them.
+	// If unset, a default of 50 is used.
+	BundleCountThreshold int
+
+	// BufferMaxBytes is the maximum size (in bytes) of log entries that will
+	// be buffered in memory before being dropped.
+	// If unset, a default of 8MB will be used.
+	BufferMaxBytes int
+
+	// NumberOfWorkers sets the number of go rountines that send requests
+	// to Stackdriver Logging. The minimum number of workers is 1.
+	NumberOfWorkers int
+}
+
+// Exporter writes log records to Stackdriver Logging.
+type Exporter struct {
+	o       Options
+	logName string
+	client  *logging.Client
+	bundler *bundler.Bundler
+}
+
+// NewExporter creates a new Exporter.
+func NewExporter(o Options) (*Exporter, error) {
+	if o.ProjectID == "" {
+		return nil, errors.New("stackdriver/logging: ProjectID is required")
+	}
+	ctx := o.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	client, err := logging.NewClient(ctx, o.ClientOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("stackdriver/logging: couldn't initialize logging client: %v", err)
+	}
+	return newExporterWithClient(o, client), nil
+}
+
+// NewExporterFrom creates an exporter writing log records to the logID log,
+// in the project and with the monitored resource of the Stackdriver exporter
+// se. Log records are batched with the bundling options of se, and are
+// associated with the spans it exports. The Logging API client is created
+// with the LoggingClientOptions of se.
+//
+// The returned exporter must be closed independently of se.
+func NewExporterFrom(se *stackdriver.Exporter, logID string) (*Exporter, error) {
+	so := se.Options()
+	clientOptions := make([]option.ClientOption, 0, len(so.LoggingClientOptions)+1)
+	clientOptions = append(clientOptions, so.LoggingClientOptions...)
+	clientOptions = append(clientOptions, option.WithUserAgent(so.UserAgent))
+	return NewExporter(Options{
+		ProjectID:            so.ProjectID,
+		LogID:                logID,
+		Resource:             so.Resource,
+		ClientOptions:        clientOptions,
+		Context:              so.Context,
+		Timeout:              so.Timeout,
+		OnError:              so.OnError,
+		BundleDelayThreshold: so.BundleDelayThreshold,
+		BundleCountThreshold: so.BundleCountThreshold,
+		NumberOfWorkers:      so.NumberOfWorkers,
+	})
+}
+
+func newExporterWithClient(o Options, c *logging.Client) *Exporter {
+	if o.LogID == "" {
+		o.LogID = defaultLogID
+	}
+	if o.Resource == nil {
+		o.Resource = &monitoredrespb.MonitoredResource{Type: "global"}
+	}
+	e := &Exporter{
+		o:       o,
+		logName: "projects/" + o.ProjectID + "/logs/" + url.PathEscape(o.LogID),
+		client:  c,
+	}
+	b := bundler.NewBundler((*loggingpb.LogEntry)(nil), func(bundle interface{}) {
+		e.upload(bundle.([]*loggingpb.LogEntry))
+	})
+	if o.BundleDelayThreshold > 0 {
+		b.DelayThreshold = o.BundleDelayThreshold
+	} else {
+		b.DelayThreshold = 2 * time.Second
+	}
+	if o.BundleCountThreshold > 0 {
+		b.BundleCountThreshold = o.BundleCountThreshold
+	} else {
+		b.BundleCountThreshold = 50
+	}
+	if o.NumberOfWorkers > 0 {
+		b.HandlerLimit = o.NumberOfWorkers
+	}
+	if o.BufferMaxBytes > 0 {
+		b.BufferedByteLimit = o.BufferMaxBytes
+	} else {
+		b.BufferedByteLimit = defaultBufferedByteLimit
+	}
+	e.bundler = b
+	return e
+}
+
+// Log queues r to be written to Stackdriver Logging. If ctx holds a span, the
+// log entry is associated with its trace and span IDs.
+func (e *Exporter) Log(ctx context.Context, r Record) {
+	entry, err := e.entry(ctx, r)
+	if err != nil {
+		e.handleError(err)
+		return
+	}
+	switch err := e.bundler.Add(entry, proto.Size(entry)); err {
+	case nil:
+	case bundler.ErrOverflow:
+		e.handleError(errors.New("failed to upload log entry: buffer full"))
+	default:
+		e.handleError(err)
+	}
+}
+
+// entry converts r into a log entry.
+func (e *Exporter) entry(ctx context.Context, r Record) (*loggingpb.LogEntry, error) {
+	ts := r.Timestamp
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	entry := &loggingpb.LogEntry{
+		Timestamp: timestamppb.New(ts),
+		Severity:  logtypepb.LogSeverity(r.Severity),
+		Labels:    r.Labels,
+	}
+	if r.Fields == nil {
+		entry.Payload = &loggingpb.LogEntry_TextPayload{TextPayload: r.Message}
+	} else {
+		fields := make(map[string]interface{}, len(r.Fields)+1)
+		for k, v := range r.Fields {
+			fields[k] = v
+		}
+		if r.Message != "" {
+			fields["message"] = r.Message
+		}
+		payload, err := structpb.NewStruct(fields)
+		if err != nil {
+			return nil, fmt.Errorf("stackdriver/logging: invalid log fields: %v", err)
+		}
+		entry.Payload = &loggingpb.LogEntry_JsonPayload{JsonPayload: payload}
+	}
+	if span := trace.FromContext(ctx); span != nil {
+		sc := span.SpanContext()
+		entry.Trace = "projects/" + e.o.ProjectID + "/traces/" + sc.TraceID.String()
+		entry.SpanId = sc.SpanID.String()
+		entry.TraceSampled = sc.IsSampled()
+	}
+	return entry, nil
+}
+
+// upload writes entries to Stackdriver Logging.
+func (e *Exporter) upload(entries []*loggingpb.LogEntry) {
+	ctx := e.o.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	// Create a never-sampled span to prevent traces associated with exporter.
+	ctx, span := trace.StartSpan(
+		ctx,
+		"contrib.go.opencensus.io/exporter/stackdriver/logging.upload",
+		trace.WithSampler(trace.NeverSample()),
+	)
+	defer span.End()
+	span.AddAttributes(trace.Int64Attribute("num_entries", int64(len(entries))))
+
+	timeout := e.o.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	_, err := e.client.WriteLogEntries(ctx, &loggingpb.WriteLogEntriesRequest{
+		LogName:        e.logName,
+		Resource:       e.o.Resource,
+		Labels:         e.o.DefaultLabels,
+		Entries:        entries,
+		PartialSuccess: true,
+	})
+	if err != nil {
+		span.SetStatus(trace.Status{Code: 2, Message: err.Error()})
+		e.handleError(err)
+	}
+}
+
+// Flush waits for the logged records to be uploaded.
+//
+// This is useful if your program is ending and you do not want to lose
+// recent log records.
+func (e *Exporter) Flush() {
+	e.bundler.Flush()
+}
+
+// Close flushes the logged records and closes the client connection.
+func (e *Exporter) Close() error {
+	e.Flush()
+	return e.client.Close()
+}
+
+func (e *Exporter) handleError(err error) {
+	if e.o.OnError != nil {
+		e.o.OnError(err)
+		return
+	}
+	log.Printf("Failed to export to Stackdriver Logging: %v", err)
+}
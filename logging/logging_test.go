@@ -0,0 +1,213 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	logging "cloud.google.com/go/logging/apiv2"
+	"cloud.google.com/go/logging/apiv2/loggingpb"
+	"contrib.go.opencensus.io/exporter/stackdriver"
+	"contrib.go.opencensus.io/exporter/stackdriver/stackdrivertest"
+	"go.opencensus.io/trace"
+	"google.golang.org/api/option"
+	monitoredrespb "google.golang.org/genproto/googleapis/api/monitoredres"
+	logtypepb "google.golang.org/genproto/googleapis/logging/type"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+type fakeLoggingServer struct {
+	loggingpb.UnimplementedLoggingServiceV2Server
+
+	mu   sync.Mutex
+	reqs []*loggingpb.WriteLogEntriesRequest
+}
+
+func (s *fakeLoggingServer) WriteLogEntries(ctx context.Context, req *loggingpb.WriteLogEntriesRequest) (*loggingpb.WriteLogEntriesResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reqs = append(s.reqs, req)
+	return &loggingpb.WriteLogEntriesResponse{}, nil
+}
+
+// startFakeLoggingServer starts a fake Logging API server, and returns it
+// along with its address.
+func startFakeLoggingServer(t *testing.T) (*fakeLoggingServer, string) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to bind to an available address: %v", err)
+	}
+	server := new(fakeLoggingServer)
+	srv := grpc.NewServer()
+	loggingpb.RegisterLoggingServiceV2Server(srv, server)
+	go func() {
+		_ = srv.Serve(ln)
+	}()
+	t.Cleanup(srv.Stop)
+	return server, ln.Addr().String()
+}
+
+func newTestExporter(t *testing.T, o Options) (*Exporter, *fakeLoggingServer) {
+	server, addr := startFakeLoggingServer(t)
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := logging.NewClient(context.Background(), option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newExporterWithClient(o, client), server
+}
+
+func TestLog(t *testing.T) {
+	resource := &monitoredrespb.MonitoredResource{Type: "gce_instance", Labels: map[string]string{"instance_id": "1"}}
+	e, server := newTestExporter(t, Options{
+		ProjectID: "test-project",
+		LogID:     "app/requests",
+		Resource:  resource,
+		OnError:   func(err error) { t.Error(err) },
+	})
+
+	ctx, span := trace.StartSpan(context.Background(), "span", trace.WithSampler(trace.AlwaysSample()))
+	now := time.Now()
+	e.Log(ctx, Record{Timestamp: now, Severity: Warning, Message: "in span"})
+	span.End()
+	e.Log(context.Background(), Record{Message: "structured", Fields: map[string]interface{}{"status": 404}})
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	var entries []*loggingpb.LogEntry
+	for _, req := range server.reqs {
+		if got, want := req.LogName, "projects/test-project/logs/app%2Frequests"; got != want {
+			t.Errorf("LogName = %q; want %q", got, want)
+		}
+		if req.Resource.GetType() != resource.Type {
+			t.Errorf("Resource = %v; want %v", req.Resource, resource)
+		}
+		entries = append(entries, req.Entries...)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries; want 2", len(entries))
+	}
+
+	sc := span.SpanContext()
+	traced := entries[0]
+	if got, want := traced.Trace, "projects/test-project/traces/"+sc.TraceID.String(); got != want {
+		t.Errorf("Trace = %q; want %q", got, want)
+	}
+	if got, want := traced.SpanId, sc.SpanID.String(); got != want {
+		t.Errorf("SpanId = %q; want %q", got, want)
+	}
+	if !traced.TraceSampled {
+		t.Error("TraceSampled = false; want true")
+	}
+	if traced.Severity != logtypepb.LogSeverity_WARNING {
+		t.Errorf("Severity = %v; want WARNING", traced.Severity)
+	}
+	if !traced.Timestamp.AsTime().Equal(now) {
+		t.Errorf("Timestamp = %v; want %v", traced.Timestamp.AsTime(), now)
+	}
+	if got := traced.GetTextPayload(); got != "in span" {
+		t.Errorf("TextPayload = %q; want %q", got, "in span")
+	}
+
+	untraced := entries[1]
+	if untraced.Trace != "" || untraced.SpanId != "" {
+		t.Errorf("Trace, SpanId = %q, %q; want empty", untraced.Trace, untraced.SpanId)
+	}
+	fields := untraced.GetJsonPayload().GetFields()
+	if fields["message"].GetStringValue() != "structured" || fields["status"].GetNumberValue() != 404 {
+		t.Errorf("JsonPayload = %v; want message and status fields", untraced.GetJsonPayload())
+	}
+}
+
+func TestNewExporterFrom(t *testing.T) {
+	srv, err := stackdrivertest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	server, addr := startFakeLoggingServer(t)
+
+	resource := &monitoredrespb.MonitoredResource{Type: "gce_instance", Labels: map[string]string{"instance_id": "1"}}
+	// Spare capacity must not be shared by the client options of the
+	// logging exporters.
+	loggingOptions := make([]option.ClientOption, 0, 4)
+	loggingOptions = append(loggingOptions,
+		option.WithEndpoint(addr),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())))
+	se, err := stackdriver.NewExporter(stackdriver.Options{
+		ProjectID:               "test-project",
+		Resource:                resource,
+		MonitoringClientOptions: srv.ClientOptions(),
+		TraceClientOptions:      srv.ClientOptions(),
+		LoggingClientOptions:    loggingOptions,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer se.Close()
+
+	for i := 0; i < 2; i++ {
+		e, err := NewExporterFrom(se, "app")
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.Log(context.Background(), Record{Message: "message"})
+		if err := e.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := loggingOptions[:cap(loggingOptions)][3]; got != nil {
+		t.Errorf("LoggingClientOptions changed: %v", got)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.reqs) != 2 {
+		t.Fatalf("got %d requests; want 2", len(server.reqs))
+	}
+	for _, req := range server.reqs {
+		if got, want := req.LogName, "projects/test-project/logs/app"; got != want {
+			t.Errorf("LogName = %q; want %q", got, want)
+		}
+		if req.Resource.GetType() != resource.Type {
+			t.Errorf("Resource = %v; want %v", req.Resource, resource)
+		}
+	}
+}
+
+func TestLogInvalidFields(t *testing.T) {
+	var errs []error
+	e, _ := newTestExporter(t, Options{
+		ProjectID: "test-project",
+		OnError:   func(err error) { errs = append(errs, err) },
+	})
+	defer e.Close()
+	e.Log(context.Background(), Record{Fields: map[string]interface{}{"ch": make(chan int)}})
+	if len(errs) != 1 {
+		t.Errorf("got %d errors; want 1", len(errs))
+	}
+}
@@ -22,12 +22,16 @@ directly to Stackdriver Metrics.
 import (
 	"context"
 	"fmt"
-	"strings"
+	"sort"
+	"sync/atomic"
 
 	"github.com/golang/protobuf/ptypes/any"
 	"github.com/golang/protobuf/ptypes/timestamp"
 	"go.opencensus.io/trace"
+	"google.golang.org/api/support/bundler"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 
 	"cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
 	distributionpb "google.golang.org/genproto/googleapis/api/distribution"
@@ -41,11 +45,9 @@ import (
 )
 
 const (
-	exemplarAttachmentTypeString  = "type.googleapis.com/google.protobuf.StringValue"
-	exemplarAttachmentTypeSpanCtx = "type.googleapis.com/google.monitoring.v3.SpanContext"
-
-	// TODO(songy23): add support for this.
-	// exemplarAttachmentTypeDroppedLabels = "type.googleapis.com/google.monitoring.v3.DroppedLabels"
+	exemplarAttachmentTypeString        = "type.googleapis.com/google.protobuf.StringValue"
+	exemplarAttachmentTypeSpanCtx       = "type.googleapis.com/google.monitoring.v3.SpanContext"
+	exemplarAttachmentTypeDroppedLabels = "type.googleapis.com/google.monitoring.v3.DroppedLabels"
 )
 
 // ExportMetrics exports OpenCensus Metrics to Stackdriver Monitoring.
@@ -55,8 +57,16 @@ func (se *statsExporter) ExportMetrics(ctx context.Context, metrics []*metricdat
 	}
 
 	for _, metric := range metrics {
-		se.metricsBundler.Add(metric, 1)
-		// TODO: [rghetia] handle errors.
+		atomic.AddInt64(&se.queuedMetrics, 1)
+		if err := se.metricsBundler.add(ctx, metric, se.o.MetricsBundleOptions.statsItemSize(len(metric.TimeSeries))); err != nil {
+			atomic.AddInt64(&se.queuedMetrics, -1)
+			// TODO: [rghetia] handle errors.
+			reason := errorReason(err)
+			if err == bundler.ErrOverflow {
+				reason = dropReasonBufferFull
+			}
+			se.sm.timeSeriesDroppedAdd(len(metric.TimeSeries), reason)
+		}
 	}
 
 	return nil
@@ -70,8 +80,10 @@ func (se *statsExporter) handleMetricsUpload(metrics []*metricdata.Metric) {
 }
 
 func (se *statsExporter) uploadMetrics(metrics []*metricdata.Metric) error {
-	ctx, cancel := newContextWithTimeout(se.o.Context, se.o.Timeout)
-	defer cancel()
+	ctx := se.o.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
 
 	var errors []error
 
@@ -82,21 +94,39 @@ func (se *statsExporter) uploadMetrics(metrics []*metricdata.Metric) error {
 	)
 	defer span.End()
 
+	metrics = se.expandSummaryMetrics(metrics)
+	// refused holds the metrics not exported because of ReconcileRefuse.
+	refused := make(map[*metricdata.Metric]bool)
 	for _, metric := range metrics {
 		// Now create the metric descriptor remotely.
 		if err := se.createMetricDescriptorFromMetric(ctx, metric); err != nil {
+			dropped := 0
+			if _, ok := err.(*DescriptorDriftError); ok {
+				refused[metric] = true
+				dropped = len(metric.TimeSeries)
+				se.sm.timeSeriesDroppedAdd(dropped, errorReason(err))
+			}
 			span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
-			errors = append(errors, err)
+			errors = append(errors, metricError(SignalMetricDescriptor, se.metricTypeFromProto(metric.Descriptor.Name), dropped, err))
 			continue
 		}
 	}
 
 	var allTimeSeries []*monitoringpb.TimeSeries
 	for _, metric := range metrics {
+		if refused[metric] {
+			continue
+		}
 		tsl, err := se.metricToMpbTs(ctx, metric)
 		if err != nil {
+			var metricType string
+			var dropped int
+			if metric != nil {
+				metricType, dropped = se.metricTypeFromProto(metric.Descriptor.Name), len(metric.TimeSeries)
+			}
+			se.sm.timeSeriesDroppedAdd(dropped, errorReason(err))
 			span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
-			errors = append(errors, err)
+			errors = append(errors, metricError(SignalMetrics, metricType, dropped, err))
 			continue
 		}
 		if tsl != nil {
@@ -116,7 +146,7 @@ func (se *statsExporter) uploadMetrics(metrics []*metricdata.Metric) error {
 		if len(nonServiceTsBatch) > 0 {
 			nonServiceReql := se.combineTimeSeriesToCreateTimeSeriesRequest(nonServiceTsBatch)
 			for _, ctsreq := range nonServiceReql {
-				if err := createTimeSeries(ctx, se.c, ctsreq); err != nil {
+				if err := se.writeTimeSeries(ctx, false, ctsreq); err != nil {
 					span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
 					errors = append(errors, err)
 				}
@@ -125,7 +155,7 @@ func (se *statsExporter) uploadMetrics(metrics []*metricdata.Metric) error {
 		if len(serviceTsBatch) > 0 {
 			serviceReql := se.combineTimeSeriesToCreateTimeSeriesRequest(serviceTsBatch)
 			for _, ctsreq := range serviceReql {
-				if err := createServiceTimeSeries(ctx, se.c, ctsreq); err != nil {
+				if err := se.writeTimeSeries(ctx, true, ctsreq); err != nil {
 					span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
 					errors = append(errors, err)
 				}
@@ -133,17 +163,10 @@ func (se *statsExporter) uploadMetrics(metrics []*metricdata.Metric) error {
 		}
 	}
 
-	numErrors := len(errors)
-	if numErrors == 0 {
+	if len(errors) == 0 {
 		return nil
-	} else if numErrors == 1 {
-		return errors[0]
 	}
-	errMsgs := make([]string, 0, numErrors)
-	for _, err := range errors {
-		errMsgs = append(errMsgs, err.Error())
-	}
-	return fmt.Errorf("[%s]", strings.Join(errMsgs, "; "))
+	return newExportError(SignalMetrics, errors)
 }
 
 // metricToMpbTs converts a metric into a list of Stackdriver Monitoring v3 API TimeSeries
@@ -159,6 +182,7 @@ func (se *statsExporter) metricToMpbTs(ctx context.Context, metric *metricdata.M
 	metricType := se.metricTypeFromProto(metricName)
 	metricLabelKeys := metric.Descriptor.LabelKeys
 	metricKind, _ := metricDescriptorTypeToMetricKind(metric)
+	keysCollide := labelKeysCollide(metricLabelKeys)
 
 	if metricKind == googlemetricpb.MetricDescriptor_METRIC_KIND_UNSPECIFIED {
 		// ignore these Timeserieses. TODO [rghetia] log errors.
@@ -180,6 +204,9 @@ func (se *statsExporter) metricToMpbTs(ctx context.Context, metric *metricdata.M
 			// TODO: (@rghetia) perhaps log this error from labels extraction, if non-nil.
 			continue
 		}
+		if keysCollide {
+			addDroppedLabels(sdPoints, sanitizationDroppedLabels(metricLabelKeys, ts.LabelValues))
+		}
 
 		var rsc *monitoredrespb.MonitoredResource
 		var mr monitoredresource.Interface
@@ -194,14 +221,21 @@ func (se *statsExporter) metricToMpbTs(ctx context.Context, metric *metricdata.M
 		} else {
 			rsc = resource
 		}
-		timeSeries = append(timeSeries, &monitoringpb.TimeSeries{
+		mts := &monitoringpb.TimeSeries{
 			Metric: &googlemetricpb.Metric{
 				Type:   metricType,
 				Labels: labels,
 			},
 			Resource: rsc,
 			Points:   sdPoints,
-		})
+		}
+		se.compactDistributions(mts)
+		se.setDistributionRanges(mts)
+		if se.cumulative.adjust(metricName, mts) > 0 && len(mts.Points) == 0 {
+			se.sm.timeSeriesDroppedAdd(1, dropReasonOutOfOrder)
+			continue
+		}
+		timeSeries = append(timeSeries, mts)
 	}
 
 	return timeSeries, nil
@@ -266,7 +300,7 @@ func (se *statsExporter) createMetricDescriptorFromMetric(ctx context.Context, m
 		return nil
 	}
 
-	if err = se.createMetricDescriptor(ctx, inMD); err != nil {
+	if err = se.reconcileMetricDescriptor(ctx, inMD); err != nil {
 		return err
 	}
 
@@ -346,6 +380,7 @@ func metricDescriptorTypeToMetricKind(m *metricdata.Metric) (googlemetricpb.Metr
 		return googlemetricpb.MetricDescriptor_GAUGE, googlemetricpb.MetricDescriptor_DISTRIBUTION
 
 	case metricdata.TypeSummary:
+		// Summaries are split by expandSummaryMetrics before being converted.
 		// TODO: [rghetia] after upgrading to proto version3, retrun UNRECOGNIZED instead of UNSPECIFIED
 		return googlemetricpb.MetricDescriptor_METRIC_KIND_UNSPECIFIED, googlemetricpb.MetricDescriptor_VALUE_TYPE_UNSPECIFIED
 
@@ -509,20 +544,85 @@ func metricExemplarToPbExemplar(exemplar *metricdata.Exemplar, projectID string)
 	}
 }
 
+// attachmentsToPbAttachments converts the attachments of an exemplar, in
+// the order of their keys. Span contexts, numbers, booleans and proto
+// messages, such as *monitoringpb.DroppedLabels, keep their type; the other
+// values are converted to strings.
 func attachmentsToPbAttachments(attachments metricdata.Attachments, projectID string) []*any.Any {
+	keys := make([]string, 0, len(attachments))
+	for k := range attachments {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
 	var pbAttachments []*any.Any
-	for _, v := range attachments {
-		if spanCtx, succ := v.(trace.SpanContext); succ {
-			pbAttachments = append(pbAttachments, toPbSpanCtxAttachment(spanCtx, projectID))
-		} else {
-			// Treat everything else as plain string for now.
-			// TODO(songy23): add support for dropped label attachments.
-			pbAttachments = append(pbAttachments, toPbStringAttachment(v))
+	for _, k := range keys {
+		var a *any.Any
+		switch v := attachments[k].(type) {
+		case trace.SpanContext:
+			a = toPbSpanCtxAttachment(v, projectID)
+		case *any.Any:
+			a = v
+		case proto.Message:
+			a = toPbMessageAttachment(v)
+		default:
+			a = toPbScalarAttachment(v)
 		}
+		if a == nil {
+			a = toPbStringAttachment(attachments[k])
+		}
+		pbAttachments = append(pbAttachments, a)
 	}
 	return pbAttachments
 }
 
+// toPbMessageAttachment returns m packed in an Any, or nil if it cannot be
+// marshaled.
+func toPbMessageAttachment(m proto.Message) *any.Any {
+	a, err := anypb.New(m)
+	if err != nil {
+		return nil
+	}
+	return a
+}
+
+// toPbScalarAttachment returns v packed in an Any as a protobuf wrapper
+// type if it is a number or a boolean, or nil otherwise.
+func toPbScalarAttachment(v interface{}) *any.Any {
+	var m proto.Message
+	switch v := v.(type) {
+	case bool:
+		m = wrapperspb.Bool(v)
+	case int:
+		m = wrapperspb.Int64(int64(v))
+	case int8:
+		m = wrapperspb.Int64(int64(v))
+	case int16:
+		m = wrapperspb.Int64(int64(v))
+	case int32:
+		m = wrapperspb.Int64(int64(v))
+	case int64:
+		m = wrapperspb.Int64(v)
+	case uint:
+		m = wrapperspb.UInt64(uint64(v))
+	case uint8:
+		m = wrapperspb.UInt64(uint64(v))
+	case uint16:
+		m = wrapperspb.UInt64(uint64(v))
+	case uint32:
+		m = wrapperspb.UInt64(uint64(v))
+	case uint64:
+		m = wrapperspb.UInt64(v)
+	case float32:
+		m = wrapperspb.Double(float64(v))
+	case float64:
+		m = wrapperspb.Double(v)
+	default:
+		return nil
+	}
+	return toPbMessageAttachment(m)
+}
+
 func toPbStringAttachment(v interface{}) *any.Any {
 	s := fmt.Sprintf("%v", v)
 	return &any.Any{
@@ -25,6 +25,7 @@ import (
 
 	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
 	"cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -39,6 +40,7 @@ type metricsBatcher struct {
 
 	// Counts all dropped TimeSeries by this metricsBatcher.
 	droppedTimeSeries int
+	sm                *selfMetrics
 
 	workers []*worker
 	// reqsChan, respsChan and wg are shared between metricsBatcher and worker goroutines.
@@ -47,7 +49,7 @@ type metricsBatcher struct {
 	wg        *sync.WaitGroup
 }
 
-func newMetricsBatcher(ctx context.Context, projectID string, numWorkers int, mc *monitoring.MetricClient, timeout time.Duration) *metricsBatcher {
+func newMetricsBatcher(ctx context.Context, projectID string, numWorkers int, mc *monitoring.MetricClient, timeout time.Duration, retry *RetryPolicy, sm *selfMetrics) *metricsBatcher {
 	if numWorkers < minNumWorkers {
 		numWorkers = minNumWorkers
 	}
@@ -61,7 +63,7 @@ func newMetricsBatcher(ctx context.Context, projectID string, numWorkers int, mc
 	var wg sync.WaitGroup
 	wg.Add(numWorkers)
 	for i := 0; i < numWorkers; i++ {
-		w := newWorker(ctx, mc, reqsChan, respsChan, &wg, timeout)
+		w := newWorker(ctx, mc, reqsChan, respsChan, &wg, timeout, retry, sm)
 		workers = append(workers, w)
 		go w.start()
 	}
@@ -69,6 +71,7 @@ func newMetricsBatcher(ctx context.Context, projectID string, numWorkers int, mc
 		projectName:       fmt.Sprintf("projects/%s", projectID),
 		allTss:            make([]*monitoringpb.TimeSeries, 0, maxTimeSeriesPerUpload),
 		droppedTimeSeries: 0,
+		sm:                sm,
 		workers:           workers,
 		wg:                &wg,
 		reqsChan:          reqsChan,
@@ -77,6 +80,17 @@ func newMetricsBatcher(ctx context.Context, projectID string, numWorkers int, mc
 }
 
 func (mb *metricsBatcher) recordDroppedTimeseries(numTimeSeries int, errs ...error) {
+	reason := errorReason(nil)
+	if len(errs) > 0 {
+		reason = errorReason(errs[0])
+	}
+	mb.sm.timeSeriesDroppedAdd(numTimeSeries, reason)
+	mb.addResponse(numTimeSeries, errs)
+}
+
+// addResponse accounts for time series dropped by a worker, which already
+// recorded them in the self metrics.
+func (mb *metricsBatcher) addResponse(numTimeSeries int, errs []error) {
 	mb.droppedTimeSeries += numTimeSeries
 	for _, err := range errs {
 		if err != nil {
@@ -103,24 +117,16 @@ func (mb *metricsBatcher) close(ctx context.Context) error {
 	mb.wg.Wait()
 	for i := 0; i < len(mb.workers); i++ {
 		resp := <-mb.respsChan
-		mb.recordDroppedTimeseries(resp.droppedTimeSeries, resp.errs...)
+		mb.addResponse(resp.droppedTimeSeries, resp.errs)
 	}
 	close(mb.respsChan)
 
-	numErrors := len(mb.allErrs)
-	if numErrors == 0 {
+	if len(mb.allErrs) == 0 {
 		return nil
 	}
-
-	if numErrors == 1 {
-		return mb.allErrs[0]
-	}
-
-	errMsgs := make([]string, 0, numErrors)
-	for _, err := range mb.allErrs {
-		errMsgs = append(errMsgs, err.Error())
-	}
-	return fmt.Errorf("[%s]", strings.Join(errMsgs, "; "))
+	ee := newExportError(SignalMetrics, mb.allErrs)
+	ee.Dropped = mb.droppedTimeSeries
+	return ee
 }
 
 // sendReqToChan grabs all the timeseies in this metricsBatcher, puts them
@@ -136,9 +142,60 @@ func (mb *metricsBatcher) sendReqToChan() {
 // regex to extract min-max ranges from error response strings in the format "timeSeries[(min-max,...)] ..." (max is optional)
 var timeSeriesErrRegex = regexp.MustCompile(`: timeSeries\[([0-9]+(?:-[0-9]+)?(?:,[0-9]+(?:-[0-9]+)?)*)\]`)
 
-// sendReq sends create time series requests to Stackdriver,
-// and returns the count of dropped time series and error.
-func sendReq(ctx context.Context, c *monitoring.MetricClient, req *monitoringpb.CreateTimeSeriesRequest) (int, []error) {
+const partialFailurePrefix = "One or more TimeSeries could not be written:"
+
+// RejectedTimeSeries describes a time series that Stackdriver Monitoring
+// refused to write.
+type RejectedTimeSeries struct {
+	// MetricType is the metric type of the rejected time series.
+	MetricType string
+
+	// Labels are the metric labels of the rejected time series.
+	Labels map[string]string
+
+	// Reason is the explanation given by Stackdriver Monitoring.
+	Reason string
+}
+
+// TimeSeriesError is reported when Stackdriver Monitoring rejects some or
+// all of the time series of a CreateTimeSeries request.
+type TimeSeriesError struct {
+	// Rejected lists the time series that were not written.
+	Rejected []RejectedTimeSeries
+
+	// Err is the last error returned by Stackdriver Monitoring.
+	Err error
+}
+
+func (e *TimeSeriesError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the error returned by Stackdriver Monitoring.
+func (e *TimeSeriesError) Unwrap() error {
+	return e.Err
+}
+
+// GRPCStatus returns the status of the error returned by Stackdriver
+// Monitoring, so that status.Code can be used on a TimeSeriesError.
+func (e *TimeSeriesError) GRPCStatus() *status.Status {
+	return status.Convert(e.Err)
+}
+
+// newTimeSeriesError returns a *TimeSeriesError for the time series of req
+// that were rejected with err.
+func newTimeSeriesError(req *monitoringpb.CreateTimeSeriesRequest, err error) *TimeSeriesError {
+	rejected, _, ok := splitRejectedTimeSeries(req, err)
+	if !ok {
+		rejected = rejectTimeSeries(req.TimeSeries, status.Convert(err).Message())
+	}
+	return &TimeSeriesError{Rejected: rejected, Err: err}
+}
+
+// sendReq sends create time series requests to Stackdriver, retrying them
+// according to retry, and returns the count of dropped time series and error.
+// Each attempt is bounded by timeout.
+func sendReq(ctx context.Context, c *monitoring.MetricClient, req *monitoringpb.CreateTimeSeriesRequest, retry *RetryPolicy, timeout time.Duration, sm *selfMetrics) (int, []error) {
 	// c == nil only happens in unit tests where we don't make real calls to Stackdriver server
 	if c == nil {
 		return 0, nil
@@ -148,51 +205,160 @@ func sendReq(ctx context.Context, c *monitoring.MetricClient, req *monitoringpb.
 	errors := []error{}
 	serviceReq, nonServiceReq := splitCreateTimeSeriesRequest(req)
 	if nonServiceReq != nil {
-		err := createTimeSeries(ctx, c, nonServiceReq)
+		create := sm.timeCreateTimeSeries(methodCreateTimeSeries, createTimeSeries)
+		n, err := sendTimeSeries(ctx, c, create, nonServiceReq, retry, timeout)
 		if err != nil {
-			dropped += droppedTimeSeriesFromMonitoringAPIError(nonServiceReq, err)
+			dropped += n
 			errors = append(errors, err)
 		}
 	}
 	if serviceReq != nil {
-		err := createServiceTimeSeries(ctx, c, serviceReq)
+		create := sm.timeCreateTimeSeries(methodCreateServiceTimeSeries, createServiceTimeSeries)
+		n, err := sendTimeSeries(ctx, c, create, serviceReq, retry, timeout)
 		if err != nil {
-			dropped += droppedTimeSeriesFromMonitoringAPIError(serviceReq, err)
+			dropped += n
 			errors = append(errors, err)
 		}
 	}
 	return dropped, errors
 }
 
-func droppedTimeSeriesFromMonitoringAPIError(req *monitoringpb.CreateTimeSeriesRequest, monitoringAPIerr error) int {
-	droppedTimeSeriesRangeMatches := timeSeriesErrRegex.FindAllStringSubmatch(monitoringAPIerr.Error(), -1)
-	if !strings.HasPrefix(monitoringAPIerr.Error(), "One or more TimeSeries could not be written:") || len(droppedTimeSeriesRangeMatches) == 0 {
-		return len(req.TimeSeries)
+// sendTimeSeries sends req with create, retrying it according to retry. If
+// retry.ResubmitUnaffected is set, time series rejected by a retryable error
+// are removed from the request before it is retried.
+//
+// It returns the number of time series that were not written and, if any,
+// a *TimeSeriesError describing them.
+func sendTimeSeries(
+	ctx context.Context,
+	c *monitoring.MetricClient,
+	create func(context.Context, *monitoring.MetricClient, *monitoringpb.CreateTimeSeriesRequest) error,
+	req *monitoringpb.CreateTimeSeriesRequest,
+	retry *RetryPolicy,
+	timeout time.Duration,
+) (int, error) {
+	var rejected []RejectedTimeSeries
+	// lastErr is the last error whose rejected time series were already
+	// removed from req.
+	var lastErr error
+	err := retry.invoke(ctx, timeout, func(ctx context.Context) error {
+		err := create(ctx, c, req)
+		if err == nil || retry == nil || !retry.ResubmitUnaffected || !retry.retryable(err) {
+			return err
+		}
+		r, unaffected, ok := splitRejectedTimeSeries(req, err)
+		if !ok {
+			return err
+		}
+		lastErr = err
+		rejected = append(rejected, r...)
+		req = &monitoringpb.CreateTimeSeriesRequest{Name: req.Name, TimeSeries: unaffected}
+		if len(unaffected) == 0 {
+			// Nothing is left to resubmit.
+			return nil
+		}
+		return err
+	})
+
+	if err != nil {
+		r, _, ok := splitRejectedTimeSeries(req, err)
+		if err == lastErr || !ok {
+			// None of the remaining time series were written.
+			r = rejectTimeSeries(req.TimeSeries, status.Convert(err).Message())
+		}
+		rejected = append(rejected, r...)
+		lastErr = err
 	}
+	if len(rejected) == 0 {
+		return 0, nil
+	}
+	return len(rejected), &TimeSeriesError{Rejected: rejected, Err: lastErr}
+}
 
-	dropped := 0
-	for _, submatches := range droppedTimeSeriesRangeMatches {
-		for i := 1; i < len(submatches); i++ {
-			for _, rng := range strings.Split(submatches[i], ",") {
-				rngSlice := strings.Split(rng, "-")
-
-				// strconv errors not possible due to regex above
-				min, _ := strconv.Atoi(rngSlice[0])
-				max := min
-				if len(rngSlice) > 1 {
-					max, _ = strconv.Atoi(rngSlice[1])
-				}
-
-				dropped += max - min + 1
+// splitRejectedTimeSeries uses the indices reported in a partial failure
+// error to split the time series of req into the rejected and the unaffected
+// ones. It returns false if err does not identify the rejected time series.
+func splitRejectedTimeSeries(req *monitoringpb.CreateTimeSeriesRequest, monitoringAPIerr error) ([]RejectedTimeSeries, []*monitoringpb.TimeSeries, bool) {
+	reasons, ok := rejectionReasonsFromMonitoringAPIError(monitoringAPIerr, len(req.TimeSeries))
+	if !ok {
+		return nil, nil, false
+	}
+
+	var rejected []RejectedTimeSeries
+	var unaffected []*monitoringpb.TimeSeries
+	for i, ts := range req.TimeSeries {
+		if reason, ok := reasons[i]; ok {
+			rejected = append(rejected, rejectTimeSeries([]*monitoringpb.TimeSeries{ts}, reason)...)
+		} else {
+			unaffected = append(unaffected, ts)
+		}
+	}
+	return rejected, unaffected, true
+}
+
+func rejectTimeSeries(tsl []*monitoringpb.TimeSeries, reason string) []RejectedTimeSeries {
+	rejected := make([]RejectedTimeSeries, 0, len(tsl))
+	for _, ts := range tsl {
+		rejected = append(rejected, RejectedTimeSeries{
+			MetricType: ts.GetMetric().GetType(),
+			Labels:     ts.GetMetric().GetLabels(),
+			Reason:     reason,
+		})
+	}
+	return rejected
+}
+
+// rejectionReasonsFromMonitoringAPIError parses errors in the format
+//
+//	One or more TimeSeries could not be written: <reason>: timeSeries[0-16,25]; <reason>: timeSeries[45]
+//
+// and returns the reason for each rejected time series index. Indices
+// outside of the n time series of the request are ignored.
+func rejectionReasonsFromMonitoringAPIError(monitoringAPIerr error, n int) (map[int]string, bool) {
+	msg := status.Convert(monitoringAPIerr).Message()
+	if !strings.HasPrefix(msg, partialFailurePrefix) {
+		return nil, false
+	}
+	matches := timeSeriesErrRegex.FindAllStringSubmatchIndex(msg, -1)
+	if len(matches) == 0 {
+		return nil, false
+	}
+
+	reasons := make(map[int]string)
+	prevEnd := len(partialFailurePrefix)
+	for _, m := range matches {
+		reason := strings.Trim(msg[prevEnd:m[0]], "; ")
+		prevEnd = m[1]
+		for _, rng := range strings.Split(msg[m[2]:m[3]], ",") {
+			rngSlice := strings.Split(rng, "-")
+
+			// The regex above only matches digits; out of range values
+			// are parsed as the maximum int, and clamped below.
+			min, _ := strconv.Atoi(rngSlice[0])
+			max := min
+			if len(rngSlice) > 1 {
+				max, _ = strconv.Atoi(rngSlice[1])
+			}
+			if max >= n {
+				max = n - 1
+			}
+			if min < 0 {
+				min = 0
+			}
+
+			for i := min; i <= max; i++ {
+				reasons[i] = reason
 			}
 		}
 	}
-	return dropped
+	return reasons, true
 }
 
 type worker struct {
 	ctx     context.Context
 	timeout time.Duration
+	retry   *RetryPolicy
+	sm      *selfMetrics
 	mc      *monitoring.MetricClient
 
 	resp *response
@@ -210,9 +376,14 @@ func newWorker(
 	respsChan chan *response,
 	wg *sync.WaitGroup,
 	timeout time.Duration,
+	retry *RetryPolicy,
+	sm *selfMetrics,
 ) *worker {
 	return &worker{
 		ctx:       ctx,
+		timeout:   timeout,
+		retry:     retry,
+		sm:        sm,
 		mc:        mc,
 		resp:      &response{},
 		reqsChan:  reqsChan,
@@ -230,10 +401,11 @@ func (w *worker) start() {
 }
 
 func (w *worker) sendReqWithTimeout(req *monitoringpb.CreateTimeSeriesRequest) {
-	ctx, cancel := newContextWithTimeout(w.ctx, w.timeout)
-	defer cancel()
-
-	w.recordDroppedTimeseries(sendReq(ctx, w.mc, req))
+	dropped, errs := sendReq(w.ctx, w.mc, req, w.retry, w.timeout, w.sm)
+	if w.mc != nil {
+		w.sm.recordTimeSeriesResult(len(req.TimeSeries), errs)
+	}
+	w.recordDroppedTimeseries(dropped, errs)
 }
 
 func (w *worker) recordDroppedTimeseries(numTimeSeries int, errors []error) {
@@ -19,13 +19,17 @@ import (
 	"errors"
 	"fmt"
 	"testing"
+	"time"
 
 	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
 	"cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	"github.com/google/go-cmp/cmp"
 	"google.golang.org/api/option"
 	googlemetricpb "google.golang.org/genproto/googleapis/api/metric"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
 func TestWorkers(t *testing.T) {
@@ -37,13 +41,13 @@ func TestWorkers(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to create metric client %v", err)
 	}
-	m1 := newMetricsBatcher(ctx, "test", 1, c1, defaultTimeout) // batcher with 1 worker
+	m1 := newMetricsBatcher(ctx, "test", 1, c1, defaultTimeout, nil, nil) // batcher with 1 worker
 
 	c2, err := makeClient(addr)
 	if err != nil {
 		t.Fatalf("Failed to create metric client %v", err)
 	}
-	m2 := newMetricsBatcher(ctx, "test", 2, c2, defaultTimeout) // batcher with 2 workers
+	m2 := newMetricsBatcher(ctx, "test", 2, c2, defaultTimeout, nil, nil) // batcher with 2 workers
 
 	tss := makeTs(500, false) // make 500 time series, should be split to 3 reqs
 
@@ -200,7 +204,7 @@ func TestSendReqAndParseDropped(t *testing.T) {
 			var tsl []*monitoringpb.TimeSeries
 			tsl = append(tsl, makeTs(test.serviceTimeSeriesCount, true)...)
 			tsl = append(tsl, makeTs(test.nonServiceTimeSeriesCount, false)...)
-			d, errors := sendReq(context.Background(), mc, &monitoringpb.CreateTimeSeriesRequest{TimeSeries: tsl})
+			d, errors := sendReq(context.Background(), mc, &monitoringpb.CreateTimeSeriesRequest{TimeSeries: tsl}, nil, defaultTimeout, nil)
 			if !test.expectedErr && len(errors) > 0 {
 				t.Fatalf("Expected no errors, got %v", errors)
 			}
@@ -213,3 +217,87 @@ func TestSendReqAndParseDropped(t *testing.T) {
 		})
 	}
 }
+
+func TestSendReqReportsRejectedTimeSeries(t *testing.T) {
+	persistedCreateTimeSeries := createTimeSeries
+	defer func() {
+		createTimeSeries = persistedCreateTimeSeries
+	}()
+	createTimeSeries = func(ctx context.Context, c *monitoring.MetricClient, ts *monitoringpb.CreateTimeSeriesRequest) error {
+		return status.Error(codes.InvalidArgument, "One or more TimeSeries could not be written: Points must be written in order.: timeSeries[1-2]; Unknown metric: custom.googleapis.com/opencensus/test/metric/4: timeSeries[4]")
+	}
+
+	mc, _ := monitoring.NewMetricClient(context.Background())
+	tsl := makeTs(5, false)
+	dropped, errs := sendReq(context.Background(), mc, &monitoringpb.CreateTimeSeriesRequest{TimeSeries: tsl}, nil, defaultTimeout, nil)
+	if dropped != 3 {
+		t.Errorf("Want 3 dropped, got %v", dropped)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("Want 1 error, got %v", errs)
+	}
+	var tsErr *TimeSeriesError
+	if !errors.As(errs[0], &tsErr) {
+		t.Fatalf("Want *TimeSeriesError, got %T", errs[0])
+	}
+	if got := status.Code(tsErr); got != codes.InvalidArgument {
+		t.Errorf("status.Code() = %v; want %v", got, codes.InvalidArgument)
+	}
+	want := []RejectedTimeSeries{
+		{MetricType: tsl[1].Metric.Type, Labels: tsl[1].Metric.Labels, Reason: "Points must be written in order."},
+		{MetricType: tsl[2].Metric.Type, Labels: tsl[2].Metric.Labels, Reason: "Points must be written in order."},
+		{MetricType: tsl[4].Metric.Type, Labels: tsl[4].Metric.Labels, Reason: "Unknown metric: custom.googleapis.com/opencensus/test/metric/4"},
+	}
+	if diff := cmp.Diff(tsErr.Rejected, want); diff != "" {
+		t.Errorf("Unexpected rejected time series -got +want: %s", diff)
+	}
+}
+
+func TestSendReqResubmitsUnaffectedTimeSeries(t *testing.T) {
+	persistedCreateTimeSeries := createTimeSeries
+	defer func() {
+		createTimeSeries = persistedCreateTimeSeries
+	}()
+	var reqs []*monitoringpb.CreateTimeSeriesRequest
+	createTimeSeries = func(ctx context.Context, c *monitoring.MetricClient, ts *monitoringpb.CreateTimeSeriesRequest) error {
+		reqs = append(reqs, ts)
+		if len(reqs) == 1 {
+			return status.Error(codes.Unavailable, "One or more TimeSeries could not be written: Unknown metric: custom.googleapis.com/opencensus/test/metric/0: timeSeries[0]")
+		}
+		return nil
+	}
+
+	mc, _ := monitoring.NewMetricClient(context.Background())
+	p := &RetryPolicy{InitialBackoff: time.Millisecond, ResubmitUnaffected: true}
+	tsl := makeTs(3, false)
+	dropped, errs := sendReq(context.Background(), mc, &monitoringpb.CreateTimeSeriesRequest{TimeSeries: tsl}, p, defaultTimeout, nil)
+	if dropped != 1 {
+		t.Errorf("Want 1 dropped, got %v", dropped)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("Want 1 error, got %v", errs)
+	}
+	var tsErr *TimeSeriesError
+	if !errors.As(errs[0], &tsErr) || len(tsErr.Rejected) != 1 || tsErr.Rejected[0].MetricType != tsl[0].Metric.Type {
+		t.Errorf("Want a *TimeSeriesError rejecting %s, got %v", tsl[0].Metric.Type, errs[0])
+	}
+	if len(reqs) != 2 {
+		t.Fatalf("Want 2 CreateTimeSeries calls, got %d", len(reqs))
+	}
+	if diff := cmpTSReqs([]*monitoringpb.CreateTimeSeriesRequest{reqs[1]}, []*monitoringpb.CreateTimeSeriesRequest{{TimeSeries: tsl[1:]}}); diff != "" {
+		t.Errorf("Unexpected resubmitted request -got +want: %s", diff)
+	}
+}
+
+func TestRejectionReasonsOutOfRange(t *testing.T) {
+	err := status.Error(codes.InvalidArgument, partialFailurePrefix+
+		" bad value: timeSeries[1-9223372036854775806]; reversed: timeSeries[2-0]; overflow: timeSeries[99999999999999999999]")
+	reasons, ok := rejectionReasonsFromMonitoringAPIError(err, 3)
+	if !ok {
+		t.Fatal("rejectionReasonsFromMonitoringAPIError() failed")
+	}
+	want := map[int]string{1: "bad value", 2: "bad value"}
+	if diff := cmp.Diff(reasons, want); diff != "" {
+		t.Errorf("reasons: -got +want %s", diff)
+	}
+}
@@ -73,7 +73,7 @@ func (se *statsExporter) PushMetricsProto(ctx context.Context, node *commonpb.No
 	// Caches the resources seen so far
 	seenResources := make(map[*resourcepb.Resource]*monitoredrespb.MonitoredResource)
 
-	mb := newMetricsBatcher(ctx, se.o.ProjectID, se.o.NumberOfWorkers, se.c, se.o.Timeout)
+	mb := newMetricsBatcher(ctx, se.o.ProjectID, se.o.NumberOfWorkers, se.c, se.o.Timeout, se.o.RetryPolicy, se.sm)
 	for _, metric := range metrics {
 		if len(metric.GetTimeseries()) == 0 {
 			// No TimeSeries to export, skip this metric.
@@ -84,14 +84,16 @@ func (se *statsExporter) PushMetricsProto(ctx context.Context, node *commonpb.No
 			summaryMtcs := se.convertSummaryMetrics(metric)
 			for _, summaryMtc := range summaryMtcs {
 				if err := se.createMetricDescriptorFromMetricProto(ctx, summaryMtc); err != nil {
-					mb.recordDroppedTimeseries(len(summaryMtc.GetTimeseries()), err)
+					n := len(summaryMtc.GetTimeseries())
+					mb.recordDroppedTimeseries(n, metricError(SignalMetricDescriptor, se.metricTypeFromProto(summaryMtc.GetMetricDescriptor().GetName()), n, err))
 					continue
 				}
 				se.protoMetricToTimeSeries(ctx, mappedRsc, summaryMtc, mb)
 			}
 		} else {
 			if err := se.createMetricDescriptorFromMetricProto(ctx, metric); err != nil {
-				mb.recordDroppedTimeseries(len(metric.GetTimeseries()), err)
+				n := len(metric.GetTimeseries())
+				mb.recordDroppedTimeseries(n, metricError(SignalMetricDescriptor, se.metricTypeFromProto(metric.GetMetricDescriptor().GetName()), n, err))
 				continue
 			}
 			se.protoMetricToTimeSeries(ctx, mappedRsc, metric, mb)
@@ -172,7 +174,7 @@ func (se *statsExporter) convertSummaryMetrics(summary *metricspb.Metric) []*met
 		if len(sumTss) > 0 {
 			metric := &metricspb.Metric{
 				MetricDescriptor: &metricspb.MetricDescriptor{
-					Name:        fmt.Sprintf("%s_summary_sum", summary.GetMetricDescriptor().GetName()),
+					Name:        se.summaryMetricName(summary.GetMetricDescriptor().GetName(), SummarySum),
 					Description: summary.GetMetricDescriptor().GetDescription(),
 					Type:        metricspb.MetricDescriptor_CUMULATIVE_DOUBLE,
 					Unit:        summary.GetMetricDescriptor().GetUnit(),
@@ -186,7 +188,7 @@ func (se *statsExporter) convertSummaryMetrics(summary *metricspb.Metric) []*met
 		if len(countTss) > 0 {
 			metric := &metricspb.Metric{
 				MetricDescriptor: &metricspb.MetricDescriptor{
-					Name:        fmt.Sprintf("%s_summary_count", summary.GetMetricDescriptor().GetName()),
+					Name:        se.summaryMetricName(summary.GetMetricDescriptor().GetName(), SummaryCount),
 					Description: summary.GetMetricDescriptor().GetDescription(),
 					Type:        metricspb.MetricDescriptor_CUMULATIVE_INT64,
 					Unit:        "1",
@@ -202,7 +204,7 @@ func (se *statsExporter) convertSummaryMetrics(summary *metricspb.Metric) []*met
 			lks = append(lks, percentileLabelKey)
 			metric := &metricspb.Metric{
 				MetricDescriptor: &metricspb.MetricDescriptor{
-					Name:        fmt.Sprintf("%s_summary_percentile", summary.GetMetricDescriptor().GetName()),
+					Name:        se.summaryMetricName(summary.GetMetricDescriptor().GetName(), SummaryPercentile),
 					Description: summary.GetMetricDescriptor().GetDescription(),
 					Type:        metricspb.MetricDescriptor_GAUGE_DOUBLE,
 					Unit:        summary.GetMetricDescriptor().GetUnit(),
@@ -249,7 +251,8 @@ func resourcepbToResource(rsc *resourcepb.Resource) *resource.Resource {
 // but it doesn't invoke any remote API.
 func (se *statsExporter) protoMetricToTimeSeries(ctx context.Context, mappedRsc *monitoredrespb.MonitoredResource, metric *metricspb.Metric, mb *metricsBatcher) {
 	if metric == nil || metric.MetricDescriptor == nil {
-		mb.recordDroppedTimeseries(len(metric.GetTimeseries()), errNilMetricOrMetricDescriptor)
+		n := len(metric.GetTimeseries())
+		mb.recordDroppedTimeseries(n, metricError(SignalMetrics, "", n, errNilMetricOrMetricDescriptor))
 	}
 
 	metricType := se.metricTypeFromProto(metric.GetMetricDescriptor().GetName())
@@ -268,7 +271,7 @@ func (se *statsExporter) protoMetricToTimeSeries(ctx context.Context, mappedRsc
 
 		sdPoints, err := se.protoTimeSeriesToMonitoringPoints(protoTimeSeries, metricKind)
 		if err != nil {
-			mb.recordDroppedTimeseries(1, err)
+			mb.recordDroppedTimeseries(1, metricError(SignalMetrics, metricType, 1, err))
 			continue
 		}
 
@@ -276,10 +279,10 @@ func (se *statsExporter) protoMetricToTimeSeries(ctx context.Context, mappedRsc
 		// with that from the MetricDescriptor
 		labels, err := labelsPerTimeSeries(se.defaultLabels, labelKeys, protoTimeSeries.GetLabelValues())
 		if err != nil {
-			mb.recordDroppedTimeseries(1, err)
+			mb.recordDroppedTimeseries(1, metricError(SignalMetrics, metricType, 1, err))
 			continue
 		}
-		mb.addTimeSeries(&monitoringpb.TimeSeries{
+		ts := &monitoringpb.TimeSeries{
 			Metric: &googlemetricpb.Metric{
 				Type:   metricType,
 				Labels: labels,
@@ -288,7 +291,15 @@ func (se *statsExporter) protoMetricToTimeSeries(ctx context.Context, mappedRsc
 			ValueType:  valueType,
 			Resource:   mappedRsc,
 			Points:     sdPoints,
-		})
+		}
+		se.compactDistributions(ts)
+		se.setDistributionRanges(ts)
+		if se.cumulative.adjust(metric.GetMetricDescriptor().GetName(), ts) > 0 && len(ts.Points) == 0 {
+			se.sm.timeSeriesDroppedAdd(1, dropReasonOutOfOrder)
+			mb.addResponse(1, []error{metricError(SignalMetrics, metricType, 1, errPointsOutOfOrder)})
+			continue
+		}
+		mb.addTimeSeries(ts)
 	}
 }
 
@@ -325,9 +336,6 @@ func (se *statsExporter) createMetricDescriptorFromMetricProto(ctx context.Conte
 		return nil
 	}
 
-	ctx, cancel := newContextWithTimeout(ctx, se.o.Timeout)
-	defer cancel()
-
 	se.protoMu.Lock()
 	defer se.protoMu.Unlock()
 
@@ -348,7 +356,7 @@ func (se *statsExporter) createMetricDescriptorFromMetricProto(ctx context.Conte
 		return err
 	}
 
-	if err = se.createMetricDescriptor(ctx, inMD); err != nil {
+	if err = se.reconcileMetricDescriptor(ctx, inMD); err != nil {
 		return err
 	}
 
@@ -0,0 +1,211 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/api/support/bundler"
+)
+
+// OverflowPolicy selects what happens to the spans, view data and metrics
+// exported while the buffer of their bundler is full.
+type OverflowPolicy int
+
+const (
+	// OverflowDropNewest drops the data being exported. It is the default.
+	OverflowDropNewest OverflowPolicy = iota
+
+	// OverflowDropOldest accepts the data being exported, and drops the
+	// oldest data waiting for room in the buffer instead. The data waiting
+	// for room is limited to the BufferedByteLimit of the bundler, so up to
+	// twice that limit can be held in memory.
+	OverflowDropOldest
+
+	// OverflowBlock blocks the export calls until there is room in the
+	// buffer, or until Options.OverflowBlockTimeout elapses or the context
+	// passed to ExportMetrics is done, in which case the data being
+	// exported is dropped.
+	OverflowBlock
+)
+
+const defaultOverflowBlockTimeout = 10 * time.Second
+
+// overflowBundler adds items to a bundler according to an overflow policy.
+type overflowBundler struct {
+	b       *bundler.Bundler
+	policy  OverflowPolicy
+	timeout time.Duration
+	// waiting holds the items waiting for room in b, with OverflowDropOldest.
+	waiting *waitingQueue
+}
+
+// newOverflowBundler returns an overflowBundler adding items to b according
+// to the overflow policy of o. evicted is called with the items dropped by
+// OverflowDropOldest.
+func newOverflowBundler(b *bundler.Bundler, o *Options, evicted func(item interface{})) *overflowBundler {
+	ob := &overflowBundler{b: b, policy: o.OverflowPolicy, timeout: o.OverflowBlockTimeout}
+	if ob.timeout <= 0 {
+		ob.timeout = defaultOverflowBlockTimeout
+	}
+	if ob.policy == OverflowDropOldest {
+		ob.waiting = newWaitingQueue(b, evicted)
+	}
+	return ob
+}
+
+// add adds item of the given size. It returns bundler.ErrOverflow if the
+// item is dropped because the buffer is full, and bundler.ErrOversizedItem
+// if the item is bigger than a bundle. With OverflowBlock, it stops waiting
+// for room in the buffer when ctx is done.
+func (ob *overflowBundler) add(ctx context.Context, item interface{}, size int) error {
+	if ob.policy == OverflowDropNewest {
+		return ob.b.Add(item, size)
+	}
+	if ob.b.BundleByteLimit > 0 && size > ob.b.BundleByteLimit {
+		return bundler.ErrOversizedItem
+	}
+	if size > ob.b.BufferedByteLimit {
+		// The bundler would never have room for the item.
+		return bundler.ErrOverflow
+	}
+	if ob.policy == OverflowDropOldest {
+		ob.waiting.push(item, size)
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, ob.timeout)
+	defer cancel()
+	err := ob.b.AddWait(ctx, item, size)
+	if err != nil && err == ctx.Err() {
+		return bundler.ErrOverflow
+	}
+	return err
+}
+
+// flush waits for the added items to be handled.
+func (ob *overflowBundler) flush() {
+	if ob.waiting != nil {
+		ob.waiting.drain()
+	}
+	ob.b.Flush()
+}
+
+// close stops adding the waiting items to the bundler. The items still
+// waiting, if flush was not called, are lost.
+func (ob *overflowBundler) close() {
+	if ob.waiting != nil {
+		ob.waiting.close()
+	}
+}
+
+type waitingItem struct {
+	item interface{}
+	size int
+}
+
+// waitingQueue holds items until there is room for them in a bundler. When
+// the size of its items exceeds the BufferedByteLimit of the bundler, the
+// oldest ones are evicted.
+type waitingQueue struct {
+	b       *bundler.Bundler
+	evicted func(item interface{})
+	// ctx is cancelled by close, to stop waiting for room in b.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu    sync.Mutex
+	cond  *sync.Cond
+	items []waitingItem
+	size  int
+	// adding is true while an item is being added to the bundler.
+	adding bool
+	closed bool
+}
+
+func newWaitingQueue(b *bundler.Bundler, evicted func(item interface{})) *waitingQueue {
+	q := &waitingQueue{b: b, evicted: evicted}
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	q.cond = sync.NewCond(&q.mu)
+	go q.loop()
+	return q
+}
+
+func (q *waitingQueue) push(item interface{}, size int) {
+	var evicted []interface{}
+	q.mu.Lock()
+	q.items = append(q.items, waitingItem{item, size})
+	q.size += size
+	for q.size > q.b.BufferedByteLimit && len(q.items) > 1 {
+		evicted = append(evicted, q.items[0].item)
+		q.size -= q.items[0].size
+		q.items[0] = waitingItem{}
+		q.items = q.items[1:]
+	}
+	q.cond.Broadcast()
+	q.mu.Unlock()
+
+	for _, item := range evicted {
+		q.evicted(item)
+	}
+}
+
+// loop adds the items to the bundler, blocking while it is full.
+func (q *waitingQueue) loop() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		for len(q.items) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if q.closed {
+			return
+		}
+		it := q.items[0]
+		q.items[0] = waitingItem{}
+		q.items = q.items[1:]
+		q.size -= it.size
+		q.adding = true
+		q.mu.Unlock()
+
+		// The items too big for the bundler are rejected by add, so
+		// AddWait only fails once close is called.
+		if err := q.b.AddWait(q.ctx, it.item, it.size); err != nil {
+			q.evicted(it.item)
+		}
+
+		q.mu.Lock()
+		q.adding = false
+		q.cond.Broadcast()
+	}
+}
+
+// drain waits until all the items are added to the bundler.
+func (q *waitingQueue) drain() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for (len(q.items) > 0 || q.adding) && !q.closed {
+		q.cond.Wait()
+	}
+}
+
+func (q *waitingQueue) close() {
+	q.cancel()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
@@ -0,0 +1,175 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/support/bundler"
+)
+
+// blockedBundler returns a bundler of ints with room for two of them, whose
+// handler blocks until release is closed.
+func blockedBundler() (b *bundler.Bundler, release chan struct{}, handled func() []int) {
+	var mu sync.Mutex
+	var items []int
+	release = make(chan struct{})
+	b = BundleOptions{CountThreshold: 1, BufferedByteLimit: 2, DelayThreshold: time.Millisecond}.
+		withBundlerDefaults().
+		newBundler(0, func(bundle interface{}) {
+			<-release
+			mu.Lock()
+			items = append(items, bundle.([]int)...)
+			mu.Unlock()
+		})
+	return b, release, func() []int {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]int(nil), items...)
+	}
+}
+
+func TestOverflowDropNewest(t *testing.T) {
+	b, release, handled := blockedBundler()
+	ob := newOverflowBundler(b, &Options{}, nil)
+	var dropped []int
+	for i := 1; i <= 4; i++ {
+		if err := ob.add(context.Background(), i, 1); err == bundler.ErrOverflow {
+			dropped = append(dropped, i)
+		}
+	}
+	close(release)
+	ob.flush()
+	if len(dropped) == 0 || dropped[len(dropped)-1] != 4 {
+		t.Errorf("dropped = %v; want the newest items", dropped)
+	}
+	if got := handled(); len(got)+len(dropped) != 4 {
+		t.Errorf("handled %v and dropped %v; want 4 items in total", got, dropped)
+	}
+}
+
+func TestOverflowDropOldest(t *testing.T) {
+	b, release, handled := blockedBundler()
+	var mu sync.Mutex
+	var evicted []int
+	ob := newOverflowBundler(b, &Options{OverflowPolicy: OverflowDropOldest}, func(item interface{}) {
+		mu.Lock()
+		evicted = append(evicted, item.(int))
+		mu.Unlock()
+	})
+	defer ob.close()
+	const n = 10
+	for i := 1; i <= n; i++ {
+		if err := ob.add(context.Background(), i, 1); err != nil {
+			t.Fatalf("add(%d) = %v", i, err)
+		}
+	}
+	close(release)
+	ob.flush()
+
+	got := handled()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(evicted) == 0 {
+		t.Fatal("no item evicted")
+	}
+	if len(got)+len(evicted) != n {
+		t.Errorf("handled %v and evicted %v; want %d items in total", got, evicted, n)
+	}
+	if got[len(got)-1] != n {
+		t.Errorf("handled %v; want the newest item", got)
+	}
+	for i := 1; i < len(got); i++ {
+		if got[i] <= got[i-1] {
+			t.Errorf("handled %v; want items in order", got)
+		}
+	}
+	if err := ob.add(context.Background(), 0, 3); err != bundler.ErrOverflow {
+		t.Errorf("add() of item bigger than the buffer = %v; want %v", err, bundler.ErrOverflow)
+	}
+}
+
+func TestOverflowDropOldestClose(t *testing.T) {
+	b, release, _ := blockedBundler()
+	defer close(release)
+	evicted := make(chan int, 3)
+	ob := newOverflowBundler(b, &Options{OverflowPolicy: OverflowDropOldest}, func(item interface{}) {
+		evicted <- item.(int)
+	})
+	for i := 1; i <= 3; i++ {
+		if err := ob.add(context.Background(), i, 1); err != nil {
+			t.Fatalf("add(%d) = %v", i, err)
+		}
+		// Let the item be added to the bundler before the next one.
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The bundler is full, and item 3 waits for room until close is called.
+	ob.close()
+	select {
+	case got := <-evicted:
+		if got != 3 {
+			t.Errorf("evicted %d; want 3", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("close() did not stop waiting for room in the bundler")
+	}
+}
+
+func TestOverflowBlock(t *testing.T) {
+	b, release, handled := blockedBundler()
+	ob := newOverflowBundler(b, &Options{OverflowPolicy: OverflowBlock, OverflowBlockTimeout: 20 * time.Millisecond}, nil)
+	for i := 1; i <= 2; i++ {
+		if err := ob.add(context.Background(), i, 1); err != nil {
+			t.Fatalf("add(%d) = %v", i, err)
+		}
+	}
+	start := time.Now()
+	if err := ob.add(context.Background(), 3, 1); err != bundler.ErrOverflow {
+		t.Errorf("add() with full buffer = %v; want %v", err, bundler.ErrOverflow)
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("add() returned after %v; want to block for the timeout", d)
+	}
+
+	ob.timeout = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if err := ob.add(ctx, 3, 1); err != bundler.ErrOverflow {
+		t.Errorf("add() with full buffer and done context = %v; want %v", err, bundler.ErrOverflow)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("add() returned after %v; want to stop when the context is done", d)
+	}
+
+	time.AfterFunc(10*time.Millisecond, func() { close(release) })
+	if err := ob.add(context.Background(), 4, 1); err != nil {
+		t.Errorf("add() once the buffer has room = %v", err)
+	}
+	ob.flush()
+	if got := handled(); len(got) != 3 {
+		t.Errorf("handled %v; want 3 items", got)
+	}
+}
+
+func TestValidateOverflowPolicy(t *testing.T) {
+	o := Options{OverflowPolicy: OverflowBlock + 1}
+	if err := o.validateBundleOptions(); err == nil {
+		t.Error("validateBundleOptions() = nil; want error for unknown overflow policy")
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package propagation
+
+import (
+	"net/http"
+
+	"go.opencensus.io/plugin/ochttp/propagation/tracecontext"
+	"go.opencensus.io/trace"
+	"go.opencensus.io/trace/propagation"
+)
+
+// Header identifies a header a span context can be propagated in.
+type Header int
+
+const (
+	// HeaderNone is reported when no span context was found.
+	HeaderNone Header = iota
+	// HeaderCloudTrace is the X-Cloud-Trace-Context header.
+	HeaderCloudTrace
+	// HeaderTraceContext is the W3C Trace Context traceparent header, along
+	// with its tracestate header.
+	HeaderTraceContext
+)
+
+// String returns the name of the header.
+func (h Header) String() string {
+	switch h {
+	case HeaderCloudTrace:
+		return httpHeader
+	case HeaderTraceContext:
+		return "traceparent"
+	}
+	return "none"
+}
+
+// defaultPrecedence is used when CompositeHTTPFormat.Precedence is empty.
+var defaultPrecedence = []Header{HeaderTraceContext, HeaderCloudTrace}
+
+var _ propagation.HTTPFormat = (*CompositeHTTPFormat)(nil)
+
+// CompositeHTTPFormat implements propagation.HTTPFormat to propagate traces
+// in both the X-Cloud-Trace-Context and the W3C Trace Context headers, so
+// that services using either of them take part in the same trace.
+type CompositeHTTPFormat struct {
+	// Precedence lists the headers in the order they are looked for in
+	// incoming requests. Headers that are not listed are ignored.
+	// If empty, traceparent is preferred over X-Cloud-Trace-Context.
+	Precedence []Header
+
+	cloudTrace   HTTPFormat
+	traceContext tracecontext.HTTPFormat
+}
+
+// SpanContextFromRequest extracts a span context from the first header of
+// Precedence that holds a valid one.
+func (f *CompositeHTTPFormat) SpanContextFromRequest(req *http.Request) (sc trace.SpanContext, ok bool) {
+	sc, h := f.SpanContextAndHeaderFromRequest(req)
+	return sc, h != HeaderNone
+}
+
+// SpanContextAndHeaderFromRequest is like SpanContextFromRequest, and also
+// reports the header the span context was extracted from, or HeaderNone if
+// the request holds none.
+//
+// When the span context comes from X-Cloud-Trace-Context, the tracestate
+// header is kept as long as traceparent refers to the same trace.
+func (f *CompositeHTTPFormat) SpanContextAndHeaderFromRequest(req *http.Request) (trace.SpanContext, Header) {
+	precedence := f.Precedence
+	if len(precedence) == 0 {
+		precedence = defaultPrecedence
+	}
+	for _, h := range precedence {
+		switch h {
+		case HeaderCloudTrace:
+			sc, ok := f.cloudTrace.SpanContextFromRequest(req)
+			if !ok {
+				continue
+			}
+			if w3c, ok := f.traceContext.SpanContextFromRequest(req); ok && w3c.TraceID == sc.TraceID {
+				sc.Tracestate = w3c.Tracestate
+			}
+			return sc, HeaderCloudTrace
+		case HeaderTraceContext:
+			if sc, ok := f.traceContext.SpanContextFromRequest(req); ok {
+				return sc, HeaderTraceContext
+			}
+		}
+	}
+	return trace.SpanContext{}, HeaderNone
+}
+
+// SpanContextToRequest modifies the given request to include both the
+// X-Cloud-Trace-Context and the traceparent headers, as well as the
+// tracestate header if sc has one.
+func (f *CompositeHTTPFormat) SpanContextToRequest(sc trace.SpanContext, req *http.Request) {
+	f.cloudTrace.SpanContextToRequest(sc, req)
+	f.traceContext.SpanContextToRequest(sc, req)
+}
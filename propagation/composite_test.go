@@ -0,0 +1,162 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package propagation
+
+import (
+	"net/http"
+	"testing"
+
+	"go.opencensus.io/trace"
+	"go.opencensus.io/trace/tracestate"
+)
+
+func TestCompositeHTTPFormatExtract(t *testing.T) {
+	cloudTID := [16]byte{16, 84, 69, 170, 120, 67, 188, 139, 242, 6, 177, 32, 0, 16, 0, 0}
+	w3cTID := [16]byte{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36}
+	const (
+		cloudHeader     = "105445aa7843bc8bf206b12000100000/123;o=1"
+		w3cHeader       = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+		w3cSameTrace    = "00-105445aa7843bc8bf206b12000100000-00f067aa0ba902b7-01"
+		tracestateValue = "foo=bar"
+	)
+	tests := []struct {
+		name        string
+		precedence  []Header
+		cloud, w3c  string
+		wantHeader  Header
+		wantTraceID [16]byte
+		wantState   bool
+	}{
+		{
+			name:        "default prefers traceparent",
+			cloud:       cloudHeader,
+			w3c:         w3cHeader,
+			wantHeader:  HeaderTraceContext,
+			wantTraceID: w3cTID,
+			wantState:   true,
+		},
+		{
+			name:        "cloud trace first",
+			precedence:  []Header{HeaderCloudTrace, HeaderTraceContext},
+			cloud:       cloudHeader,
+			w3c:         w3cHeader,
+			wantHeader:  HeaderCloudTrace,
+			wantTraceID: cloudTID,
+		},
+		{
+			name:        "cloud trace keeps tracestate of same trace",
+			precedence:  []Header{HeaderCloudTrace, HeaderTraceContext},
+			cloud:       cloudHeader,
+			w3c:         w3cSameTrace,
+			wantHeader:  HeaderCloudTrace,
+			wantTraceID: cloudTID,
+			wantState:   true,
+		},
+		{
+			name:        "falls back to cloud trace",
+			cloud:       cloudHeader,
+			wantHeader:  HeaderCloudTrace,
+			wantTraceID: cloudTID,
+		},
+		{
+			name:        "falls back to traceparent",
+			precedence:  []Header{HeaderCloudTrace, HeaderTraceContext},
+			cloud:       "invalid",
+			w3c:         w3cHeader,
+			wantHeader:  HeaderTraceContext,
+			wantTraceID: w3cTID,
+			wantState:   true,
+		},
+		{
+			name:       "unlisted header ignored",
+			precedence: []Header{HeaderCloudTrace},
+			w3c:        w3cHeader,
+			wantHeader: HeaderNone,
+		},
+		{
+			name:       "no header",
+			wantHeader: HeaderNone,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "http://example.com", nil)
+			if tt.cloud != "" {
+				req.Header.Set(httpHeader, tt.cloud)
+			}
+			if tt.w3c != "" {
+				req.Header.Set("traceparent", tt.w3c)
+				req.Header.Set("tracestate", tracestateValue)
+			}
+			f := &CompositeHTTPFormat{Precedence: tt.precedence}
+			sc, h := f.SpanContextAndHeaderFromRequest(req)
+			if h != tt.wantHeader {
+				t.Fatalf("header = %v; want %v", h, tt.wantHeader)
+			}
+			if _, ok := f.SpanContextFromRequest(req); ok != (tt.wantHeader != HeaderNone) {
+				t.Errorf("SpanContextFromRequest ok = %v", ok)
+			}
+			if h == HeaderNone {
+				return
+			}
+			if sc.TraceID != tt.wantTraceID {
+				t.Errorf("TraceID = %v; want %v", sc.TraceID, trace.TraceID(tt.wantTraceID))
+			}
+			if got := sc.Tracestate != nil; got != tt.wantState {
+				t.Errorf("has tracestate = %v; want %v", got, tt.wantState)
+			}
+		})
+	}
+}
+
+func TestCompositeHTTPFormatInject(t *testing.T) {
+	ts, err := tracestate.New(nil, tracestate.Entry{Key: "foo", Value: "bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := trace.SpanContext{
+		TraceID:      [16]byte{16, 84, 69, 170, 120, 67, 188, 139, 242, 6, 177, 32, 0, 16, 0, 0},
+		SpanID:       [8]byte{0, 0, 0, 0, 0, 0, 0, 123},
+		TraceOptions: 1,
+		Tracestate:   ts,
+	}
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	f := &CompositeHTTPFormat{}
+	f.SpanContextToRequest(sc, req)
+
+	if got, want := req.Header.Get(httpHeader), "105445aa7843bc8bf206b12000100000/123;o=1"; got != want {
+		t.Errorf("%s = %q; want %q", httpHeader, got, want)
+	}
+	if got, want := req.Header.Get("traceparent"), "00-105445aa7843bc8bf206b12000100000-000000000000007b-01"; got != want {
+		t.Errorf("traceparent = %q; want %q", got, want)
+	}
+	if got, want := req.Header.Get("tracestate"), "foo=bar"; got != want {
+		t.Errorf("tracestate = %q; want %q", got, want)
+	}
+
+	for _, p := range [][]Header{{HeaderCloudTrace}, {HeaderTraceContext}} {
+		f := &CompositeHTTPFormat{Precedence: p}
+		got, h := f.SpanContextAndHeaderFromRequest(req)
+		if h != p[0] {
+			t.Errorf("header = %v; want %v", h, p[0])
+		}
+		if got.TraceID != sc.TraceID || got.SpanID != sc.SpanID || got.TraceOptions != sc.TraceOptions {
+			t.Errorf("round trip through %v = %+v; want %+v", h, got, sc)
+		}
+		if got.Tracestate == nil {
+			t.Errorf("round trip through %v lost tracestate", h)
+		}
+	}
+}
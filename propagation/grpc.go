@@ -0,0 +1,158 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package propagation
+
+import (
+	"context"
+	"strings"
+
+	"go.opencensus.io/trace"
+	"go.opencensus.io/trace/propagation"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// grpcHeader is the metadata key of the X-Cloud-Trace-Context header.
+	// gRPC metadata keys are lowercase.
+	grpcHeader = `x-cloud-trace-context`
+	// grpcBinaryHeader is the metadata key used by ocgrpc.
+	grpcBinaryHeader = `grpc-trace-bin`
+)
+
+// GRPCFormat propagates traces in gRPC metadata for Google Cloud Platform
+// and Stackdriver Trace, using the x-cloud-trace-context key along with the
+// grpc-trace-bin key used by ocgrpc.
+type GRPCFormat struct{}
+
+// SpanContextFromMetadata extracts a span context from incoming metadata. The
+// x-cloud-trace-context value is preferred over the grpc-trace-bin one.
+func (f *GRPCFormat) SpanContextFromMetadata(md metadata.MD) (sc trace.SpanContext, ok bool) {
+	if v := md.Get(grpcHeader); len(v) > 0 {
+		if sc, ok := spanContextFromHeader(v[0]); ok {
+			return sc, true
+		}
+	}
+	if v := md.Get(grpcBinaryHeader); len(v) > 0 {
+		return propagation.FromBinary([]byte(v[0]))
+	}
+	return trace.SpanContext{}, false
+}
+
+// SpanContextToMetadata modifies the given metadata to include both the
+// x-cloud-trace-context and the grpc-trace-bin values for sc.
+func (f *GRPCFormat) SpanContextToMetadata(sc trace.SpanContext, md metadata.MD) {
+	md.Set(grpcHeader, spanContextToHeader(sc))
+	md.Set(grpcBinaryHeader, string(propagation.Binary(sc)))
+}
+
+// UnaryServerInterceptor returns an interceptor that starts a server span
+// for each call, as a child of the span context found in the incoming
+// metadata by GRPCFormat.
+//
+// It is meant for servers that do not use ocgrpc.ServerHandler, which only
+// reads grpc-trace-bin.
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, span := startServerSpan(ctx, info.FullMethod)
+		defer span.End()
+		resp, err := handler(ctx, req)
+		setSpanStatus(span, err)
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor is the streaming counterpart of
+// UnaryServerInterceptor.
+func StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, span := startServerSpan(ss.Context(), info.FullMethod)
+		defer span.End()
+		err := handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+		setSpanStatus(span, err)
+		return err
+	}
+}
+
+// UnaryClientInterceptor returns an interceptor that adds the span context of
+// the current span to the outgoing metadata as x-cloud-trace-context.
+//
+// grpc-trace-bin is left to ocgrpc.ClientHandler, which adds it for the
+// client span it creates.
+func UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(outgoingContext(ctx), method, req, reply, cc, opts...)
+	}
+}
+
+// StreamClientInterceptor is the streaming counterpart of
+// UnaryClientInterceptor.
+func StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(outgoingContext(ctx), desc, cc, method, opts...)
+	}
+}
+
+// startServerSpan starts the span of a call to fullMethod, named the same way
+// as the spans of ocgrpc.
+func startServerSpan(ctx context.Context, fullMethod string) (context.Context, *trace.Span) {
+	name := strings.Replace(strings.TrimPrefix(fullMethod, "/"), "/", ".", -1)
+	md, _ := metadata.FromIncomingContext(ctx)
+	var f GRPCFormat
+	if parent, ok := f.SpanContextFromMetadata(md); ok {
+		return trace.StartSpanWithRemoteParent(ctx, name, parent, trace.WithSpanKind(trace.SpanKindServer))
+	}
+	return trace.StartSpan(ctx, name, trace.WithSpanKind(trace.SpanKindServer))
+}
+
+func setSpanStatus(span *trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	if s, ok := status.FromError(err); ok {
+		span.SetStatus(trace.Status{Code: int32(s.Code()), Message: s.Message()})
+	} else {
+		span.SetStatus(trace.Status{Code: int32(codes.Internal), Message: err.Error()})
+	}
+}
+
+// outgoingContext returns ctx with the x-cloud-trace-context of its span set
+// in the outgoing metadata.
+func outgoingContext(ctx context.Context) context.Context {
+	span := trace.FromContext(ctx)
+	if span == nil {
+		return ctx
+	}
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if ok {
+		md = md.Copy()
+	} else {
+		md = metadata.MD{}
+	}
+	md.Set(grpcHeader, spanContextToHeader(span.SpanContext()))
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// serverStream overrides the context of a grpc.ServerStream.
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,172 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package propagation
+
+import (
+	"context"
+	"testing"
+
+	"go.opencensus.io/trace"
+	"go.opencensus.io/trace/propagation"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+var testSpanContext = trace.SpanContext{
+	TraceID:      [16]byte{16, 84, 69, 170, 120, 67, 188, 139, 242, 6, 177, 32, 0, 16, 0, 0},
+	SpanID:       [8]byte{0, 0, 0, 0, 0, 0, 0, 123},
+	TraceOptions: 1,
+}
+
+func TestGRPCFormat(t *testing.T) {
+	other := trace.SpanContext{TraceID: [16]byte{1}, SpanID: [8]byte{2}}
+	tests := []struct {
+		name   string
+		md     metadata.MD
+		want   trace.SpanContext
+		wantOK bool
+	}{
+		{
+			name:   "cloud trace",
+			md:     metadata.Pairs(grpcHeader, "105445aa7843bc8bf206b12000100000/123;o=1"),
+			want:   testSpanContext,
+			wantOK: true,
+		},
+		{
+			name:   "binary",
+			md:     metadata.Pairs(grpcBinaryHeader, string(propagation.Binary(testSpanContext))),
+			want:   testSpanContext,
+			wantOK: true,
+		},
+		{
+			name: "cloud trace preferred",
+			md: metadata.Pairs(
+				grpcHeader, "105445aa7843bc8bf206b12000100000/123;o=1",
+				grpcBinaryHeader, string(propagation.Binary(other))),
+			want:   testSpanContext,
+			wantOK: true,
+		},
+		{
+			name: "invalid cloud trace",
+			md: metadata.Pairs(
+				grpcHeader, "invalid",
+				grpcBinaryHeader, string(propagation.Binary(other))),
+			want:   other,
+			wantOK: true,
+		},
+		{
+			name: "none",
+			md:   metadata.MD{},
+		},
+	}
+	f := &GRPCFormat{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, ok := f.SpanContextFromMetadata(tt.md)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v; want %v", ok, tt.wantOK)
+			}
+			if sc != tt.want {
+				t.Errorf("SpanContextFromMetadata() = %+v; want %+v", sc, tt.want)
+			}
+		})
+	}
+
+	md := metadata.MD{}
+	f.SpanContextToMetadata(testSpanContext, md)
+	if got, want := md.Get(grpcHeader), "105445aa7843bc8bf206b12000100000/123;o=1"; len(got) != 1 || got[0] != want {
+		t.Errorf("%s = %q; want %q", grpcHeader, got, want)
+	}
+	if got := md.Get(grpcBinaryHeader); len(got) != 1 {
+		t.Errorf("%s = %q; want one value", grpcBinaryHeader, got)
+	} else if sc, ok := propagation.FromBinary([]byte(got[0])); !ok || sc != testSpanContext {
+		t.Errorf("%s = %+v; want %+v", grpcBinaryHeader, sc, testSpanContext)
+	}
+}
+
+func TestServerInterceptors(t *testing.T) {
+	md := metadata.Pairs(grpcHeader, "105445aa7843bc8bf206b12000100000/123;o=1")
+	ctx := metadata.NewIncomingContext(context.Background(), md)
+
+	check := func(ctx context.Context) {
+		t.Helper()
+		span := trace.FromContext(ctx)
+		if span == nil {
+			t.Fatal("no span in handler context")
+		}
+		sc := span.SpanContext()
+		if sc.TraceID != testSpanContext.TraceID {
+			t.Errorf("TraceID = %v; want %v", sc.TraceID, testSpanContext.TraceID)
+		}
+		if sc.SpanID == testSpanContext.SpanID {
+			t.Error("server span reuses the parent span ID")
+		}
+	}
+
+	_, err := UnaryServerInterceptor()(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/pkg.Service/Method"},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			check(ctx)
+			return nil, nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = StreamServerInterceptor()(nil, &serverStream{ctx: ctx}, &grpc.StreamServerInfo{FullMethod: "/pkg.Service/Stream"},
+		func(srv interface{}, ss grpc.ServerStream) error {
+			check(ss.Context())
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientInterceptors(t *testing.T) {
+	ctx, span := trace.StartSpanWithRemoteParent(context.Background(), "parent", testSpanContext)
+	defer span.End()
+	ctx = metadata.AppendToOutgoingContext(ctx, "key", "value")
+
+	check := func(ctx context.Context) {
+		t.Helper()
+		md, _ := metadata.FromOutgoingContext(ctx)
+		if got := md.Get("key"); len(got) != 1 {
+			t.Errorf("existing metadata lost: %v", md)
+		}
+		var f GRPCFormat
+		sc, ok := f.SpanContextFromMetadata(md)
+		if !ok || sc.TraceID != span.SpanContext().TraceID || sc.SpanID != span.SpanContext().SpanID {
+			t.Errorf("outgoing span context = %+v, %v; want %+v", sc, ok, span.SpanContext())
+		}
+	}
+
+	err := UnaryClientInterceptor()(ctx, "/pkg.Service/Method", nil, nil, nil,
+		func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+			check(ctx)
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = StreamClientInterceptor()(ctx, &grpc.StreamDesc{}, nil, "/pkg.Service/Stream",
+		func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			check(ctx)
+			return nil, nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -13,7 +13,9 @@
 // limitations under the License.
 
 // Package propagation implement X-Cloud-Trace-Context header propagation used
-// by Google Cloud products.
+// by Google Cloud products. CompositeHTTPFormat also propagates the W3C Trace
+// Context headers, for services that use either of them. GRPCFormat and the
+// gRPC interceptors propagate X-Cloud-Trace-Context in gRPC metadata.
 package propagation // import "contrib.go.opencensus.io/exporter/stackdriver/propagation"
 
 import (
@@ -41,7 +43,11 @@ type HTTPFormat struct{}
 
 // SpanContextFromRequest extracts a Stackdriver Trace span context from incoming requests.
 func (f *HTTPFormat) SpanContextFromRequest(req *http.Request) (sc trace.SpanContext, ok bool) {
-	h := req.Header.Get(httpHeader)
+	return spanContextFromHeader(req.Header.Get(httpHeader))
+}
+
+// spanContextFromHeader parses the value of an X-Cloud-Trace-Context header.
+func spanContextFromHeader(h string) (sc trace.SpanContext, ok bool) {
 	// See https://cloud.google.com/trace/docs/faq for the header HTTPFormat.
 	// Return if the header is empty or missing, or if the header is unreasonably
 	// large, to avoid making unnecessary copies of a large string.
@@ -88,7 +94,11 @@ func (f *HTTPFormat) SpanContextFromRequest(req *http.Request) (sc trace.SpanCon
 
 // SpanContextToRequest modifies the given request to include a Stackdriver Trace header.
 func (f *HTTPFormat) SpanContextToRequest(sc trace.SpanContext, req *http.Request) {
+	req.Header.Set(httpHeader, spanContextToHeader(sc))
+}
+
+// spanContextToHeader formats sc as the value of an X-Cloud-Trace-Context header.
+func spanContextToHeader(sc trace.SpanContext) string {
 	sid := binary.BigEndian.Uint64(sc.SpanID[:])
-	header := fmt.Sprintf("%s/%d;o=%d", hex.EncodeToString(sc.TraceID[:]), sid, int64(sc.TraceOptions))
-	req.Header.Set(httpHeader, header)
+	return fmt.Sprintf("%s/%d;o=%d", hex.EncodeToString(sc.TraceID[:]), sid, int64(sc.TraceOptions))
 }
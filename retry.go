@@ -0,0 +1,160 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultRetryMaxAttempts    = 5
+	defaultRetryInitialBackoff = 500 * time.Millisecond
+	defaultRetryMaxBackoff     = 30 * time.Second
+	defaultRetryMultiplier     = 2.0
+)
+
+var defaultRetryableCodes = []codes.Code{codes.Unavailable, codes.DeadlineExceeded}
+
+// RetryPolicy configures how failed calls to the Stackdriver Monitoring
+// and Trace APIs are retried.
+//
+// Retries are spaced by an exponentially growing backoff. Each attempt is
+// bounded by Options.Timeout, so the total time spent on a call may exceed it.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts for a single call,
+	// including the first one. If unset, a default of 5 is used.
+	MaxAttempts int
+
+	// InitialBackoff is the delay before the first retry.
+	// If unset, a default of 500ms is used.
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the delay between two attempts.
+	// If unset, a default of 30s is used.
+	MaxBackoff time.Duration
+
+	// Multiplier is the factor by which the backoff grows after each retry.
+	// If unset, a default of 2 is used.
+	Multiplier float64
+
+	// Jitter is the fraction of each backoff, between 0 and 1, that is
+	// randomized in order to spread retries from multiple processes.
+	// If unset, backoffs are not randomized.
+	Jitter float64
+
+	// RetryableCodes lists the gRPC status codes that cause a call to be
+	// retried. If unset, Unavailable and DeadlineExceeded are retried.
+	RetryableCodes []codes.Code
+
+	// ResubmitUnaffected controls what is retried when a CreateTimeSeries
+	// request sent by PushMetricsProto fails with a retryable code and the
+	// error identifies the time series that were rejected. If set, only the
+	// time series that were not rejected are sent again, and the rejected ones
+	// are reported through a *TimeSeriesError.
+	ResubmitUnaffected bool
+}
+
+// invoke calls fn until it succeeds, fails with a non-retryable error, the
+// attempts are exhausted or ctx is done, and returns the last error.
+// Each attempt is given its own context bounded by timeout.
+//
+// A nil RetryPolicy calls fn exactly once.
+func (p *RetryPolicy) invoke(ctx context.Context, timeout time.Duration, fn func(ctx context.Context) error) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	for attempt := 1; ; attempt++ {
+		actx, cancel := newContextWithTimeout(ctx, timeout)
+		err := fn(actx)
+		cancel()
+		if err == nil || attempt >= p.maxAttempts() || !p.retryable(err) {
+			return err
+		}
+
+		t := time.NewTimer(p.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+	}
+}
+
+func (p *RetryPolicy) maxAttempts() int {
+	if p == nil {
+		return 1
+	}
+	if p.MaxAttempts <= 0 {
+		return defaultRetryMaxAttempts
+	}
+	return p.MaxAttempts
+}
+
+// retryable reports whether err carries one of the retryable status codes.
+// A nil RetryPolicy uses the default codes.
+func (p *RetryPolicy) retryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	var retryableCodes []codes.Code
+	if p != nil {
+		retryableCodes = p.RetryableCodes
+	}
+	if len(retryableCodes) == 0 {
+		retryableCodes = defaultRetryableCodes
+	}
+	code := status.Code(err)
+	for _, c := range retryableCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the delay to wait after the given (1-based) failed attempt.
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	initial, max, multiplier := p.InitialBackoff, p.MaxBackoff, p.Multiplier
+	if initial <= 0 {
+		initial = defaultRetryInitialBackoff
+	}
+	if max <= 0 {
+		max = defaultRetryMaxBackoff
+	}
+	if multiplier < 1 {
+		multiplier = defaultRetryMultiplier
+	}
+
+	d := float64(initial)
+	for i := 1; i < attempt && d < float64(max); i++ {
+		d *= multiplier
+	}
+	if d > float64(max) {
+		d = float64(max)
+	}
+	if jitter := p.Jitter; jitter > 0 {
+		if jitter > 1 {
+			jitter = 1
+		}
+		d -= d * jitter * rand.Float64()
+	}
+	return time.Duration(d)
+}
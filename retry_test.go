@@ -0,0 +1,178 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+	"cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRetryPolicyInvoke(t *testing.T) {
+	fastPolicy := &RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+	}
+	testCases := []struct {
+		name         string
+		policy       *RetryPolicy
+		errs         []error
+		wantAttempts int
+		wantErr      bool
+	}{
+		{
+			name:         "nil policy does not retry",
+			policy:       nil,
+			errs:         []error{status.Error(codes.Unavailable, "unavailable"), nil},
+			wantAttempts: 1,
+			wantErr:      true,
+		},
+		{
+			name:         "retries retryable codes until success",
+			policy:       fastPolicy,
+			errs:         []error{status.Error(codes.Unavailable, "unavailable"), status.Error(codes.DeadlineExceeded, "deadline"), nil},
+			wantAttempts: 3,
+			wantErr:      false,
+		},
+		{
+			name:         "stops after max attempts",
+			policy:       fastPolicy,
+			errs:         []error{status.Error(codes.Unavailable, "1"), status.Error(codes.Unavailable, "2"), status.Error(codes.Unavailable, "3"), nil},
+			wantAttempts: 3,
+			wantErr:      true,
+		},
+		{
+			name:         "does not retry non-retryable codes",
+			policy:       fastPolicy,
+			errs:         []error{status.Error(codes.InvalidArgument, "invalid"), nil},
+			wantAttempts: 1,
+			wantErr:      true,
+		},
+		{
+			name:         "does not retry errors without status",
+			policy:       fastPolicy,
+			errs:         []error{errors.New("err1"), nil},
+			wantAttempts: 1,
+			wantErr:      true,
+		},
+		{
+			name: "custom retryable codes",
+			policy: &RetryPolicy{
+				InitialBackoff: time.Millisecond,
+				RetryableCodes: []codes.Code{codes.ResourceExhausted},
+			},
+			errs:         []error{status.Error(codes.ResourceExhausted, "quota"), nil},
+			wantAttempts: 2,
+			wantErr:      false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			attempts := 0
+			err := tc.policy.invoke(context.Background(), time.Second, func(ctx context.Context) error {
+				err := tc.errs[attempts]
+				attempts++
+				return err
+			})
+			if attempts != tc.wantAttempts {
+				t.Errorf("attempts = %d; want %d", attempts, tc.wantAttempts)
+			}
+			if (err != nil) != tc.wantErr {
+				t.Errorf("err = %v; wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyInvoke_ContextDone(t *testing.T) {
+	p := &RetryPolicy{InitialBackoff: time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	attempts := 0
+	err := p.invoke(ctx, time.Second, func(ctx context.Context) error {
+		attempts++
+		return status.Error(codes.Unavailable, "unavailable")
+	})
+	if err == nil {
+		t.Fatal("want error, got nil")
+	}
+	if attempts != 1 {
+		t.Errorf("attempts = %d; want 1", attempts)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := &RetryPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Multiplier:     3,
+	}
+	for attempt, want := range map[int]time.Duration{
+		1: 100 * time.Millisecond,
+		2: 300 * time.Millisecond,
+		3: 900 * time.Millisecond,
+		4: time.Second,
+		9: time.Second,
+	} {
+		if got := p.backoff(attempt); got != want {
+			t.Errorf("backoff(%d) = %v; want %v", attempt, got, want)
+		}
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := p.backoff(1); got < 50*time.Millisecond || got > 100*time.Millisecond {
+			t.Fatalf("backoff(1) with jitter = %v; want within [50ms, 100ms]", got)
+		}
+	}
+}
+
+func TestSendReqRetries(t *testing.T) {
+	persistedCreateTimeSeries := createTimeSeries
+	defer func() {
+		createTimeSeries = persistedCreateTimeSeries
+	}()
+	attempts := 0
+	createTimeSeries = func(ctx context.Context, c *monitoring.MetricClient, ts *monitoringpb.CreateTimeSeriesRequest) error {
+		attempts++
+		if attempts < 3 {
+			return status.Error(codes.Unavailable, "unavailable")
+		}
+		return nil
+	}
+
+	mc, _ := monitoring.NewMetricClient(context.Background())
+	p := &RetryPolicy{InitialBackoff: time.Millisecond}
+	req := &monitoringpb.CreateTimeSeriesRequest{TimeSeries: makeTs(10, false)}
+	dropped, errs := sendReq(context.Background(), mc, req, p, defaultTimeout, nil)
+	if len(errs) != 0 {
+		t.Fatalf("Expected no errors, got %v", errs)
+	}
+	if dropped != 0 {
+		t.Errorf("Want 0 dropped, got %v", dropped)
+	}
+	if attempts != 3 {
+		t.Errorf("attempts = %d; want 3", attempts)
+	}
+}
@@ -0,0 +1,376 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+	"cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	"go.opencensus.io/metric"
+	"go.opencensus.io/metric/metricdata"
+	"go.opencensus.io/metric/metricproducer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Names of the metrics describing the exporter itself.
+const (
+	selfMetricsPrefix = "opencensus.io/exporter/stackdriver/"
+
+	selfMetricSpansExported      = selfMetricsPrefix + "spans_exported"
+	selfMetricSpansDropped       = selfMetricsPrefix + "spans_dropped"
+	selfMetricSpansOverflowed    = selfMetricsPrefix + "spans_overflowed"
+	selfMetricTimeSeriesSent     = selfMetricsPrefix + "time_series_sent"
+	selfMetricTimeSeriesDropped  = selfMetricsPrefix + "time_series_dropped"
+	selfMetricDescriptorsCreated = selfMetricsPrefix + "metric_descriptors_created"
+	selfMetricRPCLatency         = selfMetricsPrefix + "rpc_latency"
+	selfMetricQueueDepth         = selfMetricsPrefix + "queue_depth"
+	selfMetricTailTraces         = selfMetricsPrefix + "tail_sampling_traces"
+	selfMetricTailEarlyDecisions = selfMetricsPrefix + "tail_sampling_early_decisions"
+)
+
+// API methods reported by the rpc_latency metric.
+const (
+	methodBatchWriteSpans         = "BatchWriteSpans"
+	methodCreateTimeSeries        = "CreateTimeSeries"
+	methodCreateServiceTimeSeries = "CreateServiceTimeSeries"
+	methodCreateMetricDescriptor  = "CreateMetricDescriptor"
+	methodGetMetricDescriptor     = "GetMetricDescriptor"
+	methodDeleteMetricDescriptor  = "DeleteMetricDescriptor"
+)
+
+// Reasons reported by the spans_dropped and time_series_dropped metrics, in
+// addition to the gRPC status codes of failed calls.
+const (
+	dropReasonBufferFull = "buffer_full"
+	dropReasonOversized  = "oversized"
+	dropReasonOutOfOrder = "out_of_order"
+)
+
+// Decisions reported by the tail_sampling_traces metric.
+const (
+	tailDecisionSampled    = "sampled"
+	tailDecisionNotSampled = "not_sampled"
+)
+
+// rpcLatencyBounds are the bucket bounds of the rpc_latency metric, in milliseconds.
+var rpcLatencyBounds = []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000}
+
+var (
+	selfMetricReasonKey   = metricdata.LabelKey{Key: "reason", Description: "Why the data was dropped"}
+	selfMetricMethodKey   = metricdata.LabelKey{Key: "method", Description: "Stackdriver API method"}
+	selfMetricStatusKey   = metricdata.LabelKey{Key: "status", Description: "gRPC status code of the call"}
+	selfMetricQueueKey    = metricdata.LabelKey{Key: "queue", Description: "Name of the exporter queue"}
+	selfMetricDecisionKey = metricdata.LabelKey{Key: "decision", Description: "Tail sampling decision"}
+)
+
+// selfMetrics records metrics about the health of the exporter. All of its
+// methods can be called on a nil *selfMetrics, in which case nothing is
+// recorded.
+type selfMetrics struct {
+	reg *metric.Registry
+
+	spansExported      *metric.Int64Cumulative
+	spansDropped       *metric.Int64Cumulative
+	spansOverflowed    *metric.Int64Cumulative
+	timeSeriesSent     *metric.Int64Cumulative
+	timeSeriesDropped  *metric.Int64Cumulative
+	descriptorsCreated *metric.Int64Cumulative
+	queueDepth         *metric.Int64DerivedGauge
+	tailTraces         *metric.Int64Cumulative
+	tailEarlyDecisions *metric.Int64Cumulative
+
+	mu        sync.Mutex
+	start     time.Time
+	latencies map[rpcKey]*metricdata.Distribution
+}
+
+type rpcKey struct {
+	method, status string
+}
+
+var _ metricproducer.Producer = (*selfMetrics)(nil)
+
+func newSelfMetrics() *selfMetrics {
+	sm := &selfMetrics{
+		reg:       metric.NewRegistry(),
+		start:     time.Now(),
+		latencies: make(map[rpcKey]*metricdata.Distribution),
+	}
+	// Adding metrics to a new registry only fails on duplicate names.
+	sm.spansExported, _ = sm.reg.AddInt64Cumulative(selfMetricSpansExported,
+		metric.WithDescription("Number of spans uploaded to Stackdriver Trace"),
+		metric.WithUnit(metricdata.UnitDimensionless))
+	sm.spansDropped, _ = sm.reg.AddInt64Cumulative(selfMetricSpansDropped,
+		metric.WithDescription("Number of spans that could not be uploaded to Stackdriver Trace"),
+		metric.WithUnit(metricdata.UnitDimensionless),
+		metric.WithLabelKeysAndDescription(selfMetricReasonKey))
+	sm.spansOverflowed, _ = sm.reg.AddInt64Cumulative(selfMetricSpansOverflowed,
+		metric.WithDescription("Number of spans that did not fit in the trace buffer"),
+		metric.WithUnit(metricdata.UnitDimensionless))
+	sm.timeSeriesSent, _ = sm.reg.AddInt64Cumulative(selfMetricTimeSeriesSent,
+		metric.WithDescription("Number of time series written to Stackdriver Monitoring"),
+		metric.WithUnit(metricdata.UnitDimensionless))
+	sm.timeSeriesDropped, _ = sm.reg.AddInt64Cumulative(selfMetricTimeSeriesDropped,
+		metric.WithDescription("Number of time series that could not be written to Stackdriver Monitoring"),
+		metric.WithUnit(metricdata.UnitDimensionless),
+		metric.WithLabelKeysAndDescription(selfMetricReasonKey))
+	sm.descriptorsCreated, _ = sm.reg.AddInt64Cumulative(selfMetricDescriptorsCreated,
+		metric.WithDescription("Number of metric descriptors created in Stackdriver Monitoring"),
+		metric.WithUnit(metricdata.UnitDimensionless))
+	sm.queueDepth, _ = sm.reg.AddInt64DerivedGauge(selfMetricQueueDepth,
+		metric.WithDescription("Number of items waiting to be uploaded"),
+		metric.WithUnit(metricdata.UnitDimensionless),
+		metric.WithLabelKeysAndDescription(selfMetricQueueKey))
+	sm.tailTraces, _ = sm.reg.AddInt64Cumulative(selfMetricTailTraces,
+		metric.WithDescription("Number of traces sampled or not by tail sampling"),
+		metric.WithUnit(metricdata.UnitDimensionless),
+		metric.WithLabelKeysAndDescription(selfMetricDecisionKey))
+	sm.tailEarlyDecisions, _ = sm.reg.AddInt64Cumulative(selfMetricTailEarlyDecisions,
+		metric.WithDescription("Number of tail sampling decisions made early because of the memory limits"),
+		metric.WithUnit(metricdata.UnitDimensionless))
+	return sm
+}
+
+// Read implements metricproducer.Producer.
+func (sm *selfMetrics) Read() []*metricdata.Metric {
+	if sm == nil {
+		return nil
+	}
+	metrics := sm.reg.Read()
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if len(sm.latencies) == 0 {
+		return metrics
+	}
+	keys := make([]rpcKey, 0, len(sm.latencies))
+	for k := range sm.latencies {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].status < keys[j].status
+	})
+	now := time.Now()
+	latency := &metricdata.Metric{
+		Descriptor: metricdata.Descriptor{
+			Name:        selfMetricRPCLatency,
+			Description: "Latency of the calls to the Stackdriver APIs",
+			Unit:        metricdata.UnitMilliseconds,
+			Type:        metricdata.TypeCumulativeDistribution,
+			LabelKeys:   []metricdata.LabelKey{selfMetricMethodKey, selfMetricStatusKey},
+		},
+	}
+	for _, k := range keys {
+		d := *sm.latencies[k]
+		d.Buckets = append([]metricdata.Bucket(nil), d.Buckets...)
+		latency.TimeSeries = append(latency.TimeSeries, &metricdata.TimeSeries{
+			LabelValues: []metricdata.LabelValue{metricdata.NewLabelValue(k.method), metricdata.NewLabelValue(k.status)},
+			Points:      []metricdata.Point{metricdata.NewDistributionPoint(now, &d)},
+			StartTime:   sm.start,
+		})
+	}
+	return append(metrics, latency)
+}
+
+// totals returns the sum of the time series of the cumulative metrics with
+// the given names, by name.
+func (sm *selfMetrics) totals(names ...string) map[string]int64 {
+	totals := make(map[string]int64, len(names))
+	if sm == nil {
+		return totals
+	}
+	for _, m := range sm.reg.Read() {
+		for _, name := range names {
+			if m.Descriptor.Name != name {
+				continue
+			}
+			for _, ts := range m.TimeSeries {
+				for _, p := range ts.Points {
+					if v, ok := p.Value.(int64); ok {
+						totals[name] += v
+					}
+				}
+			}
+		}
+	}
+	return totals
+}
+
+func (sm *selfMetrics) add(c *metric.Int64Cumulative, n int, labels ...string) {
+	if sm == nil || n <= 0 {
+		return
+	}
+	lvs := make([]metricdata.LabelValue, 0, len(labels))
+	for _, l := range labels {
+		lvs = append(lvs, metricdata.NewLabelValue(l))
+	}
+	if entry, err := c.GetEntry(lvs...); err == nil {
+		entry.Inc(int64(n))
+	}
+}
+
+func (sm *selfMetrics) spansExportedAdd(n int) {
+	if sm != nil {
+		sm.add(sm.spansExported, n)
+	}
+}
+
+func (sm *selfMetrics) spansDroppedAdd(n int, reason string) {
+	if sm != nil {
+		sm.add(sm.spansDropped, n, reason)
+	}
+}
+
+func (sm *selfMetrics) spansOverflowedAdd(n int) {
+	if sm != nil {
+		sm.add(sm.spansOverflowed, n)
+	}
+}
+
+func (sm *selfMetrics) timeSeriesSentAdd(n int) {
+	if sm != nil {
+		sm.add(sm.timeSeriesSent, n)
+	}
+}
+
+func (sm *selfMetrics) timeSeriesDroppedAdd(n int, reason string) {
+	if sm != nil {
+		sm.add(sm.timeSeriesDropped, n, reason)
+	}
+}
+
+func (sm *selfMetrics) descriptorCreated() {
+	if sm != nil {
+		sm.add(sm.descriptorsCreated, 1)
+	}
+}
+
+// tailDecisionAdd records a tail sampling decision.
+func (sm *selfMetrics) tailDecisionAdd(sampled, early bool) {
+	if sm == nil {
+		return
+	}
+	decision := tailDecisionNotSampled
+	if sampled {
+		decision = tailDecisionSampled
+	}
+	sm.add(sm.tailTraces, 1, decision)
+	if early {
+		sm.add(sm.tailEarlyDecisions, 1)
+	}
+}
+
+// recordTimeSeriesResult records the outcome of sending total time series
+// that failed with errs, as returned by sendReq.
+func (sm *selfMetrics) recordTimeSeriesResult(total int, errs []error) {
+	if sm == nil {
+		return
+	}
+	dropped := 0
+	for _, err := range errs {
+		n := 1
+		var tsErr *TimeSeriesError
+		if errors.As(err, &tsErr) {
+			n = len(tsErr.Rejected)
+		}
+		dropped += n
+		sm.timeSeriesDroppedAdd(n, errorReason(err))
+	}
+	sm.timeSeriesSentAdd(total - dropped)
+}
+
+// recordRPC records the latency of a call to method started at start.
+func (sm *selfMetrics) recordRPC(method string, start time.Time, err error) {
+	if sm == nil {
+		return
+	}
+	ms := float64(time.Since(start)) / float64(time.Millisecond)
+	k := rpcKey{method: method, status: status.Code(err).String()}
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	d, ok := sm.latencies[k]
+	if !ok {
+		d = &metricdata.Distribution{
+			BucketOptions: &metricdata.BucketOptions{Bounds: rpcLatencyBounds},
+			Buckets:       make([]metricdata.Bucket, len(rpcLatencyBounds)+1),
+		}
+		sm.latencies[k] = d
+	}
+	addToDistribution(d, ms)
+}
+
+// addToDistribution records v in d, which must have explicit bucket bounds
+// and one more bucket than bounds, and returns the index of its bucket.
+func addToDistribution(d *metricdata.Distribution, v float64) (bucket int) {
+	// Welford's online update of the sum of squared deviations.
+	mean := 0.0
+	if d.Count > 0 {
+		mean = d.Sum / float64(d.Count)
+	}
+	d.Count++
+	d.Sum += v
+	d.SumOfSquaredDeviation += (v - mean) * (v - d.Sum/float64(d.Count))
+	bounds := d.BucketOptions.Bounds
+	i := sort.SearchFloat64s(bounds, v)
+	if i < len(bounds) && bounds[i] == v {
+		i++
+	}
+	d.Buckets[i].Count++
+	return i
+}
+
+// timeCreateTimeSeries wraps a create time series function to record the
+// latency of its calls.
+func (sm *selfMetrics) timeCreateTimeSeries(
+	method string,
+	create func(context.Context, *monitoring.MetricClient, *monitoringpb.CreateTimeSeriesRequest) error,
+) func(context.Context, *monitoring.MetricClient, *monitoringpb.CreateTimeSeriesRequest) error {
+	if sm == nil {
+		return create
+	}
+	return func(ctx context.Context, c *monitoring.MetricClient, req *monitoringpb.CreateTimeSeriesRequest) error {
+		start := time.Now()
+		err := create(ctx, c, req)
+		sm.recordRPC(method, start, err)
+		return err
+	}
+}
+
+// addQueue reports the number of items returned by depth under the given
+// queue name.
+func (sm *selfMetrics) addQueue(name string, depth func() int64) {
+	if sm == nil {
+		return
+	}
+	_ = sm.queueDepth.UpsertEntry(depth, metricdata.NewLabelValue(name))
+}
+
+// errorReason returns the reason label used for data dropped because of err.
+func errorReason(err error) string {
+	if err == nil {
+		return codes.Unknown.String()
+	}
+	return status.Code(err).String()
+}
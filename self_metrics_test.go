@@ -0,0 +1,150 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+	"cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	"go.opencensus.io/metric/metricdata"
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// selfMetricValues returns the int64 values of the self metrics, keyed by
+// metric name and label values.
+func selfMetricValues(sm *selfMetrics) map[string]int64 {
+	values := make(map[string]int64)
+	for _, m := range sm.Read() {
+		for _, ts := range m.TimeSeries {
+			key := m.Descriptor.Name
+			for _, lv := range ts.LabelValues {
+				key += "|" + lv.Value
+			}
+			if v, ok := ts.Points[0].Value.(int64); ok {
+				values[key] = v
+			}
+		}
+	}
+	return values
+}
+
+func TestSelfMetricsNil(t *testing.T) {
+	var sm *selfMetrics
+	sm.spansExportedAdd(1)
+	sm.timeSeriesDroppedAdd(1, "reason")
+	sm.recordRPC(methodCreateTimeSeries, time.Now(), nil)
+	sm.recordTimeSeriesResult(2, nil)
+	sm.addQueue("queue", func() int64 { return 0 })
+	if got := sm.Read(); got != nil {
+		t.Errorf("Read() = %v; want nil", got)
+	}
+}
+
+func TestSelfMetricsRPCLatency(t *testing.T) {
+	sm := newSelfMetrics()
+	now := time.Now()
+	sm.recordRPC(methodCreateTimeSeries, now.Add(-2*time.Millisecond), nil)
+	sm.recordRPC(methodCreateTimeSeries, now.Add(-20*time.Millisecond), nil)
+	sm.recordRPC(methodCreateTimeSeries, now, status.Error(codes.Unavailable, "unavailable"))
+
+	var latency *metricdata.Metric
+	for _, m := range sm.Read() {
+		if m.Descriptor.Name == selfMetricRPCLatency {
+			latency = m
+		}
+	}
+	if latency == nil {
+		t.Fatal("rpc_latency metric not found")
+	}
+	if got := len(latency.TimeSeries); got != 2 {
+		t.Fatalf("got %d rpc_latency time series; want 2", got)
+	}
+	// Time series are sorted by method then status.
+	ts := latency.TimeSeries[0]
+	if got := ts.LabelValues[1].Value; got != "OK" {
+		t.Errorf("status = %q; want %q", got, "OK")
+	}
+	d := ts.Points[0].Value.(*metricdata.Distribution)
+	if d.Count != 2 {
+		t.Errorf("Count = %d; want 2", d.Count)
+	}
+	if d.Sum < 22 {
+		t.Errorf("Sum = %v; want at least 22", d.Sum)
+	}
+	if d.Buckets[1].Count != 1 || d.Buckets[3].Count != 1 {
+		t.Errorf("Buckets = %v; want one count in [1, 5) and one in [10, 25)", d.Buckets)
+	}
+}
+
+func TestSelfMetricsTimeSeries(t *testing.T) {
+	persistedCreateTimeSeries := createTimeSeries
+	defer func() {
+		createTimeSeries = persistedCreateTimeSeries
+	}()
+	var createErr error
+	createTimeSeries = func(ctx context.Context, c *monitoring.MetricClient, ts *monitoringpb.CreateTimeSeriesRequest) error {
+		return createErr
+	}
+
+	e := &statsExporter{o: Options{ProjectID: "test"}, sm: newSelfMetrics()}
+	req := &monitoringpb.CreateTimeSeriesRequest{Name: "projects/test", TimeSeries: makeTs(3, false)}
+	if err := e.writeTimeSeries(context.Background(), false, req); err != nil {
+		t.Fatal(err)
+	}
+	createErr = status.Error(codes.InvalidArgument, "invalid")
+	if err := e.writeTimeSeries(context.Background(), false, req); err == nil {
+		t.Fatal("writeTimeSeries() error = nil; want error")
+	}
+
+	got := selfMetricValues(e.sm)
+	for key, want := range map[string]int64{
+		selfMetricTimeSeriesSent:                         3,
+		selfMetricTimeSeriesDropped + "|InvalidArgument": 3,
+	} {
+		if got[key] != want {
+			t.Errorf("%s = %d; want %d", key, got[key], want)
+		}
+	}
+}
+
+func TestSelfMetricsSpans(t *testing.T) {
+	sm := newSelfMetrics()
+	e := newTraceExporterWithClient(Options{
+		ProjectID:                "test",
+		BundleDelayThreshold:     time.Hour,
+		BundleCountThreshold:     1000,
+		TraceSpansBufferMaxBytes: 1,
+	}, nil)
+	e.sm = sm
+
+	_, span := trace.StartSpan(context.Background(), "span", trace.WithSampler(trace.AlwaysSample()))
+	span.End()
+	e.ExportSpan(&trace.SpanData{SpanContext: span.SpanContext(), Name: "span"})
+
+	got := selfMetricValues(sm)
+	for key, want := range map[string]int64{
+		selfMetricSpansOverflowed:                           1,
+		selfMetricSpansDropped + "|" + dropReasonBufferFull: 1,
+	} {
+		if got[key] != want {
+			t.Errorf("%s = %d; want %d", key, got[key], want)
+		}
+	}
+}
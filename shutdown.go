@@ -0,0 +1,99 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+)
+
+// ShutdownReport summarizes the data handled by an exporter over its
+// lifetime, as returned by Exporter.Shutdown.
+type ShutdownReport struct {
+	// SpansExported and SpansDropped are the numbers of spans uploaded to
+	// Stackdriver Trace, and of spans that could not be.
+	SpansExported int64
+	SpansDropped  int64
+
+	// SpansPending is the number of spans still waiting to be uploaded, or
+	// being uploaded, when the deadline of Shutdown expired. They are lost.
+	SpansPending int64
+
+	// TimeSeriesSent and TimeSeriesDropped are the numbers of time series
+	// written to Stackdriver Monitoring, and of time series that could
+	// not be.
+	TimeSeriesSent    int64
+	TimeSeriesDropped int64
+
+	// MetricsPending is the number of view data and metrics still waiting
+	// to be uploaded, or being uploaded, when the deadline of Shutdown
+	// expired. They are lost.
+	MetricsPending int64
+}
+
+// String returns a one-line summary of r.
+func (r ShutdownReport) String() string {
+	return fmt.Sprintf("spans: %d exported, %d dropped, %d pending; time series: %d sent, %d dropped; metrics pending: %d",
+		r.SpansExported, r.SpansDropped, r.SpansPending, r.TimeSeriesSent, r.TimeSeriesDropped, r.MetricsPending)
+}
+
+// Shutdown stops the metrics exporter started by StartMetricsExporter,
+// uploads the buffered spans, view data and metrics, and closes the client
+// connections. It waits for the uploads until the deadline of ctx, and
+// returns ctx.Err() if it expires first, in which case the remaining data is
+// lost: closing the client connections cancels the uploads in progress, and
+// the flush started by Shutdown keeps running in the background until it has
+// failed to upload the data still buffered. The errors of these uploads are
+// passed to Options.OnError, and may be reported after Shutdown returns.
+//
+// The report describes all the data handled by the exporter, including the
+// data exported before Shutdown was called. Shutdown must not be called
+// concurrently with export calls. Calling Close after Shutdown has no effect.
+func (e *Exporter) Shutdown(ctx context.Context) (ShutdownReport, error) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.StopMetricsExporter()
+		e.Flush()
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	report := e.report()
+	if cerr := e.closeContext(ctx); cerr != nil && err == nil {
+		err = cerr
+	}
+	return report, err
+}
+
+// report returns the current ShutdownReport of e.
+func (e *Exporter) report() ShutdownReport {
+	se := e.statsExporter
+	totals := se.sm.totals(selfMetricSpansExported, selfMetricSpansDropped,
+		selfMetricTimeSeriesSent, selfMetricTimeSeriesDropped)
+	return ShutdownReport{
+		SpansExported:     totals[selfMetricSpansExported],
+		SpansDropped:      totals[selfMetricSpansDropped],
+		SpansPending:      atomic.LoadInt64(&e.traceExporter.queued),
+		TimeSeriesSent:    totals[selfMetricTimeSeriesSent],
+		TimeSeriesDropped: totals[selfMetricTimeSeriesDropped],
+		MetricsPending:    atomic.LoadInt64(&se.queuedViewData) + atomic.LoadInt64(&se.queuedMetrics),
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opencensus.io/metric/metricdata"
+	"go.opencensus.io/metric/metricproducer"
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc/codes"
+
+	"cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+)
+
+// Names of the metrics derived from spans.
+const (
+	spanMetricsPrefix = "opencensus.io/span/"
+
+	spanMetricRequestCount = spanMetricsPrefix + "request_count"
+	spanMetricErrorCount   = spanMetricsPrefix + "error_count"
+	spanMetricLatency      = spanMetricsPrefix + "latency"
+)
+
+const defaultSpanMetricsMaxTimeSeries = 1000
+
+// spanMetricsOverflowValue replaces every label value of the spans whose
+// label values would exceed SpanMetricsOptions.MaxTimeSeries.
+const spanMetricsOverflowValue = "other"
+
+// defaultSpanLatencyBounds are the default bucket bounds of the latency
+// metric derived from spans, in milliseconds.
+var defaultSpanLatencyBounds = []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000}
+
+var (
+	spanMetricNameKey   = metricdata.LabelKey{Key: "span_name", Description: "Name of the span"}
+	spanMetricKindKey   = metricdata.LabelKey{Key: "span_kind", Description: "Kind of the span"}
+	spanMetricStatusKey = metricdata.LabelKey{Key: "status", Description: "Canonical status code of the span"}
+)
+
+// SpanMetricsOptions configures the request count, error count and latency
+// metrics derived from the spans exported through ExportSpan. They are
+// labeled with the name, kind and status of the spans, and with the
+// attributes selected in Attributes, as left by Options.SpanProcessors. The
+// spans dropped by the processors are counted with empty attribute labels.
+//
+// Only the spans sampled by the trace sampler reach the exporter, so the
+// metrics only describe all requests if every span is sampled, for example
+// with trace.AlwaysSample along with Options.TailSampling.
+type SpanMetricsOptions struct {
+	// Attributes are the keys of the span attributes added as labels to
+	// the metrics. Spans without one of the attributes have an empty
+	// label value.
+	Attributes []string
+
+	// LatencyBounds are the bucket bounds of the latency distribution, in
+	// milliseconds. If unset, bounds from 1ms to 1min are used.
+	LatencyBounds []float64
+
+	// MaxTimeSeries is the maximum number of label value combinations. The
+	// spans with other combinations are recorded with every label value
+	// set to "other", and the exemplars of their latency carry their label
+	// values as dropped labels. If unset, a default of 1000 is used.
+	MaxTimeSeries int
+}
+
+// spanMetrics aggregates the spans into metrics. All of its methods can be
+// called on a nil *spanMetrics, in which case nothing is recorded.
+type spanMetrics struct {
+	o         SpanMetricsOptions
+	labelKeys []metricdata.LabelKey
+
+	mu     sync.Mutex
+	start  time.Time
+	series map[string]*spanSeries
+}
+
+// spanSeries holds the metric values of a label value combination.
+type spanSeries struct {
+	labels   []string
+	requests int64
+	errors   int64
+	latency  metricdata.Distribution
+}
+
+var _ metricproducer.Producer = (*spanMetrics)(nil)
+
+func newSpanMetrics(o SpanMetricsOptions) *spanMetrics {
+	if len(o.LatencyBounds) == 0 {
+		o.LatencyBounds = defaultSpanLatencyBounds
+	}
+	if o.MaxTimeSeries <= 0 {
+		o.MaxTimeSeries = defaultSpanMetricsMaxTimeSeries
+	}
+	keys := []metricdata.LabelKey{spanMetricNameKey, spanMetricKindKey, spanMetricStatusKey}
+	for _, a := range o.Attributes {
+		keys = append(keys, metricdata.LabelKey{Key: a, Description: fmt.Sprintf("Value of the %s span attribute", a)})
+	}
+	return &spanMetrics{
+		o:         o,
+		labelKeys: keys,
+		start:     time.Now(),
+		series:    make(map[string]*spanSeries),
+	}
+}
+
+// record adds s to the metrics.
+func (sm *spanMetrics) record(s *trace.SpanData) {
+	if sm == nil {
+		return
+	}
+	labels := make([]string, 0, len(sm.labelKeys))
+	labels = append(labels, s.Name, spanKindName(s.SpanKind), codes.Code(s.Code).String())
+	for _, a := range sm.o.Attributes {
+		v := ""
+		if av, ok := s.Attributes[a]; ok {
+			v = fmt.Sprint(av)
+		}
+		labels = append(labels, v)
+	}
+	ms := float64(s.EndTime.Sub(s.StartTime)) / float64(time.Millisecond)
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	key := strings.Join(labels, "\x00")
+	ss, ok := sm.series[key]
+	var dropped map[string]string
+	if !ok && len(sm.series) >= sm.o.MaxTimeSeries {
+		dropped = make(map[string]string, len(labels))
+		for i := range labels {
+			dropped[sm.labelKeys[i].Key] = labels[i]
+			labels[i] = spanMetricsOverflowValue
+		}
+		key = strings.Join(labels, "\x00")
+		ss, ok = sm.series[key]
+	}
+	if !ok {
+		ss = &spanSeries{
+			labels: labels,
+			latency: metricdata.Distribution{
+				BucketOptions: &metricdata.BucketOptions{Bounds: sm.o.LatencyBounds},
+				Buckets:       make([]metricdata.Bucket, len(sm.o.LatencyBounds)+1),
+			},
+		}
+		sm.series[key] = ss
+	}
+	ss.requests++
+	if s.Code != int32(codes.OK) {
+		ss.errors++
+	}
+	b := addToDistribution(&ss.latency, ms)
+	if dropped != nil {
+		ss.latency.Buckets[b].Exemplar = &metricdata.Exemplar{
+			Value:     ms,
+			Timestamp: s.EndTime,
+			Attachments: metricdata.Attachments{
+				metricdata.AttachmentKeySpanContext: s.SpanContext,
+				attachmentKeyDroppedLabels:          &monitoringpb.DroppedLabels{Label: dropped},
+			},
+		}
+	}
+}
+
+// Read implements metricproducer.Producer.
+func (sm *spanMetrics) Read() []*metricdata.Metric {
+	if sm == nil {
+		return nil
+	}
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if len(sm.series) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(sm.series))
+	for k := range sm.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	newMetric := func(name, description string, unit metricdata.Unit, typ metricdata.Type) *metricdata.Metric {
+		return &metricdata.Metric{
+			Descriptor: metricdata.Descriptor{
+				Name:        name,
+				Description: description,
+				Unit:        unit,
+				Type:        typ,
+				LabelKeys:   sm.labelKeys,
+			},
+		}
+	}
+	requests := newMetric(spanMetricRequestCount, "Number of spans", metricdata.UnitDimensionless, metricdata.TypeCumulativeInt64)
+	errors := newMetric(spanMetricErrorCount, "Number of spans with a status other than OK", metricdata.UnitDimensionless, metricdata.TypeCumulativeInt64)
+	latency := newMetric(spanMetricLatency, "Duration of the spans", metricdata.UnitMilliseconds, metricdata.TypeCumulativeDistribution)
+
+	now := time.Now()
+	for _, k := range keys {
+		ss := sm.series[k]
+		lvs := make([]metricdata.LabelValue, len(ss.labels))
+		for i, l := range ss.labels {
+			lvs[i] = metricdata.NewLabelValue(l)
+		}
+		d := ss.latency
+		d.Buckets = append([]metricdata.Bucket(nil), d.Buckets...)
+		requests.TimeSeries = append(requests.TimeSeries, &metricdata.TimeSeries{
+			LabelValues: lvs,
+			Points:      []metricdata.Point{metricdata.NewInt64Point(now, ss.requests)},
+			StartTime:   sm.start,
+		})
+		errors.TimeSeries = append(errors.TimeSeries, &metricdata.TimeSeries{
+			LabelValues: lvs,
+			Points:      []metricdata.Point{metricdata.NewInt64Point(now, ss.errors)},
+			StartTime:   sm.start,
+		})
+		latency.TimeSeries = append(latency.TimeSeries, &metricdata.TimeSeries{
+			LabelValues: lvs,
+			Points:      []metricdata.Point{metricdata.NewDistributionPoint(now, &d)},
+			StartTime:   sm.start,
+		})
+	}
+	return []*metricdata.Metric{requests, errors, latency}
+}
+
+// spanKindName returns the name of a span kind used as metric label value.
+func spanKindName(kind int) string {
+	switch kind {
+	case trace.SpanKindServer:
+		return "SERVER"
+	case trace.SpanKindClient:
+		return "CLIENT"
+	}
+	return "UNSPECIFIED"
+}
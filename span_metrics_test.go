@@ -0,0 +1,157 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"context"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/trace/apiv2/tracepb"
+	"go.opencensus.io/metric/metricdata"
+	"go.opencensus.io/trace"
+)
+
+func TestSpanMetrics(t *testing.T) {
+	e := newTraceExporterWithClient(Options{
+		Context: context.Background(),
+		Timeout: 10 * time.Millisecond,
+		SpanMetrics: &SpanMetricsOptions{
+			Attributes:    []string{"http.method"},
+			LatencyBounds: []float64{10, 100},
+		},
+		SpanProcessors: []SpanProcessor{func(*trace.SpanData) bool { return false }},
+	}, nil)
+	e.uploadFn = func([]*tracepb.Span) {}
+
+	start := time.Now()
+	span := func(code int32, d time.Duration) *trace.SpanData {
+		return &trace.SpanData{
+			Name:       "/users",
+			SpanKind:   trace.SpanKindServer,
+			StartTime:  start,
+			EndTime:    start.Add(d),
+			Status:     trace.Status{Code: code},
+			Attributes: map[string]interface{}{"http.method": "GET"},
+		}
+	}
+	e.ExportSpan(span(0, 5*time.Millisecond))
+	e.ExportSpan(span(0, 50*time.Millisecond))
+	e.ExportSpan(span(0, 500*time.Millisecond))
+	e.ExportSpan(span(13, 50*time.Millisecond))
+
+	metrics := e.spanMetrics.Read()
+	if len(metrics) != 3 {
+		t.Fatalf("Read() returned %d metrics; want 3", len(metrics))
+	}
+	byName := make(map[string]*metricdata.Metric)
+	for _, m := range metrics {
+		byName[m.Descriptor.Name] = m
+	}
+	lv := func(vs ...string) []metricdata.LabelValue {
+		var lvs []metricdata.LabelValue
+		for _, v := range vs {
+			lvs = append(lvs, metricdata.NewLabelValue(v))
+		}
+		return lvs
+	}
+	// The spans dropped by the processor are counted without attributes.
+	ok, internal := lv("/users", "SERVER", "OK", ""), lv("/users", "SERVER", "Internal", "")
+
+	requests := byName[spanMetricRequestCount]
+	if got := len(requests.TimeSeries); got != 2 {
+		t.Fatalf("request_count has %d time series; want 2", got)
+	}
+	// Time series are sorted by label values.
+	if !reflect.DeepEqual(requests.TimeSeries[0].LabelValues, internal) ||
+		!reflect.DeepEqual(requests.TimeSeries[1].LabelValues, ok) {
+		t.Errorf("label values = %v, %v", requests.TimeSeries[0].LabelValues, requests.TimeSeries[1].LabelValues)
+	}
+	if got := requests.TimeSeries[1].Points[0].Value; got != int64(3) {
+		t.Errorf("OK request_count = %v; want 3", got)
+	}
+	errors := byName[spanMetricErrorCount]
+	if got := errors.TimeSeries[0].Points[0].Value; got != int64(1) {
+		t.Errorf("Internal error_count = %v; want 1", got)
+	}
+	if got := errors.TimeSeries[1].Points[0].Value; got != int64(0) {
+		t.Errorf("OK error_count = %v; want 0", got)
+	}
+	d := byName[spanMetricLatency].TimeSeries[1].Points[0].Value.(*metricdata.Distribution)
+	var counts []int64
+	for _, b := range d.Buckets {
+		counts = append(counts, b.Count)
+	}
+	if want := []int64{1, 1, 1}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("latency buckets = %v; want %v", counts, want)
+	}
+	if d.Count != 3 || d.Sum != 555 {
+		t.Errorf("latency count, sum = %d, %v; want 3, 555", d.Count, d.Sum)
+	}
+}
+
+func TestSpanMetricsProcessedAttributes(t *testing.T) {
+	e := newTraceExporterWithClient(Options{
+		Context:     context.Background(),
+		SpanMetrics: &SpanMetricsOptions{Attributes: []string{"user"}},
+		SpanProcessors: []SpanProcessor{
+			RedactAttributeValues(regexp.MustCompile("^user$"), regexp.MustCompile(".+"), "redacted"),
+			func(s *trace.SpanData) bool { return s.Name != "dropped" },
+		},
+	}, nil)
+	e.uploadFn = func([]*tracepb.Span) {}
+	for _, name := range []string{"kept", "dropped"} {
+		e.ExportSpan(&trace.SpanData{Name: name, Attributes: map[string]interface{}{"user": "alice"}})
+	}
+	e.Flush()
+
+	requests := e.spanMetrics.Read()[0]
+	got := make(map[string]string)
+	for _, ts := range requests.TimeSeries {
+		got[ts.LabelValues[0].Value] = ts.LabelValues[3].Value
+	}
+	want := map[string]string{"kept": "redacted", "dropped": ""}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("user label per span name = %v; want %v", got, want)
+	}
+}
+
+func TestSpanMetricsMaxTimeSeries(t *testing.T) {
+	sm := newSpanMetrics(SpanMetricsOptions{MaxTimeSeries: 1})
+	for _, name := range []string{"a", "b", "c"} {
+		sm.record(&trace.SpanData{Name: name})
+	}
+	requests := sm.Read()[0]
+	if got := len(requests.TimeSeries); got != 2 {
+		t.Fatalf("request_count has %d time series; want 2", got)
+	}
+	overflow := requests.TimeSeries[1]
+	if got := overflow.LabelValues[0].Value; got != spanMetricsOverflowValue {
+		t.Errorf("span_name = %q; want %q", got, spanMetricsOverflowValue)
+	}
+	if got := overflow.Points[0].Value; got != int64(2) {
+		t.Errorf("overflow request_count = %v; want 2", got)
+	}
+}
+
+func TestSpanMetricsDisabled(t *testing.T) {
+	var sm *spanMetrics
+	sm.record(&trace.SpanData{})
+	if got := sm.Read(); got != nil {
+		t.Errorf("Read() = %v; want nil", got)
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/trace"
+)
+
+// HTTPRouteAttribute is the key of the span attribute holding the route
+// template matched by an HTTP server, such as "/users/{id}". ochttp does not
+// set it; handlers can add it to their spans for HTTPRouteSpanDisplayName.
+const HTTPRouteAttribute = "http.route"
+
+// PrefixedSpanDisplayName returns the name of s prefixed with "Sent." for
+// client spans and "Recv." for server spans. It is the default
+// Options.GetSpanDisplayName.
+func PrefixedSpanDisplayName(s *trace.SpanData) string {
+	switch s.SpanKind {
+	case trace.SpanKindClient:
+		return "Sent." + s.Name
+	case trace.SpanKindServer:
+		return "Recv." + s.Name
+	}
+	return s.Name
+}
+
+// UnprefixedSpanDisplayName returns the name of s unchanged, whatever its
+// kind.
+func UnprefixedSpanDisplayName(s *trace.SpanData) string {
+	return s.Name
+}
+
+// HTTPRouteSpanDisplayName returns a function naming the spans having both
+// the ochttp.MethodAttribute and HTTPRouteAttribute string attributes after
+// them, as in "GET /users/{id}". Other spans are named by fallback, or by
+// PrefixedSpanDisplayName if fallback is nil.
+func HTTPRouteSpanDisplayName(fallback func(s *trace.SpanData) string) func(s *trace.SpanData) string {
+	if fallback == nil {
+		fallback = PrefixedSpanDisplayName
+	}
+	return func(s *trace.SpanData) string {
+		method, _ := s.Attributes[ochttp.MethodAttribute].(string)
+		route, _ := s.Attributes[HTTPRouteAttribute].(string)
+		if method == "" || route == "" {
+			return fallback(s)
+		}
+		return method + " " + route
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/trace/apiv2/tracepb"
+	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/trace"
+)
+
+func TestSpanDisplayNames(t *testing.T) {
+	client := &trace.SpanData{Name: "/users/42", SpanKind: trace.SpanKindClient}
+	server := &trace.SpanData{
+		Name:     "/users/42",
+		SpanKind: trace.SpanKindServer,
+		Attributes: map[string]interface{}{
+			ochttp.MethodAttribute: "GET",
+			HTTPRouteAttribute:     "/users/{id}",
+		},
+	}
+	noRoute := &trace.SpanData{
+		Name:       "/health",
+		SpanKind:   trace.SpanKindServer,
+		Attributes: map[string]interface{}{ochttp.MethodAttribute: "GET"},
+	}
+	tests := []struct {
+		name  string
+		namer func(*trace.SpanData) string
+		span  *trace.SpanData
+		want  string
+	}{
+		{"prefixed client", PrefixedSpanDisplayName, client, "Sent./users/42"},
+		{"prefixed server", PrefixedSpanDisplayName, server, "Recv./users/42"},
+		{"prefixed internal", PrefixedSpanDisplayName, &trace.SpanData{Name: "work"}, "work"},
+		{"unprefixed", UnprefixedSpanDisplayName, client, "/users/42"},
+		{"route", HTTPRouteSpanDisplayName(nil), server, "GET /users/{id}"},
+		{"no route", HTTPRouteSpanDisplayName(nil), noRoute, "Recv./health"},
+		{"no route unprefixed", HTTPRouteSpanDisplayName(UnprefixedSpanDisplayName), noRoute, "/health"},
+	}
+	for _, tt := range tests {
+		if got := tt.namer(tt.span); got != tt.want {
+			t.Errorf("%s: got %q; want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGetSpanDisplayName(t *testing.T) {
+	e := newTraceExporterWithClient(Options{
+		Context: context.Background(),
+		Timeout: 10 * time.Millisecond,
+		GetSpanDisplayName: func(s *trace.SpanData) string {
+			return strings.Repeat(s.Name, 100)
+		},
+	}, nil)
+	var got []*tracepb.Span
+	e.uploadFn = func(spans []*tracepb.Span) {
+		got = append(got, spans...)
+	}
+	e.ExportSpan(&trace.SpanData{Name: "ab", SpanKind: trace.SpanKindServer})
+	e.Flush()
+
+	if len(got) != 1 {
+		t.Fatalf("uploaded %d spans; want 1", len(got))
+	}
+	if want := strings.Repeat("ab", maxDisplayNameLength/2); got[0].DisplayName.Value != want {
+		t.Errorf("DisplayName = %q; want %q", got[0].DisplayName.Value, want)
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/trace"
+)
+
+// SpanProcessor modifies a span before it is uploaded to Stackdriver Trace,
+// and returns false if the span must not be uploaded.
+//
+// The span is a copy owned by the exporter: its attribute maps, as well as
+// the ones of its annotations and links, and its annotation and link slices
+// can be modified in place.
+type SpanProcessor func(s *trace.SpanData) bool
+
+// DropAttributes returns a SpanProcessor removing the attributes with the
+// given keys from spans, annotations and links.
+func DropAttributes(keys ...string) SpanProcessor {
+	return func(s *trace.SpanData) bool {
+		forEachAttributes(s, func(attrs map[string]interface{}) {
+			for _, k := range keys {
+				delete(attrs, k)
+			}
+		})
+		return true
+	}
+}
+
+// DropAttributesMatching returns a SpanProcessor removing the attributes
+// whose keys match re from spans, annotations and links.
+func DropAttributesMatching(re *regexp.Regexp) SpanProcessor {
+	return func(s *trace.SpanData) bool {
+		forEachAttributes(s, func(attrs map[string]interface{}) {
+			for k := range attrs {
+				if re.MatchString(k) {
+					delete(attrs, k)
+				}
+			}
+		})
+		return true
+	}
+}
+
+// HashAttributes returns a SpanProcessor replacing the values of the
+// attributes with the given keys by the hex encoded SHA-256 hash of their
+// string representation, so that they can be correlated without being
+// disclosed.
+func HashAttributes(keys ...string) SpanProcessor {
+	return func(s *trace.SpanData) bool {
+		forEachAttributes(s, func(attrs map[string]interface{}) {
+			for _, k := range keys {
+				if v, ok := attrs[k]; ok {
+					sum := sha256.Sum256([]byte(fmt.Sprint(v)))
+					attrs[k] = hex.EncodeToString(sum[:])
+				}
+			}
+		})
+		return true
+	}
+}
+
+// RenameAttribute returns a SpanProcessor renaming the attributes with the
+// key from to the key to. Existing attributes with the key to are replaced.
+func RenameAttribute(from, to string) SpanProcessor {
+	return func(s *trace.SpanData) bool {
+		forEachAttributes(s, func(attrs map[string]interface{}) {
+			if v, ok := attrs[from]; ok {
+				delete(attrs, from)
+				attrs[to] = v
+			}
+		})
+		return true
+	}
+}
+
+// RedactAttributeValues returns a SpanProcessor replacing the parts of the
+// string attribute values matching value by replacement, which can refer to
+// submatches as in regexp.Regexp.ReplaceAllString. Only the attributes
+// whose keys match key are redacted; if key is nil, all of them are.
+func RedactAttributeValues(key, value *regexp.Regexp, replacement string) SpanProcessor {
+	return func(s *trace.SpanData) bool {
+		forEachAttributes(s, func(attrs map[string]interface{}) {
+			for k, v := range attrs {
+				str, ok := v.(string)
+				if !ok || (key != nil && !key.MatchString(k)) {
+					continue
+				}
+				attrs[k] = value.ReplaceAllString(str, replacement)
+			}
+		})
+		return true
+	}
+}
+
+// RedactAnnotations returns a SpanProcessor replacing the parts of
+// annotation messages matching re by replacement.
+func RedactAnnotations(re *regexp.Regexp, replacement string) SpanProcessor {
+	return func(s *trace.SpanData) bool {
+		for i := range s.Annotations {
+			s.Annotations[i].Message = re.ReplaceAllString(s.Annotations[i].Message, replacement)
+		}
+		return true
+	}
+}
+
+// ScrubHTTPPathQuery returns a SpanProcessor removing the query string from
+// the HTTP path attribute of spans, which becomes the /http/path label.
+func ScrubHTTPPathQuery() SpanProcessor {
+	return func(s *trace.SpanData) bool {
+		for _, k := range []string{ochttp.PathAttribute, labelHTTPPath} {
+			if p, ok := s.Attributes[k].(string); ok {
+				if i := strings.IndexByte(p, '?'); i >= 0 {
+					s.Attributes[k] = p[:i]
+				}
+			}
+		}
+		return true
+	}
+}
+
+// forEachAttributes calls f with the non-nil attribute maps of s, its
+// annotations and its links.
+func forEachAttributes(s *trace.SpanData, f func(attrs map[string]interface{})) {
+	if s.Attributes != nil {
+		f(s.Attributes)
+	}
+	for _, a := range s.Annotations {
+		if a.Attributes != nil {
+			f(a.Attributes)
+		}
+	}
+	for _, l := range s.Links {
+		if l.Attributes != nil {
+			f(l.Attributes)
+		}
+	}
+}
+
+// processSpan returns a copy of s modified by processors, or nil if one of
+// them dropped it. s is returned as is if there are no processors.
+func processSpan(s *trace.SpanData, processors []SpanProcessor) *trace.SpanData {
+	if len(processors) == 0 {
+		return s
+	}
+	c := copySpanData(s)
+	for _, p := range processors {
+		if !p(c) {
+			return nil
+		}
+	}
+	return c
+}
+
+// copySpanData returns a copy of s, sharing only its message events.
+func copySpanData(s *trace.SpanData) *trace.SpanData {
+	c := *s
+	c.Attributes = copyAttributeMap(s.Attributes)
+	if s.Annotations != nil {
+		c.Annotations = make([]trace.Annotation, len(s.Annotations))
+		for i, a := range s.Annotations {
+			a.Attributes = copyAttributeMap(a.Attributes)
+			c.Annotations[i] = a
+		}
+	}
+	if s.Links != nil {
+		c.Links = make([]trace.Link, len(s.Links))
+		for i, l := range s.Links {
+			l.Attributes = copyAttributeMap(l.Attributes)
+			c.Links[i] = l
+		}
+	}
+	return &c
+}
+
+func copyAttributeMap(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,187 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"context"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/trace/apiv2/tracepb"
+	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/trace"
+)
+
+func processorTestSpan() *trace.SpanData {
+	return &trace.SpanData{
+		Name: "span",
+		Attributes: map[string]interface{}{
+			"user.email":         "alice@example.com",
+			"user.id":            int64(42),
+			"db.statement":       "SELECT * FROM users WHERE email = 'alice@example.com'",
+			ochttp.PathAttribute: "/search?q=secret&page=2",
+		},
+		Annotations: []trace.Annotation{{
+			Message:    "lookup of alice@example.com",
+			Attributes: map[string]interface{}{"user.email": "alice@example.com"},
+		}},
+		Links: []trace.Link{{
+			Attributes: map[string]interface{}{"user.email": "alice@example.com"},
+		}},
+	}
+}
+
+func TestSpanProcessors(t *testing.T) {
+	email := regexp.MustCompile(`[a-z]+@example\.com`)
+	tests := []struct {
+		name           string
+		processor      SpanProcessor
+		wantAttrs      map[string]interface{}
+		wantAnnotation string
+		wantLinkAttrs  map[string]interface{}
+	}{
+		{
+			name:      "drop",
+			processor: DropAttributes("user.email", "user.id"),
+			wantAttrs: map[string]interface{}{
+				"db.statement":       "SELECT * FROM users WHERE email = 'alice@example.com'",
+				ochttp.PathAttribute: "/search?q=secret&page=2",
+			},
+			wantAnnotation: "lookup of alice@example.com",
+			wantLinkAttrs:  map[string]interface{}{},
+		},
+		{
+			name:      "drop matching",
+			processor: DropAttributesMatching(regexp.MustCompile(`^user\.`)),
+			wantAttrs: map[string]interface{}{
+				"db.statement":       "SELECT * FROM users WHERE email = 'alice@example.com'",
+				ochttp.PathAttribute: "/search?q=secret&page=2",
+			},
+			wantAnnotation: "lookup of alice@example.com",
+			wantLinkAttrs:  map[string]interface{}{},
+		},
+		{
+			name:      "hash",
+			processor: HashAttributes("user.id"),
+			wantAttrs: map[string]interface{}{
+				"user.email":         "alice@example.com",
+				"user.id":            "73475cb40a568e8da8a045ced110137e159f890ac4da883b6b17dc651b3a8049",
+				"db.statement":       "SELECT * FROM users WHERE email = 'alice@example.com'",
+				ochttp.PathAttribute: "/search?q=secret&page=2",
+			},
+			wantAnnotation: "lookup of alice@example.com",
+			wantLinkAttrs:  map[string]interface{}{"user.email": "alice@example.com"},
+		},
+		{
+			name:      "rename",
+			processor: RenameAttribute("user.email", "enduser.id"),
+			wantAttrs: map[string]interface{}{
+				"enduser.id":         "alice@example.com",
+				"user.id":            int64(42),
+				"db.statement":       "SELECT * FROM users WHERE email = 'alice@example.com'",
+				ochttp.PathAttribute: "/search?q=secret&page=2",
+			},
+			wantAnnotation: "lookup of alice@example.com",
+			wantLinkAttrs:  map[string]interface{}{"enduser.id": "alice@example.com"},
+		},
+		{
+			name:      "redact values",
+			processor: RedactAttributeValues(regexp.MustCompile(`^db\.`), email, "<email>"),
+			wantAttrs: map[string]interface{}{
+				"user.email":         "alice@example.com",
+				"user.id":            int64(42),
+				"db.statement":       "SELECT * FROM users WHERE email = '<email>'",
+				ochttp.PathAttribute: "/search?q=secret&page=2",
+			},
+			wantAnnotation: "lookup of alice@example.com",
+			wantLinkAttrs:  map[string]interface{}{"user.email": "alice@example.com"},
+		},
+		{
+			name:      "redact annotations",
+			processor: RedactAnnotations(email, "<email>"),
+			wantAttrs: map[string]interface{}{
+				"user.email":         "alice@example.com",
+				"user.id":            int64(42),
+				"db.statement":       "SELECT * FROM users WHERE email = 'alice@example.com'",
+				ochttp.PathAttribute: "/search?q=secret&page=2",
+			},
+			wantAnnotation: "lookup of <email>",
+			wantLinkAttrs:  map[string]interface{}{"user.email": "alice@example.com"},
+		},
+		{
+			name:      "scrub query",
+			processor: ScrubHTTPPathQuery(),
+			wantAttrs: map[string]interface{}{
+				"user.email":         "alice@example.com",
+				"user.id":            int64(42),
+				"db.statement":       "SELECT * FROM users WHERE email = 'alice@example.com'",
+				ochttp.PathAttribute: "/search",
+			},
+			wantAnnotation: "lookup of alice@example.com",
+			wantLinkAttrs:  map[string]interface{}{"user.email": "alice@example.com"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := processorTestSpan()
+			got := processSpan(s, []SpanProcessor{tt.processor})
+			if got == nil {
+				t.Fatal("processSpan() dropped the span")
+			}
+			if !reflect.DeepEqual(got.Attributes, tt.wantAttrs) {
+				t.Errorf("Attributes = %v; want %v", got.Attributes, tt.wantAttrs)
+			}
+			if got.Annotations[0].Message != tt.wantAnnotation {
+				t.Errorf("Annotation = %q; want %q", got.Annotations[0].Message, tt.wantAnnotation)
+			}
+			if !reflect.DeepEqual(got.Links[0].Attributes, tt.wantLinkAttrs) {
+				t.Errorf("Link attributes = %v; want %v", got.Links[0].Attributes, tt.wantLinkAttrs)
+			}
+			if !reflect.DeepEqual(s, processorTestSpan()) {
+				t.Errorf("processSpan() modified the original span: %+v", s)
+			}
+		})
+	}
+}
+
+func TestSpanProcessorsExport(t *testing.T) {
+	e := newTraceExporterWithClient(Options{
+		Context: context.Background(),
+		Timeout: 10 * time.Millisecond,
+		SpanProcessors: []SpanProcessor{
+			func(s *trace.SpanData) bool { return s.Name != "health" },
+			DropAttributes("user.email"),
+		},
+	}, nil)
+	var got []*tracepb.Span
+	e.uploadFn = func(spans []*tracepb.Span) {
+		got = append(got, spans...)
+	}
+	e.ExportSpan(&trace.SpanData{Name: "health"})
+	e.ExportSpan(processorTestSpan())
+	e.Flush()
+
+	if len(got) != 1 {
+		t.Fatalf("uploaded %d spans; want 1", len(got))
+	}
+	if got[0].DisplayName.Value != "span" {
+		t.Errorf("uploaded span %q; want %q", got[0].DisplayName.Value, "span")
+	}
+	if _, ok := got[0].Attributes.AttributeMap["user.email"]; ok {
+		t.Error("user.email attribute was uploaded")
+	}
+}
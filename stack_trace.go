@@ -0,0 +1,378 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"fmt"
+	"hash/fnv"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/trace/apiv2/tracepb"
+	"go.opencensus.io/trace"
+	"google.golang.org/protobuf/proto"
+)
+
+// StackTraceAttribute is the key of the span or annotation attribute holding
+// a stack trace, as formatted by runtime/debug.Stack. When
+// Options.StackTraces is set, the attribute is removed from the span and
+// uploaded as the stack trace of the span instead.
+const StackTraceAttribute = "/stacktrace"
+
+const defaultMaxStackFrames = 64
+
+// StackTraceOptions controls how stack traces are attached to the spans
+// uploaded to Stackdriver Trace.
+//
+// The stack trace of a span is read from its StackTraceAttribute attribute,
+// or from the one of its first annotation having it. Spans without one can
+// have the stack of the goroutine ending them captured.
+type StackTraceOptions struct {
+	// CaptureOnError captures the stack trace of the spans ended with a
+	// status other than OK, if they do not already have one.
+	CaptureOnError bool
+
+	// Capture, if set, is called when a span without stack trace is
+	// ended, and the stack trace is captured if it returns true.
+	// It replaces CaptureOnError.
+	Capture func(s *trace.SpanData) bool
+
+	// MaxFrames is the maximum number of frames of a stack trace; the
+	// innermost frames are kept. If unset, a default of 64 is used.
+	MaxFrames int
+}
+
+// StackTrace returns a span attribute holding the stack trace of the calling
+// goroutine, to be uploaded as the stack trace of the span when
+// Options.StackTraces is set. skip is the number of additional callers to
+// skip; 0 starts the stack trace with the caller of StackTrace.
+func StackTrace(skip int) trace.Attribute {
+	return trace.StringAttribute(StackTraceAttribute, captureStack(skip+1))
+}
+
+// captureStack formats the stack of the calling goroutine like debug.Stack,
+// without function arguments and program counter offsets. skip is the number
+// of callers to skip; 0 starts with the caller of captureStack.
+func captureStack(skip int) string {
+	pcs := make([]uintptr, 128)
+	pcs = pcs[:runtime.Callers(skip+2, pcs)]
+	var b strings.Builder
+	frames := runtime.CallersFrames(pcs)
+	for {
+		f, more := frames.Next()
+		if f.Function != "" {
+			fmt.Fprintf(&b, "%s(...)\n\t%s:%d\n", f.Function, f.File, f.Line)
+		}
+		if !more {
+			break
+		}
+	}
+	return b.String()
+}
+
+// stackFrame is a frame of a stack trace.
+type stackFrame struct {
+	function string
+	file     string
+	line     int64
+}
+
+// parseStack parses stack traces formatted by debug.Stack, or found in the
+// goroutine dumps of panics.
+func parseStack(s string) []stackFrame {
+	var frames []stackFrame
+	lines := strings.Split(s, "\n")
+	for i := 0; i < len(lines); i++ {
+		fn := strings.TrimSpace(lines[i])
+		if fn == "" || strings.HasPrefix(fn, "goroutine ") || strings.HasPrefix(lines[i], "\t") {
+			continue
+		}
+		if strings.HasPrefix(fn, "created by ") {
+			fn = strings.TrimPrefix(fn, "created by ")
+			if j := strings.Index(fn, " in goroutine "); j >= 0 {
+				fn = fn[:j]
+			}
+		} else if j := strings.LastIndexByte(fn, '('); j > 0 && strings.HasSuffix(fn, ")") {
+			fn = fn[:j]
+		}
+		f := stackFrame{function: fn}
+		if i+1 < len(lines) && strings.HasPrefix(lines[i+1], "\t") {
+			i++
+			loc := strings.TrimSpace(lines[i])
+			if j := strings.IndexByte(loc, ' '); j >= 0 {
+				loc = loc[:j]
+			}
+			f.file = loc
+			if j := strings.LastIndexByte(loc, ':'); j >= 0 {
+				if n, err := strconv.ParseInt(loc[j+1:], 10, 64); err == nil {
+					f.file, f.line = loc[:j], n
+				}
+			}
+		}
+		frames = append(frames, f)
+	}
+	return frames
+}
+
+// stackTraces captures and converts the stack traces of spans.
+type stackTraces struct {
+	o StackTraceOptions
+}
+
+func newStackTraces(o StackTraceOptions) *stackTraces {
+	if o.MaxFrames <= 0 {
+		o.MaxFrames = defaultMaxStackFrames
+	}
+	if o.Capture == nil && o.CaptureOnError {
+		o.Capture = func(s *trace.SpanData) bool { return s.Code != trace.StatusCodeOK }
+	}
+	return &stackTraces{o: o}
+}
+
+// capture returns a copy of s with the stack trace of the calling goroutine,
+// if s has none and the options require one. Otherwise s is returned.
+func (st *stackTraces) capture(s *trace.SpanData) *trace.SpanData {
+	if st.o.Capture == nil || hasStackTrace(s) || !st.o.Capture(s) {
+		return s
+	}
+	c := *s
+	c.Attributes = copyAttributeMap(s.Attributes)
+	if c.Attributes == nil {
+		c.Attributes = make(map[string]interface{})
+	}
+	c.Attributes[StackTraceAttribute] = trimExporterFrames(captureStack(1))
+	return &c
+}
+
+// trimExporterFrames removes the leading frames of the exporter and of the
+// trace package from a stack captured by captureStack, so that it starts
+// where the span was ended.
+func trimExporterFrames(stack string) string {
+	for {
+		if !strings.HasPrefix(stack, "contrib.go.opencensus.io/exporter/stackdriver.(*traceExporter).") &&
+			!strings.HasPrefix(stack, "contrib.go.opencensus.io/exporter/stackdriver.(*Exporter).") &&
+			!strings.HasPrefix(stack, "go.opencensus.io/trace.") {
+			return stack
+		}
+		// Skip the function and location lines of the frame.
+		for n := 0; n < 2; n++ {
+			i := strings.IndexByte(stack, '\n')
+			if i < 0 {
+				return ""
+			}
+			stack = stack[i+1:]
+		}
+	}
+}
+
+func hasStackTrace(s *trace.SpanData) bool {
+	if _, ok := s.Attributes[StackTraceAttribute]; ok {
+		return true
+	}
+	for _, a := range s.Annotations {
+		if _, ok := a.Attributes[StackTraceAttribute]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// extract removes the stack trace attribute from s, and returns the span
+// without it along with the converted stack trace. s is returned as is, and
+// the stack trace is nil, if s has no stack trace.
+func (st *stackTraces) extract(s *trace.SpanData) (*trace.SpanData, *tracepb.StackTrace) {
+	if !hasStackTrace(s) {
+		return s, nil
+	}
+	c := copySpanData(s)
+	var stack string
+	if v, ok := c.Attributes[StackTraceAttribute].(string); ok {
+		stack = v
+	}
+	delete(c.Attributes, StackTraceAttribute)
+	for _, a := range c.Annotations {
+		if v, ok := a.Attributes[StackTraceAttribute].(string); ok && stack == "" {
+			stack = v
+		}
+		delete(a.Attributes, StackTraceAttribute)
+	}
+	frames := parseStack(stack)
+	if len(frames) == 0 {
+		return c, nil
+	}
+	return c, st.convert(frames)
+}
+
+// convert returns the stack trace made of frames.
+func (st *stackTraces) convert(frames []stackFrame) *tracepb.StackTrace {
+	dropped := 0
+	if len(frames) > st.o.MaxFrames {
+		dropped = len(frames) - st.o.MaxFrames
+		frames = frames[:st.o.MaxFrames]
+	}
+	pbFrames := make([]*tracepb.StackTrace_StackFrame, len(frames))
+	for i, f := range frames {
+		pbFrames[i] = &tracepb.StackTrace_StackFrame{
+			FunctionName: trunc(f.function, maxAttributeStringValue),
+			FileName:     trunc(f.file, maxAttributeStringValue),
+			LineNumber:   f.line,
+			LoadModule:   moduleOf(f.function),
+		}
+	}
+	return &tracepb.StackTrace{
+		StackFrames: &tracepb.StackTrace_StackFrames{
+			Frame:              pbFrames,
+			DroppedFramesCount: clip32(dropped),
+		},
+		StackTraceHashId: stackHash(frames),
+	}
+}
+
+// dedupStackTraces returns spans, to be uploaded in one request, where the
+// stack traces repeated within a trace only refer to their hash id: as
+// Stackdriver Trace allows, their frames are only sent with the first span
+// of the request having them. The spans changed are copies.
+func dedupStackTraces(spans []*tracepb.Span) []*tracepb.Span {
+	type key struct {
+		trace string
+		hash  int64
+	}
+	var seen map[key]bool
+	var out []*tracepb.Span
+	for i, s := range spans {
+		hash := s.GetStackTrace().GetStackTraceHashId()
+		if hash == 0 || s.StackTrace.StackFrames == nil {
+			continue
+		}
+		k := key{trace: spanTraceName(s.Name), hash: hash}
+		if !seen[k] {
+			if seen == nil {
+				seen = make(map[key]bool)
+			}
+			seen[k] = true
+			continue
+		}
+		if out == nil {
+			out = append([]*tracepb.Span(nil), spans...)
+		}
+		c := proto.Clone(s).(*tracepb.Span)
+		c.StackTrace = &tracepb.StackTrace{StackTraceHashId: hash}
+		out[i] = c
+	}
+	if out == nil {
+		return spans
+	}
+	return out
+}
+
+// spanTraceName returns the resource name of the trace of a span, from the
+// name of the span: "projects/[PROJECT_ID]/traces/[TRACE_ID]".
+func spanTraceName(name string) string {
+	if i := strings.LastIndex(name, "/spans/"); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// stackHash returns a non-zero hash of frames.
+func stackHash(frames []stackFrame) int64 {
+	h := fnv.New64a()
+	for _, f := range frames {
+		fmt.Fprintf(h, "%s\x00%s\x00%d\n", f.function, f.file, f.line)
+	}
+	if sum := int64(h.Sum64()); sum != 0 {
+		return sum
+	}
+	return 1
+}
+
+type goModule struct {
+	path, version string
+}
+
+var (
+	modulesOnce sync.Once
+	// mainModule is the module of the main package of the binary.
+	mainModule *goModule
+	// modules are the modules of the binary, longest paths first.
+	modules []goModule
+)
+
+// moduleOf returns the module defining the function, as named in stack
+// traces, or nil if it is unknown.
+func moduleOf(function string) *tracepb.Module {
+	modulesOnce.Do(loadModules)
+
+	pkg := function
+	slash := strings.LastIndexByte(pkg, '/')
+	if i := strings.IndexByte(pkg[slash+1:], '.'); i >= 0 {
+		pkg = pkg[:slash+1+i]
+	}
+	if pkg == "main" {
+		if mainModule == nil {
+			return nil
+		}
+		return moduleProto(*mainModule)
+	}
+	if first := strings.SplitN(pkg, "/", 2)[0]; !strings.Contains(first, ".") {
+		// Only the packages of the standard library have no dot in their
+		// first path element.
+		return moduleProto(goModule{path: "std", version: runtime.Version()})
+	}
+	for _, m := range modules {
+		if pkg == m.path || strings.HasPrefix(pkg, m.path+"/") {
+			return moduleProto(m)
+		}
+	}
+	return nil
+}
+
+// loadModules reads the modules of the binary from its build information.
+// The version of the main module is its VCS revision, if it is known.
+func loadModules() {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	main := goModule{path: bi.Main.Path, version: bi.Main.Version}
+	for _, s := range bi.Settings {
+		if s.Key == "vcs.revision" {
+			main.version = s.Value
+		}
+	}
+	mainModule = &main
+	if main.path != "" {
+		modules = append(modules, main)
+	}
+	for _, d := range bi.Deps {
+		m := goModule{path: d.Path, version: d.Version}
+		if d.Replace != nil && d.Replace.Version != "" {
+			m.version = d.Replace.Version
+		}
+		modules = append(modules, m)
+	}
+	sort.Slice(modules, func(i, j int) bool { return len(modules[i].path) > len(modules[j].path) })
+}
+
+func moduleProto(m goModule) *tracepb.Module {
+	return &tracepb.Module{
+		Module:  trunc(m.path, maxAttributeStringValue),
+		BuildId: trunc(m.version, maxAttributeStringValue),
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"runtime/debug"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/trace/apiv2/tracepb"
+	"go.opencensus.io/trace"
+)
+
+func TestParseStack(t *testing.T) {
+	stack := `goroutine 7 [running]:
+runtime/debug.Stack()
+	/usr/local/go/src/runtime/debug/stack.go:24 +0x5e
+example.com/app/handlers.(*Server).serve(0xc000010000, {0x6f1e40, 0xc00001c0a0})
+	/src/app/handlers/server.go:42 +0x1d
+created by example.com/app.main in goroutine 1
+	/src/app/main.go:12 +0x8a
+`
+	want := []stackFrame{
+		{"runtime/debug.Stack", "/usr/local/go/src/runtime/debug/stack.go", 24},
+		{"example.com/app/handlers.(*Server).serve", "/src/app/handlers/server.go", 42},
+		{"example.com/app.main", "/src/app/main.go", 12},
+	}
+	if got := parseStack(stack); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseStack() = %v; want %v", got, want)
+	}
+	if frames := parseStack(string(debug.Stack())); len(frames) == 0 || frames[0].function != "runtime/debug.Stack" {
+		t.Errorf("parseStack(debug.Stack()) = %v", frames)
+	}
+}
+
+func TestStackTraceDedup(t *testing.T) {
+	st := newStackTraces(StackTraceOptions{MaxFrames: 1})
+	attr := StackTrace(0)
+	span := func(traceID byte) *trace.SpanData {
+		return &trace.SpanData{
+			SpanContext: trace.SpanContext{TraceID: trace.TraceID{traceID}},
+			Attributes:  map[string]interface{}{attr.Key(): attr.Value(), "k": "v"},
+		}
+	}
+
+	s, first := st.extract(span(1))
+	if _, ok := s.Attributes[StackTraceAttribute]; ok {
+		t.Error("stack trace attribute not removed")
+	}
+	if len(s.Attributes) != 1 {
+		t.Errorf("Attributes = %v; want only k", s.Attributes)
+	}
+	frames := first.GetStackFrames().GetFrame()
+	if len(frames) != 1 || !strings.HasSuffix(frames[0].FunctionName.Value, ".TestStackTraceDedup") {
+		t.Fatalf("frames = %v; want TestStackTraceDedup", frames)
+	}
+	if first.StackFrames.DroppedFramesCount == 0 {
+		t.Error("DroppedFramesCount = 0; want the frames beyond MaxFrames")
+	}
+	if got := frames[0].LoadModule.GetModule().GetValue(); got != "contrib.go.opencensus.io/exporter/stackdriver" {
+		t.Errorf("module = %q", got)
+	}
+	if first.StackTraceHashId == 0 {
+		t.Error("StackTraceHashId not set")
+	}
+
+	_, again := st.extract(span(1))
+	if again.StackFrames == nil {
+		t.Error("stack trace converted without frames")
+	}
+
+	pbSpan := func(traceID, spanID byte, stack *tracepb.StackTrace) *tracepb.Span {
+		return &tracepb.Span{
+			Name:       fmt.Sprintf("projects/foo/traces/%032x/spans/%016x", traceID, spanID),
+			StackTrace: stack,
+		}
+	}
+	spans := []*tracepb.Span{
+		pbSpan(1, 1, first),
+		pbSpan(1, 2, again),
+		pbSpan(2, 3, again),
+		pbSpan(1, 4, nil),
+	}
+	got := dedupStackTraces(spans)
+	if got[0].StackTrace.StackFrames == nil {
+		t.Error("first stack trace of the request sent without frames")
+	}
+	if got := got[1].StackTrace; got.StackFrames != nil || got.StackTraceHashId != first.StackTraceHashId {
+		t.Errorf("repeated stack trace = %v; want only the hash id", got)
+	}
+	if got[2].StackTrace.StackFrames == nil {
+		t.Error("stack trace of another trace sent without frames")
+	}
+	if got[3].StackTrace != nil {
+		t.Errorf("stack trace = %v; want none", got[3].StackTrace)
+	}
+	if spans[1].StackTrace.StackFrames == nil {
+		t.Error("dedupStackTraces() changed its input")
+	}
+	// The next request sends the frames again.
+	if got := dedupStackTraces(spans[1:2]); got[0].StackTrace.StackFrames == nil {
+		t.Error("stack trace of a new request sent without frames")
+	}
+}
+
+func TestModuleOf(t *testing.T) {
+	if got := moduleOf("net/http.(*Server).Serve").Module.Value; got != "std" {
+		t.Errorf("module of net/http = %q; want std", got)
+	}
+	if got := moduleOf("go.opencensus.io/trace.StartSpan").Module.Value; got != "go.opencensus.io" {
+		t.Errorf("module of go.opencensus.io/trace = %q", got)
+	}
+	if got := moduleOf("example.com/unknown.F"); got != nil {
+		t.Errorf("module of unknown function = %v; want nil", got)
+	}
+}
+
+func TestStackTraceCaptureOnError(t *testing.T) {
+	e := newTraceExporterWithClient(Options{
+		Context:     context.Background(),
+		Timeout:     10 * time.Millisecond,
+		StackTraces: &StackTraceOptions{CaptureOnError: true},
+	}, nil)
+	var got []*tracepb.Span
+	e.uploadFn = func(spans []*tracepb.Span) {
+		got = append(got, spans...)
+	}
+	e.ExportSpan(&trace.SpanData{Name: "ok"})
+	e.ExportSpan(&trace.SpanData{Name: "failed", Status: trace.Status{Code: trace.StatusCodeInternal}})
+	e.Flush()
+
+	if len(got) != 2 {
+		t.Fatalf("uploaded %d spans; want 2", len(got))
+	}
+	if got[0].StackTrace != nil {
+		t.Errorf("stack trace captured for OK span: %v", got[0].StackTrace)
+	}
+	frames := got[1].StackTrace.GetStackFrames().GetFrame()
+	if len(frames) == 0 || !strings.HasSuffix(frames[0].FunctionName.Value, ".TestStackTraceCaptureOnError") {
+		t.Errorf("frames = %v; want to start with the test", frames)
+	}
+	if _, ok := got[1].Attributes.AttributeMap[StackTraceAttribute]; ok {
+		t.Error("stack trace uploaded as attribute")
+	}
+}
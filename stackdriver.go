@@ -55,6 +55,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	metadataapi "cloud.google.com/go/compute/metadata"
@@ -76,6 +77,7 @@ import (
 	metricspb "github.com/census-instrumentation/opencensus-proto/gen-go/metrics/v1"
 	resourcepb "github.com/census-instrumentation/opencensus-proto/gen-go/resource/v1"
 	"go.opencensus.io/metric/metricdata"
+	"go.opencensus.io/metric/metricproducer"
 )
 
 // Options contains options for configuring the exporter.
@@ -101,6 +103,7 @@ type Options struct {
 
 	// OnError is the hook to be called when there is
 	// an error uploading the stats or tracing data.
+	// Upload failures are reported as *ExportError values.
 	// If no custom hook is set, errors are logged.
 	// Optional.
 	OnError func(err error)
@@ -115,6 +118,12 @@ type Options struct {
 	// Optional.
 	TraceClientOptions []option.ClientOption
 
+	// LoggingClientOptions are additional options to be passed
+	// to the underlying Stackdriver Logging API client created by
+	// logging.NewExporterFrom.
+	// Optional.
+	LoggingClientOptions []option.ClientOption
+
 	// BundleDelayThreshold determines the max amount of time
 	// the exporter can wait before uploading view data or trace spans to
 	// the backend.
@@ -126,12 +135,52 @@ type Options struct {
 	// Optional.
 	BundleCountThreshold int
 
+	// TraceBundleOptions, ViewDataBundleOptions and MetricsBundleOptions
+	// configure the batching of spans, view data and metrics. Their unset
+	// fields default to the options above. See BundleOptions.
+	TraceBundleOptions    BundleOptions
+	ViewDataBundleOptions BundleOptions
+	MetricsBundleOptions  BundleOptions
+
+	// OverflowPolicy selects what happens to the spans, view data and
+	// metrics exported while the buffer of their bundler is full. By
+	// default, they are dropped. See OverflowPolicy.
+	OverflowPolicy OverflowPolicy
+
+	// OverflowBlockTimeout is the maximum time an export call blocks with
+	// OverflowBlock. If unset, a default of 10s is used.
+	OverflowBlockTimeout time.Duration
+
 	// TraceSpansBufferMaxBytes is the maximum size (in bytes) of spans that
 	// will be buffered in memory before being dropped.
 	//
-	// If unset, a default of 8MB will be used.
+	// If unset, a default of 8MB will be used. It is overridden by
+	// TraceBundleOptions.BufferedByteLimit.
 	TraceSpansBufferMaxBytes int
 
+	// TraceLimits controls how spans exceeding the limits of Stackdriver
+	// Trace are trimmed. If unset, the default limits are used.
+	TraceLimits TraceLimits
+
+	// TailSampling, if set, holds the spans exported through ExportSpan for
+	// a while and only uploads the traces selected by its policies.
+	// See TailSamplingOptions.
+	TailSampling *TailSamplingOptions
+
+	// StackTraces, if set, uploads the stack traces held by the
+	// StackTraceAttribute attribute of spans as their Stackdriver Trace
+	// stack traces, and can capture the ones of spans ending with errors.
+	// See StackTraceOptions.
+	StackTraces *StackTraceOptions
+
+	// SpanMetrics, if set, derives request count, error count and latency
+	// metrics from the spans exported through ExportSpan. Their producer,
+	// returned by Exporter.SpanMetricsProducer, is registered with the
+	// global metric producer manager until the exporter is closed, so that
+	// the metrics are exported by StartMetricsExporter.
+	// See SpanMetricsOptions.
+	SpanMetrics *SpanMetricsOptions
+
 	// Resource sets the MonitoredResource against which all views will be
 	// recorded by this exporter.
 	//
@@ -216,10 +265,34 @@ type Options struct {
 	// See: https://cloud.google.com/monitoring/api/ref_v3/rest/v3/projects.metricDescriptors#MetricDescriptor
 	GetMetricPrefix func(name string) string
 
+	// GetSummaryMetricName allows customizing the names of the metrics a
+	// summary metric is exported as, one for each SummaryPart. By default,
+	// DefaultSummaryMetricName is used.
+	GetSummaryMetricName func(name string, part SummaryPart) string
+
 	// DefaultTraceAttributes will be appended to every span that is exported to
 	// Stackdriver Trace.
 	DefaultTraceAttributes map[string]interface{}
 
+	// SpanProcessors are applied in order to every span before it is
+	// uploaded to Stackdriver Trace, after DefaultTraceAttributes are added.
+	// They can be used to remove or redact sensitive data.
+	// See SpanProcessor.
+	SpanProcessors []SpanProcessor
+
+	// AttributeConverter, if set, converts the values of span attributes
+	// before they are uploaded to Stackdriver Trace, after SpanProcessors
+	// are applied. See AttributeConverter.
+	AttributeConverter AttributeConverter
+
+	// GetSpanDisplayName allows customizing the display name of the spans
+	// uploaded to Stackdriver Trace. By default, the names of client and
+	// server spans are prefixed with "Sent." and "Recv.", as done by
+	// PrefixedSpanDisplayName. UnprefixedSpanDisplayName keeps span names
+	// unchanged, and HTTPRouteSpanDisplayName names HTTP spans after their
+	// method and route.
+	GetSpanDisplayName func(s *trace.SpanData) string
+
 	// DefaultMonitoringLabels are labels added to every metric created by this
 	// exporter in Stackdriver Monitoring.
 	//
@@ -255,9 +328,44 @@ type Options struct {
 	// or the unit is not important.
 	SkipCMD bool
 
+	// DescriptorReconciliation controls how the metric descriptors that
+	// already exist in Stackdriver Monitoring are compared with the ones
+	// the exporter would create. If unset, existing descriptors are not
+	// checked. See DescriptorReconciliation.
+	DescriptorReconciliation DescriptorReconciliation
+
+	// CompactBucketOptions, if true, sends the bucket bounds of the
+	// distributions that form a linear or exponential sequence as linear or
+	// exponential bucket options instead of explicit bounds, which shrinks
+	// the requests. With exponential bounds, the bucket below the first
+	// bound holds all the values below it, including the negative ones.
+	CompactBucketOptions bool
+
+	// DistributionRange, if true, sets the range of the exported
+	// distributions to the minimum and maximum of their values. Only the
+	// view data exported through ExportView carries them; the distributions
+	// of metrics only get a range when all their values are equal.
+	DistributionRange bool
+
+	// Cumulative, if set, keeps state for each cumulative time series
+	// exported through ExportMetrics and PushMetricsProto, to convert the
+	// metrics holding deltas into cumulative series and to start a new
+	// interval when a series is reset. See CumulativeOptions.
+	Cumulative *CumulativeOptions
+
 	// Timeout for all API calls. If not set, defaults to 12 seconds.
 	Timeout time.Duration
 
+	// RetryPolicy configures the retries of failed CreateTimeSeries,
+	// CreateMetricDescriptor and BatchWriteSpans calls.
+	// If unset, failed calls are not retried.
+	RetryPolicy *RetryPolicy
+
+	// DiskQueue, if set, keeps the spans and time series that could not be
+	// uploaded in a queue on disk, so that they survive network outages and
+	// restarts. See DiskQueueOptions.
+	DiskQueue *DiskQueueOptions
+
 	// ReportingInterval sets the interval between reporting metrics.
 	// If it is set to zero then default value is used.
 	ReportingInterval time.Duration
@@ -303,6 +411,9 @@ var defaultUserAgent = fmt.Sprintf("opencensus-go %s; stackdriver-exporter %s",
 type Exporter struct {
 	traceExporter *traceExporter
 	statsExporter *statsExporter
+
+	closeOnce sync.Once
+	closeErr  error
 }
 
 // NewExporter creates a new Exporter that implements both stats.Exporter and
@@ -376,14 +487,24 @@ func NewExporter(o Options) (*Exporter, error) {
 		o.UserAgent = defaultUserAgent
 	}
 
+	if err := o.validateBundleOptions(); err != nil {
+		return nil, err
+	}
+
 	se, err := newStatsExporter(o)
 	if err != nil {
 		return nil, err
 	}
-	te, err := newTraceExporter(o)
+	te, err := newTraceExporter(o, se.sm)
 	if err != nil {
+		// The client of se may be owned by the caller, through
+		// option.WithGRPCConn, and is left open.
+		se.stop()
 		return nil, err
 	}
+	if te.spanMetrics != nil {
+		metricproducer.GlobalManager().AddProducer(te.spanMetrics)
+	}
 	return &Exporter{
 		statsExporter: se,
 		traceExporter: te,
@@ -440,9 +561,57 @@ func (e *Exporter) StopMetricsExporter() {
 	e.statsExporter.stopMetricsReader()
 }
 
-// Close closes client connections.
+// SelfMetricsProducer returns a producer of metrics describing the health of
+// the exporter: the number of spans and time series it exported or dropped,
+// the metric descriptors it created, the latency of its API calls and the
+// number of items waiting in its queues.
+//
+// The metrics are only exported if the producer is registered, for example with
+//
+//	metricproducer.GlobalManager().AddProducer(exporter.SelfMetricsProducer())
+func (e *Exporter) SelfMetricsProducer() metricproducer.Producer {
+	return e.statsExporter.sm
+}
+
+// SpanMetricsProducer returns a producer of the metrics derived from spans
+// if Options.SpanMetrics is set: the number of spans, the number of spans
+// with errors and their latency, per span name, kind and status.
+//
+// The producer is registered with metricproducer.GlobalManager until e is
+// closed. It returns nil if Options.SpanMetrics is not set.
+func (e *Exporter) SpanMetricsProducer() metricproducer.Producer {
+	if e.traceExporter.spanMetrics == nil {
+		return nil
+	}
+	return e.traceExporter.spanMetrics
+}
+
+// Options returns the options of e, including the project ID and the
+// monitored resource detected by NewExporter.
+func (e *Exporter) Options() Options {
+	return e.traceExporter.o
+}
+
+// Close closes client connections. Only the first call closes them; the
+// next ones return the same error.
 func (e *Exporter) Close() error {
-	tErr := e.traceExporter.close()
+	return e.closeContext(context.Background())
+}
+
+// closeContext closes e like Close, and stops waiting for the last uploads
+// when ctx is done.
+func (e *Exporter) closeContext(ctx context.Context) error {
+	e.closeOnce.Do(func() {
+		e.closeErr = e.close(ctx)
+	})
+	return e.closeErr
+}
+
+func (e *Exporter) close(ctx context.Context) error {
+	if e.traceExporter.spanMetrics != nil {
+		metricproducer.GlobalManager().DeleteProducer(e.traceExporter.spanMetrics)
+	}
+	tErr := e.traceExporter.close(ctx)
 	mErr := e.statsExporter.close()
 	// If the trace and stats exporter share client connections,
 	// closing the stats exporter will return an error indicating
@@ -0,0 +1,324 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdrivertest_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opencensus.io/metric/metricdata"
+	"go.opencensus.io/metric/metricproducer"
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"contrib.go.opencensus.io/exporter/stackdriver"
+	"contrib.go.opencensus.io/exporter/stackdriver/stackdrivertest"
+)
+
+func TestExporter(t *testing.T) {
+	srv, err := stackdrivertest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	var mu sync.Mutex
+	var errs []error
+	exporter, err := stackdriver.NewExporter(stackdriver.Options{
+		ProjectID:               "test-project",
+		MonitoringClientOptions: srv.ClientOptions(),
+		TraceClientOptions:      srv.ClientOptions(),
+		OnError: func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			errs = append(errs, err)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	metric := &metricdata.Metric{
+		Descriptor: metricdata.Descriptor{
+			Name:      "requests",
+			Type:      metricdata.TypeCumulativeInt64,
+			LabelKeys: []metricdata.LabelKey{{Key: "method"}},
+		},
+		TimeSeries: []*metricdata.TimeSeries{{
+			LabelValues: []metricdata.LabelValue{metricdata.NewLabelValue("GET")},
+			Points:      []metricdata.Point{metricdata.NewInt64Point(now, 3)},
+			StartTime:   now.Add(-time.Minute),
+		}},
+	}
+	if err := exporter.ExportMetrics(context.Background(), []*metricdata.Metric{metric}); err != nil {
+		t.Fatal(err)
+	}
+
+	trace.RegisterExporter(exporter)
+	_, span := trace.StartSpan(context.Background(), "span", trace.WithSampler(trace.AlwaysSample()))
+	span.End()
+	trace.UnregisterExporter(exporter)
+	exporter.Flush()
+
+	mu.Lock()
+	if len(errs) != 0 {
+		t.Errorf("OnError called with %v", errs)
+	}
+	mu.Unlock()
+	if got := srv.MetricDescriptor("custom.googleapis.com/opencensus/requests"); got == nil {
+		t.Error("metric descriptor not created")
+	}
+	if got := srv.TimeSeries(); len(got) != 1 {
+		t.Errorf("TimeSeries() = %v; want one time series", got)
+	}
+	if got := srv.Spans(); len(got) != 1 || got[0].GetDisplayName().GetValue() != "span" {
+		t.Errorf("Spans() = %v; want the exported span", got)
+	}
+
+	srv.InjectError(stackdrivertest.MethodCreateTimeSeries, status.Error(codes.PermissionDenied, "denied"))
+	metric.TimeSeries[0].Points[0] = metricdata.NewInt64Point(now.Add(time.Second), 4)
+	if err := exporter.ExportMetrics(context.Background(), []*metricdata.Metric{metric}); err != nil {
+		t.Fatal(err)
+	}
+	exporter.Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(errs) != 1 {
+		t.Fatalf("OnError called with %v; want one error", errs)
+	}
+	var exportErr *stackdriver.ExportError
+	if !errors.As(errs[0], &exportErr) || exportErr.Code != codes.PermissionDenied {
+		t.Errorf("OnError called with %#v; want a PermissionDenied *ExportError", errs[0])
+	}
+}
+
+func TestExporterShutdown(t *testing.T) {
+	srv, err := stackdrivertest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	exporter, err := stackdriver.NewExporter(stackdriver.Options{
+		ProjectID:               "test-project",
+		MonitoringClientOptions: srv.ClientOptions(),
+		TraceClientOptions:      srv.ClientOptions(),
+		BundleDelayThreshold:    time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	metric := &metricdata.Metric{
+		Descriptor: metricdata.Descriptor{Name: "requests", Type: metricdata.TypeCumulativeInt64},
+		TimeSeries: []*metricdata.TimeSeries{{
+			Points:    []metricdata.Point{metricdata.NewInt64Point(now, 3)},
+			StartTime: now.Add(-time.Minute),
+		}},
+	}
+	if err := exporter.ExportMetrics(context.Background(), []*metricdata.Metric{metric}); err != nil {
+		t.Fatal(err)
+	}
+	exporter.ExportSpan(&trace.SpanData{Name: "span", StartTime: now, EndTime: now})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	report, err := exporter.Shutdown(ctx)
+	if err != nil {
+		t.Fatalf("Shutdown() = %v", err)
+	}
+	want := stackdriver.ShutdownReport{SpansExported: 1, TimeSeriesSent: 1}
+	if report != want {
+		t.Errorf("Shutdown() report = %v; want %v", report, want)
+	}
+	if len(srv.Spans()) != 1 || len(srv.TimeSeries()) != 1 {
+		t.Errorf("server got %d spans and %d time series; want 1 and 1", len(srv.Spans()), len(srv.TimeSeries()))
+	}
+	if err := exporter.Close(); err != nil {
+		t.Errorf("Close() after Shutdown() = %v", err)
+	}
+}
+
+func TestExporterCloseTailSampling(t *testing.T) {
+	srv, err := stackdrivertest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	exporter, err := stackdriver.NewExporter(stackdriver.Options{
+		ProjectID:               "test-project",
+		MonitoringClientOptions: srv.ClientOptions(),
+		TraceClientOptions:      srv.ClientOptions(),
+		BundleDelayThreshold:    time.Hour,
+		TailSampling:            &stackdriver.TailSamplingOptions{DecisionWait: time.Hour},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	exporter.ExportSpan(&trace.SpanData{Name: "span", StartTime: now, EndTime: now})
+	if err := exporter.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	if got := len(srv.Spans()); got != 1 {
+		t.Errorf("server got %d spans; want the tail sampled span", got)
+	}
+}
+
+func TestExporterShutdownDeadlineTailSampling(t *testing.T) {
+	srv, err := stackdrivertest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.SetLatency(stackdrivertest.MethodCreateTimeSeries, time.Minute)
+	srv.SetLatency(stackdrivertest.MethodBatchWriteSpans, time.Minute)
+
+	exporter, err := stackdriver.NewExporter(stackdriver.Options{
+		ProjectID:               "test-project",
+		MonitoringClientOptions: srv.ClientOptions(),
+		TraceClientOptions:      srv.ClientOptions(),
+		BundleDelayThreshold:    time.Hour,
+		SkipCMD:                 true,
+		TailSampling:            &stackdriver.TailSamplingOptions{DecisionWait: time.Hour},
+		OnError:                 func(error) {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The upload of the metric holds the flush of Shutdown until its
+	// deadline, so that the span is still held by the tail sampler when
+	// the exporter is closed.
+	now := time.Now()
+	metric := &metricdata.Metric{
+		Descriptor: metricdata.Descriptor{Name: "requests", Type: metricdata.TypeCumulativeInt64},
+		TimeSeries: []*metricdata.TimeSeries{{
+			Points:    []metricdata.Point{metricdata.NewInt64Point(now, 3)},
+			StartTime: now.Add(-time.Minute),
+		}},
+	}
+	if err := exporter.ExportMetrics(context.Background(), []*metricdata.Metric{metric}); err != nil {
+		t.Fatal(err)
+	}
+	exporter.ExportSpan(&trace.SpanData{Name: "span", StartTime: now, EndTime: now})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := exporter.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown() = %v; want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("Shutdown() returned after %v; want the deadline", d)
+	}
+}
+
+func TestExporterSpanMetricsProducer(t *testing.T) {
+	srv, err := stackdrivertest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	exporter, err := stackdriver.NewExporter(stackdriver.Options{
+		ProjectID:               "test-project",
+		MonitoringClientOptions: srv.ClientOptions(),
+		TraceClientOptions:      srv.ClientOptions(),
+		SpanMetrics:             &stackdriver.SpanMetricsOptions{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	registered := func() bool {
+		for _, p := range metricproducer.GlobalManager().GetAll() {
+			if p == exporter.SpanMetricsProducer() {
+				return true
+			}
+		}
+		return false
+	}
+	if !registered() {
+		t.Error("span metrics producer not registered by NewExporter")
+	}
+	if err := exporter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if registered() {
+		t.Error("span metrics producer still registered after Close")
+	}
+}
+
+func TestExporterSpanMetricsProducerDisabled(t *testing.T) {
+	srv, err := stackdrivertest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	exporter, err := stackdriver.NewExporter(stackdriver.Options{
+		ProjectID:               "test-project",
+		MonitoringClientOptions: srv.ClientOptions(),
+		TraceClientOptions:      srv.ClientOptions(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exporter.Close()
+	if p := exporter.SpanMetricsProducer(); p != nil {
+		t.Errorf("SpanMetricsProducer() = %#v; want nil", p)
+	}
+}
+
+func TestExporterShutdownDeadline(t *testing.T) {
+	srv, err := stackdrivertest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.SetLatency(stackdrivertest.MethodBatchWriteSpans, time.Minute)
+
+	exporter, err := stackdriver.NewExporter(stackdriver.Options{
+		ProjectID:               "test-project",
+		MonitoringClientOptions: srv.ClientOptions(),
+		TraceClientOptions:      srv.ClientOptions(),
+		BundleDelayThreshold:    time.Hour,
+		OnError:                 func(error) {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter.ExportSpan(&trace.SpanData{Name: "span"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	report, err := exporter.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Shutdown() = %v; want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("Shutdown() returned after %v; want the deadline", d)
+	}
+	if report.SpansExported != 0 || report.SpansPending != 1 {
+		t.Errorf("Shutdown() report = %v; want no exported span and 1 pending span", report)
+	}
+}
@@ -0,0 +1,423 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package stackdrivertest provides an in-process fake of the Stackdriver
+// Monitoring and Stackdriver Trace APIs, to test code using the exporter
+// without access to Google Cloud.
+//
+// The fake records the requests it receives and applies the main validation
+// rules of the real APIs, so that requests the real APIs would reject fail
+// in tests too:
+//
+//	srv, err := stackdrivertest.NewServer()
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer srv.Close()
+//	exporter, err := stackdriver.NewExporter(stackdriver.Options{
+//		ProjectID:               "test-project",
+//		MonitoringClientOptions: srv.ClientOptions(),
+//		TraceClientOptions:      srv.ClientOptions(),
+//	})
+package stackdrivertest // import "contrib.go.opencensus.io/exporter/stackdriver/stackdrivertest"
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	"cloud.google.com/go/trace/apiv2/tracepb"
+	"google.golang.org/api/option"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// Method identifies an API method implemented by the fake server.
+type Method string
+
+// Methods implemented by the fake server.
+const (
+	MethodCreateTimeSeries        Method = "CreateTimeSeries"
+	MethodCreateServiceTimeSeries Method = "CreateServiceTimeSeries"
+	MethodCreateMetricDescriptor  Method = "CreateMetricDescriptor"
+	MethodGetMetricDescriptor     Method = "GetMetricDescriptor"
+	MethodDeleteMetricDescriptor  Method = "DeleteMetricDescriptor"
+	MethodBatchWriteSpans         Method = "BatchWriteSpans"
+	MethodCreateSpan              Method = "CreateSpan"
+)
+
+// Server is a fake Stackdriver Monitoring (MetricService v3) and Stackdriver
+// Trace (TraceService v2) server listening on a loopback address.
+//
+// Metric descriptors created through the server are kept, so that time
+// series of user-defined metrics must be written after their descriptor is
+// created, as with the real API.
+type Server struct {
+	ln  net.Listener
+	srv *grpc.Server
+
+	mu                    sync.Mutex
+	descriptors           map[string]*metricpb.MetricDescriptor
+	descriptorReqs        []*monitoringpb.CreateMetricDescriptorRequest
+	timeSeriesReqs        []*monitoringpb.CreateTimeSeriesRequest
+	serviceTimeSeriesReqs []*monitoringpb.CreateTimeSeriesRequest
+	timeSeries            []*monitoringpb.TimeSeries
+	spanReqs              []*tracepb.BatchWriteSpansRequest
+	spans                 []*tracepb.Span
+	errs                  map[Method][]error
+	latencies             map[Method]time.Duration
+}
+
+// NewServer starts a fake server on a loopback address.
+func NewServer() (*Server, error) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return nil, fmt.Errorf("stackdrivertest: couldn't listen: %v", err)
+	}
+	s := &Server{
+		ln:          ln,
+		srv:         grpc.NewServer(),
+		descriptors: make(map[string]*metricpb.MetricDescriptor),
+		errs:        make(map[Method][]error),
+		latencies:   make(map[Method]time.Duration),
+	}
+	monitoringpb.RegisterMetricServiceServer(s.srv, &metricService{s: s})
+	tracepb.RegisterTraceServiceServer(s.srv, &traceService{s: s})
+	go func() {
+		_ = s.srv.Serve(ln)
+	}()
+	return s, nil
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// ClientOptions returns the options connecting a Stackdriver Monitoring or
+// Stackdriver Trace client to the server, to be used as the
+// MonitoringClientOptions and TraceClientOptions of the exporter.
+func (s *Server) ClientOptions() []option.ClientOption {
+	return []option.ClientOption{
+		option.WithEndpoint(s.Addr()),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+	}
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	s.srv.Stop()
+	_ = s.ln.Close()
+}
+
+// InjectError makes the next call to method fail with err, which should be
+// created with the status package. Errors injected several times for the
+// same method are returned by successive calls.
+//
+// The request of a call failing with an injected error is recorded, but not
+// applied.
+func (s *Server) InjectError(method Method, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errs[method] = append(s.errs[method], err)
+}
+
+// SetLatency delays the responses to method by d. A zero d removes the delay.
+func (s *Server) SetLatency(method Method, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latencies[method] = d
+}
+
+// Reset clears the recorded requests, metric descriptors, injected errors
+// and latencies.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.descriptors = make(map[string]*metricpb.MetricDescriptor)
+	s.descriptorReqs = nil
+	s.timeSeriesReqs = nil
+	s.serviceTimeSeriesReqs = nil
+	s.timeSeries = nil
+	s.spanReqs = nil
+	s.spans = nil
+	s.errs = make(map[Method][]error)
+	s.latencies = make(map[Method]time.Duration)
+}
+
+// CreateTimeSeriesRequests returns the CreateTimeSeries requests received so far.
+func (s *Server) CreateTimeSeriesRequests() []*monitoringpb.CreateTimeSeriesRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*monitoringpb.CreateTimeSeriesRequest(nil), s.timeSeriesReqs...)
+}
+
+// CreateServiceTimeSeriesRequests returns the CreateServiceTimeSeries
+// requests received so far.
+func (s *Server) CreateServiceTimeSeriesRequests() []*monitoringpb.CreateTimeSeriesRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*monitoringpb.CreateTimeSeriesRequest(nil), s.serviceTimeSeriesReqs...)
+}
+
+// CreateMetricDescriptorRequests returns the CreateMetricDescriptor requests
+// received so far.
+func (s *Server) CreateMetricDescriptorRequests() []*monitoringpb.CreateMetricDescriptorRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*monitoringpb.CreateMetricDescriptorRequest(nil), s.descriptorReqs...)
+}
+
+// BatchWriteSpansRequests returns the BatchWriteSpans requests received so far.
+func (s *Server) BatchWriteSpansRequests() []*tracepb.BatchWriteSpansRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*tracepb.BatchWriteSpansRequest(nil), s.spanReqs...)
+}
+
+// TimeSeries returns the time series written so far through both
+// CreateTimeSeries and CreateServiceTimeSeries, excluding the rejected ones.
+func (s *Server) TimeSeries() []*monitoringpb.TimeSeries {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*monitoringpb.TimeSeries(nil), s.timeSeries...)
+}
+
+// Spans returns the spans written so far, excluding the rejected ones.
+func (s *Server) Spans() []*tracepb.Span {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*tracepb.Span(nil), s.spans...)
+}
+
+// MetricDescriptor returns the descriptor of the metric type, or nil if it
+// does not exist.
+func (s *Server) MetricDescriptor(metricType string) *metricpb.MetricDescriptor {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.descriptors[metricType]
+}
+
+// AddMetricDescriptor adds md as if it had been created earlier, for
+// instance by another process.
+func (s *Server) AddMetricDescriptor(md *metricpb.MetricDescriptor) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.descriptors[md.Type] = proto.Clone(md).(*metricpb.MetricDescriptor)
+}
+
+// begin waits for the latency of method, and returns the error to inject
+// in the call, if any. It must be called without holding s.mu.
+func (s *Server) begin(ctx context.Context, method Method) error {
+	s.mu.Lock()
+	d := s.latencies[method]
+	s.mu.Unlock()
+	if d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-t.C:
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if errs := s.errs[method]; len(errs) > 0 {
+		s.errs[method] = errs[1:]
+		return errs[0]
+	}
+	return nil
+}
+
+type metricService struct {
+	monitoringpb.UnimplementedMetricServiceServer
+	s *Server
+}
+
+func (m *metricService) CreateMetricDescriptor(ctx context.Context, req *monitoringpb.CreateMetricDescriptorRequest) (*metricpb.MetricDescriptor, error) {
+	s := m.s
+	injected := s.begin(ctx, MethodCreateMetricDescriptor)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.descriptorReqs = append(s.descriptorReqs, req)
+	if injected != nil {
+		return nil, injected
+	}
+	if err := validateProjectName(req.Name); err != nil {
+		return nil, err
+	}
+	if err := validateMetricDescriptor(req.MetricDescriptor); err != nil {
+		return nil, err
+	}
+	md := proto.Clone(req.MetricDescriptor).(*metricpb.MetricDescriptor)
+	md.Name = req.Name + "/metricDescriptors/" + md.Type
+	s.descriptors[md.Type] = md
+	return md, nil
+}
+
+func (m *metricService) GetMetricDescriptor(ctx context.Context, req *monitoringpb.GetMetricDescriptorRequest) (*metricpb.MetricDescriptor, error) {
+	s := m.s
+	if err := s.begin(ctx, MethodGetMetricDescriptor); err != nil {
+		return nil, err
+	}
+	metricType, err := metricTypeFromDescriptorName(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	md, ok := s.descriptors[metricType]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "Could not find descriptor for metric '%s'.", metricType)
+	}
+	return md, nil
+}
+
+func (m *metricService) DeleteMetricDescriptor(ctx context.Context, req *monitoringpb.DeleteMetricDescriptorRequest) (*emptypb.Empty, error) {
+	s := m.s
+	if err := s.begin(ctx, MethodDeleteMetricDescriptor); err != nil {
+		return nil, err
+	}
+	metricType, err := metricTypeFromDescriptorName(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.descriptors[metricType]; !ok {
+		return nil, status.Errorf(codes.NotFound, "Could not find descriptor for metric '%s'.", metricType)
+	}
+	delete(s.descriptors, metricType)
+	return &emptypb.Empty{}, nil
+}
+
+func (m *metricService) CreateTimeSeries(ctx context.Context, req *monitoringpb.CreateTimeSeriesRequest) (*emptypb.Empty, error) {
+	s := m.s
+	injected := s.begin(ctx, MethodCreateTimeSeries)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.timeSeriesReqs = append(s.timeSeriesReqs, req)
+	if injected != nil {
+		return nil, injected
+	}
+	return &emptypb.Empty{}, s.writeTimeSeries(req)
+}
+
+func (m *metricService) CreateServiceTimeSeries(ctx context.Context, req *monitoringpb.CreateTimeSeriesRequest) (*emptypb.Empty, error) {
+	s := m.s
+	injected := s.begin(ctx, MethodCreateServiceTimeSeries)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.serviceTimeSeriesReqs = append(s.serviceTimeSeriesReqs, req)
+	if injected != nil {
+		return nil, injected
+	}
+	return &emptypb.Empty{}, s.writeTimeSeries(req)
+}
+
+// writeTimeSeries validates req and keeps its valid time series. Like the
+// real API, the invalid time series of a request are reported in a single
+// error listing their indexes, while the other ones are written. It must be
+// called with s.mu held.
+func (s *Server) writeTimeSeries(req *monitoringpb.CreateTimeSeriesRequest) error {
+	if err := validateProjectName(req.Name); err != nil {
+		return err
+	}
+	if err := validateTimeSeriesRequest(req); err != nil {
+		return err
+	}
+	var reasons []string
+	indexes := make(map[string][]int)
+	for i, ts := range req.TimeSeries {
+		if reason := validateTimeSeries(ts, s.descriptors[ts.GetMetric().GetType()]); reason != "" {
+			if _, ok := indexes[reason]; !ok {
+				reasons = append(reasons, reason)
+			}
+			indexes[reason] = append(indexes[reason], i)
+			continue
+		}
+		s.timeSeries = append(s.timeSeries, ts)
+	}
+	if len(reasons) == 0 {
+		return nil
+	}
+	parts := make([]string, 0, len(reasons))
+	for _, reason := range reasons {
+		idx := make([]string, 0, len(indexes[reason]))
+		for _, i := range indexes[reason] {
+			idx = append(idx, fmt.Sprint(i))
+		}
+		parts = append(parts, fmt.Sprintf("%s: timeSeries[%s]", reason, strings.Join(idx, ",")))
+	}
+	return status.Errorf(codes.InvalidArgument, "One or more TimeSeries could not be written: %s", strings.Join(parts, "; "))
+}
+
+type traceService struct {
+	tracepb.UnimplementedTraceServiceServer
+	s *Server
+}
+
+func (t *traceService) BatchWriteSpans(ctx context.Context, req *tracepb.BatchWriteSpansRequest) (*emptypb.Empty, error) {
+	s := t.s
+	injected := s.begin(ctx, MethodBatchWriteSpans)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.spanReqs = append(s.spanReqs, req)
+	if injected != nil {
+		return nil, injected
+	}
+	if err := validateProjectName(req.Name); err != nil {
+		return nil, err
+	}
+	// The real API rejects the whole batch when a span is invalid.
+	for i, span := range req.Spans {
+		if err := validateSpan(req.Name, span); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "spans[%d]: %v", i, err)
+		}
+	}
+	s.spans = append(s.spans, req.Spans...)
+	return &emptypb.Empty{}, nil
+}
+
+func (t *traceService) CreateSpan(ctx context.Context, span *tracepb.Span) (*tracepb.Span, error) {
+	s := t.s
+	injected := s.begin(ctx, MethodCreateSpan)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.spanReqs = append(s.spanReqs, &tracepb.BatchWriteSpansRequest{Spans: []*tracepb.Span{span}})
+	if injected != nil {
+		return nil, injected
+	}
+	name := span.GetName()
+	if i := strings.Index(name, "/traces/"); i >= 0 {
+		name = name[:i]
+	}
+	if err := validateSpan(name, span); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	s.spans = append(s.spans, span)
+	return span, nil
+}
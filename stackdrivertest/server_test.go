@@ -0,0 +1,256 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdrivertest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+	"cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	trace "cloud.google.com/go/trace/apiv2"
+	"cloud.google.com/go/trace/apiv2/tracepb"
+	labelpb "google.golang.org/genproto/googleapis/api/label"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoredrespb "google.golang.org/genproto/googleapis/api/monitoredres"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const testMetricType = "custom.googleapis.com/opencensus/test"
+
+func newMetricClient(t *testing.T) (*Server, *monitoring.MetricClient) {
+	t.Helper()
+	srv, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+	c, err := monitoring.NewMetricClient(context.Background(), srv.ClientOptions()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return srv, c
+}
+
+func testDescriptor() *metricpb.MetricDescriptor {
+	return &metricpb.MetricDescriptor{
+		Type:       testMetricType,
+		MetricKind: metricpb.MetricDescriptor_GAUGE,
+		ValueType:  metricpb.MetricDescriptor_INT64,
+		Labels:     []*labelpb.LabelDescriptor{{Key: "method"}},
+	}
+}
+
+func testTimeSeries(method string) *monitoringpb.TimeSeries {
+	now := timestamppb.New(time.Unix(1000, 0))
+	return &monitoringpb.TimeSeries{
+		Metric:     &metricpb.Metric{Type: testMetricType, Labels: map[string]string{"method": method}},
+		Resource:   &monitoredrespb.MonitoredResource{Type: "global"},
+		MetricKind: metricpb.MetricDescriptor_GAUGE,
+		ValueType:  metricpb.MetricDescriptor_INT64,
+		Points: []*monitoringpb.Point{{
+			Interval: &monitoringpb.TimeInterval{EndTime: now},
+			Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_Int64Value{Int64Value: 1}},
+		}},
+	}
+}
+
+func TestMetricDescriptors(t *testing.T) {
+	srv, c := newMetricClient(t)
+	ctx := context.Background()
+
+	_, err := c.GetMetricDescriptor(ctx, &monitoringpb.GetMetricDescriptorRequest{
+		Name: "projects/p/metricDescriptors/" + testMetricType,
+	})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("GetMetricDescriptor() error = %v; want NotFound", err)
+	}
+
+	md, err := c.CreateMetricDescriptor(ctx, &monitoringpb.CreateMetricDescriptorRequest{
+		Name:             "projects/p",
+		MetricDescriptor: testDescriptor(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := md.Name, "projects/p/metricDescriptors/"+testMetricType; got != want {
+		t.Errorf("Name = %q; want %q", got, want)
+	}
+	got, err := c.GetMetricDescriptor(ctx, &monitoringpb.GetMetricDescriptorRequest{Name: md.Name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Type != testMetricType {
+		t.Errorf("GetMetricDescriptor().Type = %q; want %q", got.Type, testMetricType)
+	}
+	if srv.MetricDescriptor(testMetricType) == nil {
+		t.Error("MetricDescriptor() = nil")
+	}
+
+	if err := c.DeleteMetricDescriptor(ctx, &monitoringpb.DeleteMetricDescriptorRequest{Name: md.Name}); err != nil {
+		t.Fatal(err)
+	}
+	if srv.MetricDescriptor(testMetricType) != nil {
+		t.Error("descriptor not deleted")
+	}
+
+	invalid := []*metricpb.MetricDescriptor{
+		{Type: "compute.googleapis.com/foo", MetricKind: metricpb.MetricDescriptor_GAUGE, ValueType: metricpb.MetricDescriptor_INT64},
+		{Type: testMetricType, ValueType: metricpb.MetricDescriptor_INT64},
+		{Type: testMetricType, MetricKind: metricpb.MetricDescriptor_GAUGE, ValueType: metricpb.MetricDescriptor_INT64,
+			Labels: []*labelpb.LabelDescriptor{{Key: "1abc"}}},
+		{Type: testMetricType, MetricKind: metricpb.MetricDescriptor_GAUGE, ValueType: metricpb.MetricDescriptor_INT64,
+			Labels: []*labelpb.LabelDescriptor{{Key: "a"}, {Key: "a"}}},
+	}
+	for i, md := range invalid {
+		_, err := c.CreateMetricDescriptor(ctx, &monitoringpb.CreateMetricDescriptorRequest{Name: "projects/p", MetricDescriptor: md})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("#%d: CreateMetricDescriptor() error = %v; want InvalidArgument", i, err)
+		}
+	}
+	if got, want := len(srv.CreateMetricDescriptorRequests()), 1+len(invalid); got != want {
+		t.Errorf("recorded %d requests; want %d", got, want)
+	}
+}
+
+func TestCreateTimeSeries(t *testing.T) {
+	srv, c := newMetricClient(t)
+	ctx := context.Background()
+	srv.AddMetricDescriptor(testDescriptor())
+
+	ok := testTimeSeries("a")
+	undeclared := testTimeSeries("b")
+	undeclared.Metric.Labels["other"] = "x"
+	unknown := testTimeSeries("c")
+	unknown.Metric.Type = "custom.googleapis.com/opencensus/unknown"
+	twoPoints := testTimeSeries("d")
+	twoPoints.Points = append(twoPoints.Points, twoPoints.Points[0])
+
+	err := c.CreateTimeSeries(ctx, &monitoringpb.CreateTimeSeriesRequest{
+		Name:       "projects/p",
+		TimeSeries: []*monitoringpb.TimeSeries{ok, undeclared, unknown, twoPoints},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("CreateTimeSeries() error = %v; want InvalidArgument", err)
+	}
+	msg := status.Convert(err).Message()
+	for _, want := range []string{
+		"One or more TimeSeries could not be written:",
+		"timeSeries[1]", "timeSeries[2]", "timeSeries[3]",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("error %q does not contain %q", msg, want)
+		}
+	}
+	if got := srv.TimeSeries(); len(got) != 1 || got[0].Metric.Labels["method"] != "a" {
+		t.Errorf("TimeSeries() = %v; want only the valid time series", got)
+	}
+
+	err = c.CreateTimeSeries(ctx, &monitoringpb.CreateTimeSeriesRequest{
+		Name:       "projects/p",
+		TimeSeries: []*monitoringpb.TimeSeries{testTimeSeries("a"), testTimeSeries("a")},
+	})
+	if status.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), "Duplicate TimeSeries") {
+		t.Errorf("CreateTimeSeries(duplicates) error = %v; want duplicate error", err)
+	}
+
+	var tooMany []*monitoringpb.TimeSeries
+	for i := 0; i <= MaxTimeSeriesPerRequest; i++ {
+		tooMany = append(tooMany, testTimeSeries(fmt.Sprint(i)))
+	}
+	err = c.CreateTimeSeries(ctx, &monitoringpb.CreateTimeSeriesRequest{Name: "projects/p", TimeSeries: tooMany})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("CreateTimeSeries(%d series) error = %v; want InvalidArgument", len(tooMany), err)
+	}
+
+	if got := len(srv.TimeSeries()); got != 1 {
+		t.Errorf("rejected requests wrote %d time series", got-1)
+	}
+	if got := len(srv.CreateTimeSeriesRequests()); got != 3 {
+		t.Errorf("recorded %d requests; want 3", got)
+	}
+}
+
+func TestInjectErrorAndLatency(t *testing.T) {
+	srv, c := newMetricClient(t)
+	srv.AddMetricDescriptor(testDescriptor())
+	req := &monitoringpb.CreateTimeSeriesRequest{
+		Name:       "projects/p",
+		TimeSeries: []*monitoringpb.TimeSeries{testTimeSeries("a")},
+	}
+
+	srv.InjectError(MethodCreateTimeSeries, status.Error(codes.Unavailable, "unavailable"))
+	if err := c.CreateTimeSeries(context.Background(), req); status.Code(err) != codes.Unavailable {
+		t.Errorf("CreateTimeSeries() error = %v; want Unavailable", err)
+	}
+	if err := c.CreateTimeSeries(context.Background(), req); err != nil {
+		t.Errorf("CreateTimeSeries() after injected error: %v", err)
+	}
+
+	srv.SetLatency(MethodCreateTimeSeries, time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.CreateTimeSeries(ctx, req); status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("CreateTimeSeries() error = %v; want DeadlineExceeded", err)
+	}
+
+	srv.Reset()
+	if got := srv.CreateTimeSeriesRequests(); len(got) != 0 {
+		t.Errorf("CreateTimeSeriesRequests() after Reset = %d requests", len(got))
+	}
+}
+
+func TestBatchWriteSpans(t *testing.T) {
+	srv, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	c, err := trace.NewClient(context.Background(), srv.ClientOptions()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	span := func(displayName string) *tracepb.Span {
+		return &tracepb.Span{
+			Name:        "projects/p/traces/0123456789abcdef0123456789abcdef/spans/0123456789abcdef",
+			SpanId:      "0123456789abcdef",
+			DisplayName: &tracepb.TruncatableString{Value: displayName},
+			StartTime:   timestamppb.New(time.Unix(1000, 0)),
+			EndTime:     timestamppb.New(time.Unix(1001, 0)),
+		}
+	}
+	ctx := context.Background()
+	if err := c.BatchWriteSpans(ctx, &tracepb.BatchWriteSpansRequest{Name: "projects/p", Spans: []*tracepb.Span{span("ok")}}); err != nil {
+		t.Fatal(err)
+	}
+	err = c.BatchWriteSpans(ctx, &tracepb.BatchWriteSpansRequest{Name: "projects/p", Spans: []*tracepb.Span{span("ok"), span("")}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("BatchWriteSpans(invalid) error = %v; want InvalidArgument", err)
+	}
+	if got := srv.Spans(); len(got) != 1 {
+		t.Errorf("Spans() = %d spans; want 1", len(got))
+	}
+	if got := srv.BatchWriteSpansRequests(); len(got) != 2 {
+		t.Errorf("BatchWriteSpansRequests() = %d requests; want 2", len(got))
+	}
+}
@@ -0,0 +1,268 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdrivertest
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	"cloud.google.com/go/trace/apiv2/tracepb"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Limits of the Stackdriver Monitoring and Stackdriver Trace APIs enforced by
+// the fake server.
+const (
+	// MaxTimeSeriesPerRequest is the maximum number of time series in a
+	// CreateTimeSeries request.
+	MaxTimeSeriesPerRequest = 200
+	// MaxLabels is the maximum number of labels of a metric.
+	MaxLabels = 30
+	// MaxLabelKeyLength is the maximum length of a label key.
+	MaxLabelKeyLength = 100
+	// MaxLabelValueLength is the maximum length of a label value.
+	MaxLabelValueLength = 1024
+	// MaxMetricTypeLength is the maximum length of a metric type.
+	MaxMetricTypeLength = 200
+	// MaxSpanAttributes is the maximum number of attributes of a span.
+	MaxSpanAttributes = 32
+	// MaxSpanDisplayNameLength is the maximum length of the display name of
+	// a span, in bytes.
+	MaxSpanDisplayNameLength = 128
+)
+
+// userDefinedPrefixes are the prefixes of the metric types whose descriptors
+// must be created before writing time series.
+var userDefinedPrefixes = []string{
+	"custom.googleapis.com/",
+	"external.googleapis.com/",
+	"workload.googleapis.com/",
+}
+
+var (
+	labelKeyRegex = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]*$`)
+	spanNameRegex = regexp.MustCompile(`^(projects/[^/]+)/traces/([0-9a-f]{32})/spans/([0-9a-f]{16})$`)
+)
+
+func isUserDefined(metricType string) bool {
+	for _, p := range userDefinedPrefixes {
+		if strings.HasPrefix(metricType, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func validateProjectName(name string) error {
+	id := strings.TrimPrefix(name, "projects/")
+	if id == name || id == "" || strings.Contains(id, "/") {
+		return status.Errorf(codes.InvalidArgument, "Name %q is not a valid project name, expected projects/[PROJECT_ID]", name)
+	}
+	return nil
+}
+
+func metricTypeFromDescriptorName(name string) (string, error) {
+	parts := strings.SplitN(name, "/metricDescriptors/", 2)
+	if len(parts) != 2 || validateProjectName(parts[0]) != nil || parts[1] == "" {
+		return "", status.Errorf(codes.InvalidArgument, "Name %q is not a valid metric descriptor name", name)
+	}
+	return parts[1], nil
+}
+
+// validateLabel returns why the label is invalid, or "" if it is valid.
+func validateLabel(key, value string) string {
+	if len(key) > MaxLabelKeyLength || !labelKeyRegex.MatchString(key) {
+		return fmt.Sprintf("invalid label key %q", key)
+	}
+	if len(value) > MaxLabelValueLength {
+		return fmt.Sprintf("value of label %q is longer than %d characters", key, MaxLabelValueLength)
+	}
+	return ""
+}
+
+func validateMetricDescriptor(md *metricpb.MetricDescriptor) error {
+	if md == nil {
+		return status.Error(codes.InvalidArgument, "Field metricDescriptor is required")
+	}
+	if len(md.Type) > MaxMetricTypeLength {
+		return status.Errorf(codes.InvalidArgument, "Metric type %q is longer than %d characters", md.Type, MaxMetricTypeLength)
+	}
+	if !isUserDefined(md.Type) {
+		return status.Errorf(codes.InvalidArgument, "Metric type %q is not a user-defined metric type", md.Type)
+	}
+	if md.MetricKind == metricpb.MetricDescriptor_METRIC_KIND_UNSPECIFIED {
+		return status.Errorf(codes.InvalidArgument, "Metric kind of %q is unspecified", md.Type)
+	}
+	if md.ValueType == metricpb.MetricDescriptor_VALUE_TYPE_UNSPECIFIED {
+		return status.Errorf(codes.InvalidArgument, "Value type of %q is unspecified", md.Type)
+	}
+	if len(md.Labels) > MaxLabels {
+		return status.Errorf(codes.InvalidArgument, "Metric %q has %d labels, the limit is %d", md.Type, len(md.Labels), MaxLabels)
+	}
+	seen := make(map[string]bool)
+	for _, l := range md.Labels {
+		if reason := validateLabel(l.Key, ""); reason != "" {
+			return status.Errorf(codes.InvalidArgument, "Metric %q: %s", md.Type, reason)
+		}
+		if seen[l.Key] {
+			return status.Errorf(codes.InvalidArgument, "Metric %q: duplicate label key %q", md.Type, l.Key)
+		}
+		seen[l.Key] = true
+	}
+	return nil
+}
+
+// validateTimeSeriesRequest checks the rules that make the real API reject a
+// whole CreateTimeSeries request.
+func validateTimeSeriesRequest(req *monitoringpb.CreateTimeSeriesRequest) error {
+	if len(req.TimeSeries) == 0 {
+		return status.Error(codes.InvalidArgument, "Field timeSeries had an invalid value: at least one TimeSeries is required")
+	}
+	if len(req.TimeSeries) > MaxTimeSeriesPerRequest {
+		return status.Errorf(codes.InvalidArgument, "Field timeSeries had an invalid value: at most %d TimeSeries can be written in a request", MaxTimeSeriesPerRequest)
+	}
+	seen := make(map[string]bool, len(req.TimeSeries))
+	for i, ts := range req.TimeSeries {
+		k := seriesKey(ts)
+		if seen[k] {
+			return status.Errorf(codes.InvalidArgument, "Field timeSeries[%d] had an invalid value: Duplicate TimeSeries encountered. Only one point can be written per TimeSeries per request.", i)
+		}
+		seen[k] = true
+	}
+	return nil
+}
+
+// seriesKey identifies the time series ts is a point of.
+func seriesKey(ts *monitoringpb.TimeSeries) string {
+	var b strings.Builder
+	b.WriteString(ts.GetMetric().GetType())
+	writeLabels(&b, ts.GetMetric().GetLabels())
+	b.WriteString("|")
+	b.WriteString(ts.GetResource().GetType())
+	writeLabels(&b, ts.GetResource().GetLabels())
+	return b.String()
+}
+
+func writeLabels(b *strings.Builder, labels map[string]string) {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(b, "|%q=%q", k, labels[k])
+	}
+}
+
+// validateTimeSeries returns why the real API would reject ts, or "" if it
+// is valid. md is the descriptor of the metric, if it exists.
+func validateTimeSeries(ts *monitoringpb.TimeSeries, md *metricpb.MetricDescriptor) string {
+	metricType := ts.GetMetric().GetType()
+	if metricType == "" {
+		return "Field metric.type is required"
+	}
+	if ts.GetResource().GetType() == "" {
+		return "Field resource.type is required"
+	}
+	if len(ts.Points) != 1 {
+		return "Only one point can be written per TimeSeries per request"
+	}
+	labels := ts.GetMetric().GetLabels()
+	if len(labels) > MaxLabels {
+		return fmt.Sprintf("Metric has more than %d labels", MaxLabels)
+	}
+	for k, v := range labels {
+		if reason := validateLabel(k, v); reason != "" {
+			return reason
+		}
+	}
+	if md == nil {
+		if isUserDefined(metricType) {
+			return "Metric descriptor not found"
+		}
+	} else {
+		if ts.MetricKind != metricpb.MetricDescriptor_METRIC_KIND_UNSPECIFIED && ts.MetricKind != md.MetricKind {
+			return fmt.Sprintf("Metric kind %v does not match the %v kind of the metric descriptor", ts.MetricKind, md.MetricKind)
+		}
+		if ts.ValueType != metricpb.MetricDescriptor_VALUE_TYPE_UNSPECIFIED && ts.ValueType != md.ValueType {
+			return fmt.Sprintf("Value type %v does not match the %v type of the metric descriptor", ts.ValueType, md.ValueType)
+		}
+		declared := make(map[string]bool, len(md.Labels))
+		for _, l := range md.Labels {
+			declared[l.Key] = true
+		}
+		for k := range labels {
+			if !declared[k] {
+				return fmt.Sprintf("Label %q is not declared by the metric descriptor", k)
+			}
+		}
+	}
+	interval := ts.Points[0].GetInterval()
+	if interval.GetEndTime() == nil {
+		return "Field points[0].interval.end_time is required"
+	}
+	kind := ts.MetricKind
+	if md != nil {
+		kind = md.MetricKind
+	}
+	start, end := interval.GetStartTime(), interval.GetEndTime()
+	switch kind {
+	case metricpb.MetricDescriptor_GAUGE:
+		if start != nil && !start.AsTime().Equal(end.AsTime()) {
+			return "The start time must be equal to the end time for the gauge metric"
+		}
+	case metricpb.MetricDescriptor_CUMULATIVE, metricpb.MetricDescriptor_DELTA:
+		if start == nil || end.AsTime().Before(start.AsTime()) {
+			return "The start time must be before the end time for the non-gauge metric"
+		}
+	}
+	return ""
+}
+
+// validateSpan returns why the real API would reject span written in project.
+func validateSpan(project string, span *tracepb.Span) error {
+	m := spanNameRegex.FindStringSubmatch(span.GetName())
+	if m == nil {
+		return fmt.Errorf("invalid span name %q", span.GetName())
+	}
+	if m[1] != project {
+		return fmt.Errorf("span %q does not belong to %s", span.GetName(), project)
+	}
+	if span.GetSpanId() != m[3] {
+		return fmt.Errorf("span ID %q does not match the span name %q", span.GetSpanId(), span.GetName())
+	}
+	if span.GetDisplayName().GetValue() == "" {
+		return errors.New("display name is required")
+	}
+	if len(span.GetDisplayName().GetValue()) > MaxSpanDisplayNameLength {
+		return fmt.Errorf("display name is longer than %d bytes", MaxSpanDisplayNameLength)
+	}
+	if span.GetStartTime() == nil || span.GetEndTime() == nil {
+		return errors.New("start and end times are required")
+	}
+	if span.GetEndTime().AsTime().Before(span.GetStartTime().AsTime()) {
+		return errors.New("end time is before start time")
+	}
+	if n := len(span.GetAttributes().GetAttributeMap()); n > MaxSpanAttributes {
+		return fmt.Errorf("span has %d attributes, the limit is %d", n, MaxSpanAttributes)
+	}
+	return nil
+}
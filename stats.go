@@ -24,6 +24,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.opencensus.io/stats"
@@ -57,8 +58,11 @@ const (
 type statsExporter struct {
 	o Options
 
-	viewDataBundler *bundler.Bundler
-	metricsBundler  *bundler.Bundler
+	viewDataBundler *overflowBundler
+	metricsBundler  *overflowBundler
+	// Number of view data and metrics held by the bundlers or being uploaded.
+	queuedViewData int64
+	queuedMetrics  int64
 
 	protoMu                sync.Mutex
 	protoMetricDescriptors map[string]bool // Metric descriptors that were already created remotely
@@ -66,9 +70,17 @@ type statsExporter struct {
 	metricMu          sync.Mutex
 	metricDescriptors map[string]bool // Metric descriptors that were already created remotely
 
+	driftMu            sync.Mutex
+	refusedDescriptors map[string]*DescriptorDriftError // Metric types not exported because of ReconcileRefuse
+
 	c             *monitoring.MetricClient
 	defaultLabels map[string]labelValue
 	ir            *metricexport.IntervalReader
+	// spool keeps the time series that could not be uploaded, if Options.DiskQueue is set.
+	spool *diskSpool
+	sm    *selfMetrics
+	// cumulative tracks the cumulative time series, if Options.Cumulative is set.
+	cumulative *cumulativeTracker
 
 	initReaderOnce sync.Once
 }
@@ -97,6 +109,8 @@ func newStatsExporter(o Options) (*statsExporter, error) {
 		o:                      o,
 		protoMetricDescriptors: make(map[string]bool),
 		metricDescriptors:      make(map[string]bool),
+		sm:                     newSelfMetrics(),
+		cumulative:             newCumulativeTracker(o.Cumulative),
 	}
 
 	var defaultLablesNotSanitized map[string]labelValue
@@ -114,22 +128,34 @@ func newStatsExporter(o Options) (*statsExporter, error) {
 		e.defaultLabels[sanitize(key)] = label
 	}
 
-	e.viewDataBundler = bundler.NewBundler((*view.Data)(nil), func(bundle interface{}) {
+	vb := o.statsBundleOptions(o.ViewDataBundleOptions).newBundler((*view.Data)(nil), func(bundle interface{}) {
 		vds := bundle.([]*view.Data)
 		e.handleUpload(vds...)
+		atomic.AddInt64(&e.queuedViewData, -int64(len(vds)))
+	})
+	e.viewDataBundler = newOverflowBundler(vb, &o, func(item interface{}) {
+		atomic.AddInt64(&e.queuedViewData, -1)
+		e.viewDataOverflowed(item.(*view.Data))
 	})
-	e.metricsBundler = bundler.NewBundler((*metricdata.Metric)(nil), func(bundle interface{}) {
+	mb := o.statsBundleOptions(o.MetricsBundleOptions).newBundler((*metricdata.Metric)(nil), func(bundle interface{}) {
 		metrics := bundle.([]*metricdata.Metric)
 		e.handleMetricsUpload(metrics)
+		atomic.AddInt64(&e.queuedMetrics, -int64(len(metrics)))
 	})
-	if delayThreshold := e.o.BundleDelayThreshold; delayThreshold > 0 {
-		e.viewDataBundler.DelayThreshold = delayThreshold
-		e.metricsBundler.DelayThreshold = delayThreshold
-	}
-	if countThreshold := e.o.BundleCountThreshold; countThreshold > 0 {
-		e.viewDataBundler.BundleCountThreshold = countThreshold
-		e.metricsBundler.BundleCountThreshold = countThreshold
+	e.metricsBundler = newOverflowBundler(mb, &o, func(item interface{}) {
+		atomic.AddInt64(&e.queuedMetrics, -1)
+		e.sm.timeSeriesDroppedAdd(len(item.(*metricdata.Metric).TimeSeries), dropReasonBufferFull)
+	})
+	if o.DiskQueue != nil {
+		e.spool, err = newDiskSpool(o.DiskQueue, "metrics", e.sendSpooledTimeSeries, o.RetryPolicy.retryable, o.handleError)
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+		e.sm.addQueue("metrics_disk", func() int64 { return int64(e.spool.q.Len()) })
 	}
+	e.sm.addQueue("view_data", func() int64 { return atomic.LoadInt64(&e.queuedViewData) })
+	e.sm.addQueue("metrics", func() int64 { return atomic.LoadInt64(&e.queuedMetrics) })
 	return e, nil
 }
 
@@ -149,9 +175,22 @@ func (e *statsExporter) stopMetricsReader() {
 }
 
 func (e *statsExporter) close() error {
+	e.stop()
 	return e.c.Close()
 }
 
+// stop stops the goroutines started by e and closes its disk queue, without
+// closing its client.
+func (e *statsExporter) stop() {
+	e.viewDataBundler.close()
+	e.metricsBundler.close()
+	if e.spool != nil {
+		if err := e.spool.close(); err != nil {
+			e.o.handleError(err)
+		}
+	}
+}
+
 func (e *statsExporter) getMonitoredResource(v *view.View, tags []tag.Tag) ([]tag.Tag, *monitoredrespb.MonitoredResource) {
 	resource := e.o.Resource
 	if resource == nil {
@@ -168,17 +207,28 @@ func (e *statsExporter) ExportView(vd *view.Data) {
 	if len(vd.Rows) == 0 {
 		return
 	}
-	err := e.viewDataBundler.Add(vd, 1)
+	atomic.AddInt64(&e.queuedViewData, 1)
+	err := e.viewDataBundler.add(context.Background(), vd, e.o.ViewDataBundleOptions.statsItemSize(len(vd.Rows)))
+	if err != nil {
+		atomic.AddInt64(&e.queuedViewData, -1)
+	}
 	switch err {
 	case nil:
 		return
 	case bundler.ErrOverflow:
-		e.o.handleError(errors.New("failed to upload: buffer full"))
+		e.viewDataOverflowed(vd)
 	default:
-		e.o.handleError(err)
+		e.sm.timeSeriesDroppedAdd(len(vd.Rows), errorReason(err))
+		e.o.handleError(metricError(SignalMetrics, e.metricType(vd.View), len(vd.Rows), err))
 	}
 }
 
+// viewDataOverflowed drops vd when there is no room for it in the bundler.
+func (e *statsExporter) viewDataOverflowed(vd *view.Data) {
+	e.sm.timeSeriesDroppedAdd(len(vd.Rows), dropReasonBufferFull)
+	e.o.handleError(metricError(SignalMetrics, e.metricType(vd.View), len(vd.Rows), errors.New("failed to upload: buffer full")))
+}
+
 // getTaskValue returns a task label value in the format of
 // "go-<pid>@<hostname>".
 func getTaskValue() string {
@@ -202,13 +252,15 @@ func (e *statsExporter) handleUpload(vds ...*view.Data) {
 // This is useful if your program is ending and you do not
 // want to lose data that hasn't yet been exported.
 func (e *statsExporter) Flush() {
-	e.viewDataBundler.Flush()
-	e.metricsBundler.Flush()
+	e.viewDataBundler.flush()
+	e.metricsBundler.flush()
 }
 
 func (e *statsExporter) uploadStats(vds []*view.Data) error {
-	ctx, cancel := newContextWithTimeout(e.o.Context, e.o.Timeout)
-	defer cancel()
+	ctx := e.o.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
 	ctx, span := trace.StartSpan(
 		ctx,
 		"contrib.go.opencensus.io/exporter/stackdriver.uploadStats",
@@ -216,22 +268,121 @@ func (e *statsExporter) uploadStats(vds []*view.Data) error {
 	)
 	defer span.End()
 
-	for _, vd := range vds {
+	// The views not exported because of ReconcileRefuse are skipped.
+	var refused []error
+	exported := make([]*view.Data, 0, len(vds))
+	for i, vd := range vds {
 		if err := e.createMetricDescriptorFromView(ctx, vd.View); err != nil {
 			span.SetStatus(trace.Status{Code: 2, Message: err.Error()})
-			return err
+			if _, ok := err.(*DescriptorDriftError); ok {
+				e.sm.timeSeriesDroppedAdd(len(vd.Rows), errorReason(err))
+				refused = append(refused, metricError(SignalMetricDescriptor, e.metricType(vd.View), len(vd.Rows), err))
+				continue
+			}
+			dropped := 0
+			for _, vd := range exported {
+				dropped += len(vd.Rows)
+			}
+			for _, vd := range vds[i:] {
+				dropped += len(vd.Rows)
+			}
+			e.sm.timeSeriesDroppedAdd(dropped, errorReason(err))
+			ee := metricError(SignalMetricDescriptor, e.metricType(vd.View), dropped, err)
+			if len(refused) == 0 {
+				return ee
+			}
+			return newExportError(SignalMetricDescriptor, append([]error{ee}, refused...))
 		}
-	}
-	for _, req := range e.makeReq(vds, maxTimeSeriesPerUpload) {
-		if err := createTimeSeries(ctx, e.c, req); err != nil {
+		exported = append(exported, vd)
+	}
+	reqs := e.makeReq(exported, maxTimeSeriesPerUpload)
+	for i, req := range reqs {
+		if err := e.writeTimeSeries(ctx, false, req); err != nil {
+			ee := newExportError(SignalMetrics, append([]error{err}, refused...))
+			skipped := 0
+			for _, req := range reqs[i+1:] {
+				skipped += len(req.TimeSeries)
+			}
+			ee.Dropped += skipped
+			e.sm.timeSeriesDroppedAdd(skipped, errorReason(err))
 			span.SetStatus(trace.Status{Code: 2, Message: err.Error()})
 			// TODO(jbd): Don't fail fast here, batch errors?
-			return err
+			return ee
 		}
 	}
+	if len(refused) == 1 {
+		return refused[0]
+	}
+	if len(refused) > 0 {
+		return newExportError(SignalMetricDescriptor, refused)
+	}
 	return nil
 }
 
+// writeTimeSeries sends req with CreateServiceTimeSeries if service is set, or
+// CreateTimeSeries otherwise. If the disk queue is enabled, req is queued when
+// it cannot be sent because of a retryable error, or when older time series
+// are still queued, so that points are written in order.
+//
+// It returns a *TimeSeriesError listing the time series that were not written.
+func (e *statsExporter) writeTimeSeries(ctx context.Context, service bool, req *monitoringpb.CreateTimeSeriesRequest) error {
+	if e.spool != nil && e.spool.pending() && e.spool.add(req) == nil {
+		return nil
+	}
+	create := e.sm.timeCreateTimeSeries(methodCreateTimeSeries, createTimeSeries)
+	if service {
+		create = e.sm.timeCreateTimeSeries(methodCreateServiceTimeSeries, createServiceTimeSeries)
+	}
+	err := e.o.RetryPolicy.invoke(ctx, e.o.Timeout, func(ctx context.Context) error {
+		return create(ctx, e.c, req)
+	})
+	if err == nil {
+		e.sm.timeSeriesSentAdd(len(req.TimeSeries))
+		return nil
+	}
+	var serr error
+	if e.spool != nil && e.o.RetryPolicy.retryable(err) {
+		if serr = e.spool.add(req); serr == nil {
+			return nil
+		}
+		serr = fmt.Errorf("couldn't queue time series on disk: %w", serr)
+	}
+	tsErr := newTimeSeriesError(req, err)
+	e.sm.timeSeriesSentAdd(len(req.TimeSeries) - len(tsErr.Rejected))
+	e.sm.timeSeriesDroppedAdd(len(tsErr.Rejected), errorReason(err))
+	if serr != nil {
+		// The upload error comes first, so that it gives the code.
+		return newExportError(SignalMetrics, []error{tsErr, serr})
+	}
+	return tsErr
+}
+
+// sendSpooledTimeSeries sends a request read from the disk queue.
+func (e *statsExporter) sendSpooledTimeSeries(rec []byte) error {
+	var req monitoringpb.CreateTimeSeriesRequest
+	if err := proto.Unmarshal(rec, &req); err != nil {
+		return newExportError(SignalMetrics, []error{fmt.Errorf("couldn't decode time series read from disk queue: %v", err)})
+	}
+	create := e.sm.timeCreateTimeSeries(methodCreateTimeSeries, createTimeSeries)
+	if len(req.TimeSeries) > 0 && serviceMetric(req.TimeSeries[0].GetMetric().GetType()) {
+		create = e.sm.timeCreateTimeSeries(methodCreateServiceTimeSeries, createServiceTimeSeries)
+	}
+	ctx, cancel := newContextWithTimeout(e.o.Context, e.o.Timeout)
+	defer cancel()
+	err := create(ctx, e.c, &req)
+	if err == nil {
+		e.sm.timeSeriesSentAdd(len(req.TimeSeries))
+		return nil
+	}
+	if e.o.RetryPolicy.retryable(err) {
+		return err
+	}
+	tsErr := newTimeSeriesError(&req, err)
+	e.sm.timeSeriesSentAdd(len(req.TimeSeries) - len(tsErr.Rejected))
+	e.sm.timeSeriesDroppedAdd(len(tsErr.Rejected), errorReason(err))
+	return newExportError(SignalMetrics, []error{tsErr})
+}
+
 func (e *statsExporter) makeReq(vds []*view.Data, limit int) []*monitoringpb.CreateTimeSeriesRequest {
 	var reqs []*monitoringpb.CreateTimeSeriesRequest
 
@@ -245,8 +396,9 @@ func (e *statsExporter) makeReq(vds []*view.Data, limit int) []*monitoringpb.Cre
 					Labels: newLabels(e.defaultLabels, tags),
 				},
 				Resource: resource,
-				Points:   []*monitoringpb.Point{newPoint(vd.View, row, vd.Start, vd.End)},
+				Points:   []*monitoringpb.Point{newPoint(vd.View, row, vd.Start, vd.End, e.o.DistributionRange)},
 			}
+			e.compactDistributions(ts)
 			allTimeSeries = append(allTimeSeries, ts)
 		}
 	}
@@ -354,7 +506,7 @@ func (e *statsExporter) createMetricDescriptorFromView(ctx context.Context, v *v
 		return err
 	}
 
-	if err = e.createMetricDescriptor(ctx, inMD); err != nil {
+	if err = e.reconcileMetricDescriptor(ctx, inMD); err != nil {
 		return err
 	}
 
@@ -446,12 +598,14 @@ func metricSignature(metric *metricpb.Metric) string {
 	return fmt.Sprintf("%s:%s", metric.GetType(), strings.Join(labelValues, ","))
 }
 
-func newPoint(v *view.View, row *view.Row, start, end time.Time) *monitoringpb.Point {
+// newPoint returns the point of row. withRange sets the range of the
+// distributions.
+func newPoint(v *view.View, row *view.Row, start, end time.Time, withRange bool) *monitoringpb.Point {
 	switch v.Aggregation.Type {
 	case view.AggTypeLastValue:
-		return newGaugePoint(v, row, end)
+		return newGaugePoint(v, row, end, withRange)
 	default:
-		return newCumulativePoint(v, row, start, end)
+		return newCumulativePoint(v, row, start, end, withRange)
 	}
 }
 
@@ -474,14 +628,14 @@ func toValidTimeIntervalpb(start, end time.Time) *monitoringpb.TimeInterval {
 	}
 }
 
-func newCumulativePoint(v *view.View, row *view.Row, start, end time.Time) *monitoringpb.Point {
+func newCumulativePoint(v *view.View, row *view.Row, start, end time.Time, withRange bool) *monitoringpb.Point {
 	return &monitoringpb.Point{
 		Interval: toValidTimeIntervalpb(start, end),
-		Value:    newTypedValue(v, row),
+		Value:    newTypedValue(v, row, withRange),
 	}
 }
 
-func newGaugePoint(v *view.View, row *view.Row, end time.Time) *monitoringpb.Point {
+func newGaugePoint(v *view.View, row *view.Row, end time.Time, withRange bool) *monitoringpb.Point {
 	gaugeTime := &timestamp.Timestamp{
 		Seconds: end.Unix(),
 		Nanos:   int32(end.Nanosecond()),
@@ -490,11 +644,11 @@ func newGaugePoint(v *view.View, row *view.Row, end time.Time) *monitoringpb.Poi
 		Interval: &monitoringpb.TimeInterval{
 			EndTime: gaugeTime,
 		},
-		Value: newTypedValue(v, row),
+		Value: newTypedValue(v, row, withRange),
 	}
 }
 
-func newTypedValue(vd *view.View, r *view.Row) *monitoringpb.TypedValue {
+func newTypedValue(vd *view.View, r *view.Row, withRange bool) *monitoringpb.TypedValue {
 	switch v := r.Data.(type) {
 	case *view.CountData:
 		return &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_Int64Value{
@@ -513,16 +667,16 @@ func newTypedValue(vd *view.View, r *view.Row) *monitoringpb.TypedValue {
 		}
 	case *view.DistributionData:
 		insertZeroBound := shouldInsertZeroBound(vd.Aggregation.Buckets...)
+		var rng *distributionpb.Distribution_Range
+		if withRange && v.Count > 0 {
+			rng = &distributionpb.Distribution_Range{Min: v.Min, Max: v.Max}
+		}
 		return &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DistributionValue{
 			DistributionValue: &distributionpb.Distribution{
 				Count:                 v.Count,
 				Mean:                  v.Mean,
 				SumOfSquaredDeviation: v.SumOfSquaredDev,
-				// TODO(songya): uncomment this once Stackdriver supports min/max.
-				// Range: &distributionpb.Distribution_Range{
-				// 	Min: v.Min,
-				// 	Max: v.Max,
-				// },
+				Range:                 rng,
 				BucketOptions: &distributionpb.Distribution_BucketOptions{
 					Options: &distributionpb.Distribution_BucketOptions_ExplicitBuckets{
 						ExplicitBuckets: &distributionpb.Distribution_BucketOptions_Explicit{
@@ -606,14 +760,19 @@ func newLabelDescriptors(defaults map[string]labelValue, keys []tag.Key) []*labe
 }
 
 func (e *statsExporter) createMetricDescriptor(ctx context.Context, md *metricpb.MetricDescriptor) error {
-	ctx, cancel := newContextWithTimeout(ctx, e.o.Timeout)
-	defer cancel()
 	cmrdesc := &monitoringpb.CreateMetricDescriptorRequest{
 		Name:             fmt.Sprintf("projects/%s", e.o.ProjectID),
 		MetricDescriptor: md,
 	}
-	_, err := createMetricDescriptor(ctx, e.c, cmrdesc)
-	return err
+	return e.o.RetryPolicy.invoke(ctx, e.o.Timeout, func(ctx context.Context) error {
+		start := time.Now()
+		_, err := createMetricDescriptor(ctx, e.c, cmrdesc)
+		e.sm.recordRPC(methodCreateMetricDescriptor, start, err)
+		if err == nil {
+			e.sm.descriptorCreated()
+		}
+		return err
+	})
 }
 
 var createMetricDescriptor = func(ctx context.Context, c *monitoring.MetricClient, mdr *monitoringpb.CreateMetricDescriptorRequest) (*metricpb.MetricDescriptor, error) {
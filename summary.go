@@ -0,0 +1,156 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"fmt"
+	"sort"
+
+	"go.opencensus.io/metric/metricdata"
+)
+
+// SummaryPart identifies one of the metrics a summary metric is exported
+// as, since Stackdriver Monitoring has no summary type.
+type SummaryPart string
+
+const (
+	// SummarySum is the cumulative sum of the values of the summary.
+	SummarySum SummaryPart = "sum"
+	// SummaryCount is the cumulative count of the values of the summary.
+	SummaryCount SummaryPart = "count"
+	// SummaryPercentile is the gauge of the percentiles of the summary,
+	// with a "percentile" label.
+	SummaryPercentile SummaryPart = "percentile"
+)
+
+// DefaultSummaryMetricName returns the name of the metric holding the given
+// part of the summary metric with the given name: name followed by
+// "_summary_sum", "_summary_count" or "_summary_percentile".
+func DefaultSummaryMetricName(name string, part SummaryPart) string {
+	return fmt.Sprintf("%s_summary_%s", name, part)
+}
+
+// summaryMetricName returns the name of the metric holding the given part
+// of the summary metric with the given name.
+func (se *statsExporter) summaryMetricName(name string, part SummaryPart) string {
+	if se.o.GetSummaryMetricName != nil {
+		return se.o.GetSummaryMetricName(name, part)
+	}
+	return DefaultSummaryMetricName(name, part)
+}
+
+// expandSummaryMetrics returns metrics with each summary metric replaced by
+// the metrics it is exported as.
+func (se *statsExporter) expandSummaryMetrics(metrics []*metricdata.Metric) []*metricdata.Metric {
+	var expanded []*metricdata.Metric
+	for i, metric := range metrics {
+		if metric == nil || metric.Descriptor.Type != metricdata.TypeSummary {
+			if expanded != nil {
+				expanded = append(expanded, metric)
+			}
+			continue
+		}
+		if expanded == nil {
+			expanded = append(make([]*metricdata.Metric, 0, len(metrics)+2), metrics[:i]...)
+		}
+		expanded = append(expanded, se.convertSummaryMetric(metric)...)
+	}
+	if expanded == nil {
+		return metrics
+	}
+	return expanded
+}
+
+// convertSummaryMetric splits summary, a summary metric, into a cumulative
+// metric of its sums, a cumulative metric of its counts and a gauge metric
+// of its percentiles, as convertSummaryMetrics does for proto metrics.
+func (se *statsExporter) convertSummaryMetric(summary *metricdata.Metric) []*metricdata.Metric {
+	var sumTss, countTss, percentileTss []*metricdata.TimeSeries
+	for _, ts := range summary.TimeSeries {
+		var sumPts, countPts []metricdata.Point
+		percentilePts := make(map[float64][]metricdata.Point)
+		for _, pt := range ts.Points {
+			sv, ok := pt.Value.(*metricdata.Summary)
+			if !ok || sv == nil {
+				continue
+			}
+			if sv.HasCountAndSum {
+				sumPts = append(sumPts, metricdata.NewFloat64Point(pt.Time, sv.Sum))
+				countPts = append(countPts, metricdata.NewInt64Point(pt.Time, sv.Count))
+			}
+			for p, v := range sv.Snapshot.Percentiles {
+				percentilePts[p] = append(percentilePts[p], metricdata.NewFloat64Point(pt.Time, v))
+			}
+		}
+		if len(sumPts) > 0 {
+			sumTss = append(sumTss, &metricdata.TimeSeries{LabelValues: ts.LabelValues, Points: sumPts, StartTime: ts.StartTime})
+			countTss = append(countTss, &metricdata.TimeSeries{LabelValues: ts.LabelValues, Points: countPts, StartTime: ts.StartTime})
+		}
+
+		percentiles := make([]float64, 0, len(percentilePts))
+		for p := range percentilePts {
+			percentiles = append(percentiles, p)
+		}
+		sort.Float64s(percentiles)
+		for _, p := range percentiles {
+			lvs := append(ts.LabelValues[:len(ts.LabelValues):len(ts.LabelValues)], metricdata.NewLabelValue(fmt.Sprintf("%f", p)))
+			percentileTss = append(percentileTss, &metricdata.TimeSeries{LabelValues: lvs, Points: percentilePts[p]})
+		}
+	}
+
+	d := summary.Descriptor
+	var metrics []*metricdata.Metric
+	if len(sumTss) > 0 {
+		metrics = append(metrics, &metricdata.Metric{
+			Descriptor: metricdata.Descriptor{
+				Name:        se.summaryMetricName(d.Name, SummarySum),
+				Description: d.Description,
+				Unit:        d.Unit,
+				Type:        metricdata.TypeCumulativeFloat64,
+				LabelKeys:   d.LabelKeys,
+			},
+			Resource:   summary.Resource,
+			TimeSeries: sumTss,
+		}, &metricdata.Metric{
+			Descriptor: metricdata.Descriptor{
+				Name:        se.summaryMetricName(d.Name, SummaryCount),
+				Description: d.Description,
+				Unit:        metricdata.UnitDimensionless,
+				Type:        metricdata.TypeCumulativeInt64,
+				LabelKeys:   d.LabelKeys,
+			},
+			Resource:   summary.Resource,
+			TimeSeries: countTss,
+		})
+	}
+	if len(percentileTss) > 0 {
+		lks := append(d.LabelKeys[:len(d.LabelKeys):len(d.LabelKeys)], metricdata.LabelKey{
+			Key:         percentileLabelKey.Key,
+			Description: percentileLabelKey.Description,
+		})
+		metrics = append(metrics, &metricdata.Metric{
+			Descriptor: metricdata.Descriptor{
+				Name:        se.summaryMetricName(d.Name, SummaryPercentile),
+				Description: d.Description,
+				Unit:        d.Unit,
+				Type:        metricdata.TypeGaugeFloat64,
+				LabelKeys:   lks,
+			},
+			Resource:   summary.Resource,
+			TimeSeries: percentileTss,
+		})
+	}
+	return metrics
+}
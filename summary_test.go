@@ -0,0 +1,194 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	metricspb "github.com/census-instrumentation/opencensus-proto/gen-go/metrics/v1"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"go.opencensus.io/metric/metricdata"
+	googlemetricpb "google.golang.org/genproto/googleapis/api/metric"
+)
+
+func summaryMetric() *metricdata.Metric {
+	start := time.Unix(1000, 0)
+	return &metricdata.Metric{
+		Descriptor: metricdata.Descriptor{
+			Name:        "rpc_latency",
+			Description: "RPC latency",
+			Unit:        metricdata.UnitMilliseconds,
+			Type:        metricdata.TypeSummary,
+			LabelKeys:   []metricdata.LabelKey{{Key: "method"}},
+		},
+		TimeSeries: []*metricdata.TimeSeries{{
+			StartTime:   start,
+			LabelValues: []metricdata.LabelValue{metricdata.NewLabelValue("get")},
+			Points: []metricdata.Point{metricdata.NewSummaryPoint(start.Add(time.Minute), &metricdata.Summary{
+				Count:          10,
+				Sum:            120.5,
+				HasCountAndSum: true,
+				Snapshot: metricdata.Snapshot{
+					Percentiles: map[float64]float64{99: 40, 50: 10},
+				},
+			})},
+		}},
+	}
+}
+
+func TestConvertSummaryMetric(t *testing.T) {
+	se := &statsExporter{o: Options{ProjectID: "foo"}}
+	got := se.convertSummaryMetric(summaryMetric())
+	if len(got) != 3 {
+		t.Fatalf("convertSummaryMetric() returned %d metrics; want 3", len(got))
+	}
+	sum, count, percentile := got[0], got[1], got[2]
+
+	if sum.Descriptor.Name != "rpc_latency_summary_sum" || sum.Descriptor.Type != metricdata.TypeCumulativeFloat64 || sum.Descriptor.Unit != metricdata.UnitMilliseconds {
+		t.Errorf("sum descriptor = %+v", sum.Descriptor)
+	}
+	if v := sum.TimeSeries[0].Points[0].Value; v != 120.5 {
+		t.Errorf("sum = %v; want 120.5", v)
+	}
+	if count.Descriptor.Name != "rpc_latency_summary_count" || count.Descriptor.Type != metricdata.TypeCumulativeInt64 || count.Descriptor.Unit != metricdata.UnitDimensionless {
+		t.Errorf("count descriptor = %+v", count.Descriptor)
+	}
+	if v := count.TimeSeries[0].Points[0].Value; v != int64(10) {
+		t.Errorf("count = %v; want 10", v)
+	}
+	if !count.TimeSeries[0].StartTime.Equal(time.Unix(1000, 0)) {
+		t.Errorf("count start time = %v; want the start time of the summary", count.TimeSeries[0].StartTime)
+	}
+
+	pd := percentile.Descriptor
+	if pd.Name != "rpc_latency_summary_percentile" || pd.Type != metricdata.TypeGaugeFloat64 || len(pd.LabelKeys) != 2 || pd.LabelKeys[1].Key != "percentile" {
+		t.Errorf("percentile descriptor = %+v", pd)
+	}
+	if len(percentile.TimeSeries) != 2 {
+		t.Fatalf("got %d percentile time series; want 2", len(percentile.TimeSeries))
+	}
+	for i, want := range []struct {
+		label string
+		value float64
+	}{{"50.000000", 10}, {"99.000000", 40}} {
+		ts := percentile.TimeSeries[i]
+		if lv := ts.LabelValues; len(lv) != 2 || lv[0].Value != "get" || lv[1].Value != want.label {
+			t.Errorf("percentile #%d label values = %v; want [get %s]", i, lv, want.label)
+		}
+		if v := ts.Points[0].Value; v != want.value {
+			t.Errorf("percentile #%d = %v; want %v", i, v, want.value)
+		}
+	}
+	if len(summaryMetric().Descriptor.LabelKeys) != 1 {
+		t.Error("convertSummaryMetric() modified the label keys of the summary")
+	}
+}
+
+func TestExpandSummaryMetrics(t *testing.T) {
+	se := &statsExporter{o: Options{ProjectID: "foo"}}
+	gauge := &metricdata.Metric{Descriptor: metricdata.Descriptor{Name: "queue", Type: metricdata.TypeGaugeInt64}}
+	in := []*metricdata.Metric{gauge}
+	if got := se.expandSummaryMetrics(in); len(got) != 1 || got[0] != gauge {
+		t.Errorf("expandSummaryMetrics() without summary = %v; want the input", got)
+	}
+
+	got := se.expandSummaryMetrics([]*metricdata.Metric{gauge, summaryMetric(), gauge})
+	var names []string
+	for _, m := range got {
+		names = append(names, m.Descriptor.Name)
+	}
+	want := "queue rpc_latency_summary_sum rpc_latency_summary_count rpc_latency_summary_percentile queue"
+	if strings.Join(names, " ") != want {
+		t.Errorf("expandSummaryMetrics() = %v; want %s", names, want)
+	}
+}
+
+func TestSummaryMetricNaming(t *testing.T) {
+	se := &statsExporter{o: Options{
+		ProjectID: "foo",
+		GetSummaryMetricName: func(name string, part SummaryPart) string {
+			return name + "." + string(part)
+		},
+	}}
+	var got []string
+	for _, m := range se.convertSummaryMetric(summaryMetric()) {
+		got = append(got, m.Descriptor.Name)
+	}
+
+	// The proto path uses the same names.
+	var gotProto []string
+	for _, m := range se.convertSummaryMetrics(&metricspb.Metric{
+		MetricDescriptor: &metricspb.MetricDescriptor{Name: "rpc_latency", Type: metricspb.MetricDescriptor_SUMMARY},
+		Timeseries: []*metricspb.TimeSeries{{
+			Points: []*metricspb.Point{{
+				Value: &metricspb.Point_SummaryValue{SummaryValue: &metricspb.SummaryValue{
+					Count: &wrappers.Int64Value{Value: 10},
+					Sum:   &wrappers.DoubleValue{Value: 120.5},
+					Snapshot: &metricspb.SummaryValue_Snapshot{
+						PercentileValues: []*metricspb.SummaryValue_Snapshot_ValueAtPercentile{makePercentileValue(10, 50)},
+					},
+				}},
+			}},
+		}},
+	}) {
+		gotProto = append(gotProto, m.GetMetricDescriptor().GetName())
+	}
+
+	want := "rpc_latency.sum rpc_latency.count rpc_latency.percentile"
+	if strings.Join(got, " ") != want {
+		t.Errorf("metric names = %v; want %s", got, want)
+	}
+	if strings.Join(gotProto, " ") != want {
+		t.Errorf("proto metric names = %v; want %s", gotProto, want)
+	}
+}
+
+func TestMetricToMpbTsSummary(t *testing.T) {
+	se := &statsExporter{o: Options{ProjectID: "foo"}}
+	var kinds []googlemetricpb.MetricDescriptor_MetricKind
+	var series int
+	for _, m := range se.expandSummaryMetrics([]*metricdata.Metric{summaryMetric()}) {
+		md, err := se.metricToMpbMetricDescriptor(m)
+		if err != nil {
+			t.Fatalf("metricToMpbMetricDescriptor(%s) = %v", m.Descriptor.Name, err)
+		}
+		kinds = append(kinds, md.MetricKind)
+		tsl, err := se.metricToMpbTs(context.Background(), m)
+		if err != nil {
+			t.Fatalf("metricToMpbTs(%s) = %v", m.Descriptor.Name, err)
+		}
+		series += len(tsl)
+	}
+	wantKinds := []googlemetricpb.MetricDescriptor_MetricKind{
+		googlemetricpb.MetricDescriptor_CUMULATIVE,
+		googlemetricpb.MetricDescriptor_CUMULATIVE,
+		googlemetricpb.MetricDescriptor_GAUGE,
+	}
+	if len(kinds) != len(wantKinds) {
+		t.Fatalf("metric kinds = %v; want %v", kinds, wantKinds)
+	}
+	for i := range kinds {
+		if kinds[i] != wantKinds[i] {
+			t.Errorf("metric kinds = %v; want %v", kinds, wantKinds)
+			break
+		}
+	}
+	if series != 4 {
+		t.Errorf("got %d time series; want 4", series)
+	}
+}
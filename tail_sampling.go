@@ -0,0 +1,319 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"container/list"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+const (
+	defaultTailSamplingDecisionWait     = 10 * time.Second
+	defaultTailSamplingMaxTraces        = 10000
+	defaultTailSamplingMaxSpansPerTrace = 1000
+)
+
+// TailSamplingPolicy decides whether the spans of a trace are uploaded. It
+// is given the spans of the trace received so far.
+type TailSamplingPolicy func(spans []*trace.SpanData) bool
+
+// TailSamplingOptions configures the tail sampling of the spans exported
+// through ExportSpan.
+//
+// The spans of a trace are held in memory for DecisionWait after its first
+// span is received. The trace is then uploaded if at least one of the
+// policies selects it, and dropped otherwise. Spans received after the
+// decision follow it, as long as they arrive within another DecisionWait.
+//
+// Since only sampled spans reach exporters, tail sampling is meant to be
+// used with trace.AlwaysSample() or a high sampling probability. Spans
+// uploaded with PushTraceSpans are not tail sampled.
+type TailSamplingOptions struct {
+	// DecisionWait is how long the spans of a trace are held before
+	// deciding whether it is uploaded. If unset, a default of 10s is used.
+	DecisionWait time.Duration
+
+	// Policies select the traces to upload. If empty, all traces are
+	// uploaded.
+	Policies []TailSamplingPolicy
+
+	// MaxTraces caps the number of traces held in memory, and the number
+	// of decisions remembered for the spans received after them. When it
+	// is reached, the decision for the oldest trace is made early, or the
+	// oldest decision is forgotten. If unset, a default of 10000 is used.
+	MaxTraces int
+
+	// MaxSpansPerTrace caps the number of spans held for a trace. When it
+	// is reached, the decision for the trace is made early.
+	// If unset, a default of 1000 is used.
+	MaxSpansPerTrace int
+}
+
+// TailSampleErrors selects the traces with a span whose status is not OK.
+func TailSampleErrors() TailSamplingPolicy {
+	return func(spans []*trace.SpanData) bool {
+		for _, s := range spans {
+			if s.Status.Code != trace.StatusCodeOK {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// TailSampleLatencyAbove selects the traces whose spans cover more than d,
+// from the earliest start time to the latest end time.
+func TailSampleLatencyAbove(d time.Duration) TailSamplingPolicy {
+	return func(spans []*trace.SpanData) bool {
+		if len(spans) == 0 {
+			return false
+		}
+		start, end := spans[0].StartTime, spans[0].EndTime
+		for _, s := range spans[1:] {
+			if s.StartTime.Before(start) {
+				start = s.StartTime
+			}
+			if s.EndTime.After(end) {
+				end = s.EndTime
+			}
+		}
+		return end.Sub(start) > d
+	}
+}
+
+// TailSampleAttribute selects the traces with a span holding the attribute
+// key with the given value. If value is nil, any value matches.
+func TailSampleAttribute(key string, value interface{}) TailSamplingPolicy {
+	return func(spans []*trace.SpanData) bool {
+		for _, s := range spans {
+			v, ok := s.Attributes[key]
+			if ok && (value == nil || v == value) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// TailSampleProbability selects the given fraction of traces. The decision
+// only depends on the trace ID, so that it is consistent across processes.
+func TailSampleProbability(fraction float64) TailSamplingPolicy {
+	if fraction >= 1 {
+		return func([]*trace.SpanData) bool { return true }
+	}
+	if fraction <= 0 {
+		return func([]*trace.SpanData) bool { return false }
+	}
+	// Same computation as trace.ProbabilitySampler.
+	upperBound := uint64(fraction * (1 << 63))
+	return func(spans []*trace.SpanData) bool {
+		if len(spans) == 0 {
+			return false
+		}
+		tid := spans[0].TraceID
+		return binary.BigEndian.Uint64(tid[0:8])>>1 < upperBound
+	}
+}
+
+// tailSampler holds spans grouped by trace until their trace is selected or
+// dropped by the policies.
+type tailSampler struct {
+	o      TailSamplingOptions
+	export func(s *trace.SpanData)
+	sm     *selfMetrics
+
+	mu      sync.Mutex
+	traces  map[trace.TraceID]*pendingTrace
+	order   *list.List // of *pendingTrace, by time of the first span
+	decided map[trace.TraceID]tailDecision
+	// decisions holds the keys of decided, oldest decision first.
+	decisions *list.List
+	held      int64 // number of spans held
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+type pendingTrace struct {
+	id    trace.TraceID
+	first time.Time
+	spans []*trace.SpanData
+	elem  *list.Element
+}
+
+type tailDecision struct {
+	sampled bool
+	at      time.Time
+}
+
+func newTailSampler(o TailSamplingOptions, export func(s *trace.SpanData), sm *selfMetrics) *tailSampler {
+	if o.DecisionWait <= 0 {
+		o.DecisionWait = defaultTailSamplingDecisionWait
+	}
+	if o.MaxTraces <= 0 {
+		o.MaxTraces = defaultTailSamplingMaxTraces
+	}
+	if o.MaxSpansPerTrace <= 0 {
+		o.MaxSpansPerTrace = defaultTailSamplingMaxSpansPerTrace
+	}
+	ts := &tailSampler{
+		o:         o,
+		export:    export,
+		sm:        sm,
+		traces:    make(map[trace.TraceID]*pendingTrace),
+		order:     list.New(),
+		decided:   make(map[trace.TraceID]tailDecision),
+		decisions: list.New(),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	sm.addQueue("tail_sampling", func() int64 {
+		ts.mu.Lock()
+		defer ts.mu.Unlock()
+		return ts.held
+	})
+	go ts.loop()
+	return ts
+}
+
+// add holds s until the decision for its trace is made, or exports it right
+// away if its trace was already selected.
+func (ts *tailSampler) add(s *trace.SpanData) {
+	var ready []*trace.SpanData
+	now := time.Now()
+
+	ts.mu.Lock()
+	if d, ok := ts.decided[s.TraceID]; ok {
+		ts.mu.Unlock()
+		if d.sampled {
+			ts.export(s)
+		}
+		return
+	}
+	pt, ok := ts.traces[s.TraceID]
+	if !ok {
+		if len(ts.traces) >= ts.o.MaxTraces {
+			oldest := ts.order.Front().Value.(*pendingTrace)
+			ready = append(ready, ts.decideLocked(oldest, now, true)...)
+		}
+		pt = &pendingTrace{id: s.TraceID, first: now}
+		pt.elem = ts.order.PushBack(pt)
+		ts.traces[s.TraceID] = pt
+	}
+	pt.spans = append(pt.spans, s)
+	ts.held++
+	if len(pt.spans) >= ts.o.MaxSpansPerTrace {
+		ready = append(ready, ts.decideLocked(pt, now, true)...)
+	}
+	ts.mu.Unlock()
+
+	for _, s := range ready {
+		ts.export(s)
+	}
+}
+
+// decideLocked applies the policies to pt, removes it from the pending
+// traces and returns its spans if it is selected. It must be called with
+// ts.mu held.
+func (ts *tailSampler) decideLocked(pt *pendingTrace, now time.Time, early bool) []*trace.SpanData {
+	sampled := len(ts.o.Policies) == 0
+	for _, p := range ts.o.Policies {
+		if p(pt.spans) {
+			sampled = true
+			break
+		}
+	}
+	ts.order.Remove(pt.elem)
+	delete(ts.traces, pt.id)
+	ts.held -= int64(len(pt.spans))
+	if ts.decisions.Len() >= ts.o.MaxTraces {
+		delete(ts.decided, ts.decisions.Remove(ts.decisions.Front()).(trace.TraceID))
+	}
+	ts.decided[pt.id] = tailDecision{sampled: sampled, at: now}
+	ts.decisions.PushBack(pt.id)
+	ts.sm.tailDecisionAdd(sampled, early)
+	if !sampled {
+		return nil
+	}
+	return pt.spans
+}
+
+// decide makes the decision for the traces held for DecisionWait, or for
+// all of them if all is true, and exports the selected spans. It returns the
+// number of spans exported.
+func (ts *tailSampler) decide(all bool) int {
+	var ready []*trace.SpanData
+	now := time.Now()
+
+	ts.mu.Lock()
+	for e := ts.order.Front(); e != nil; e = ts.order.Front() {
+		pt := e.Value.(*pendingTrace)
+		if !all && now.Sub(pt.first) < ts.o.DecisionWait {
+			break
+		}
+		ready = append(ready, ts.decideLocked(pt, now, false)...)
+	}
+	for e := ts.decisions.Front(); e != nil; e = ts.decisions.Front() {
+		id := e.Value.(trace.TraceID)
+		if now.Sub(ts.decided[id].at) < ts.o.DecisionWait {
+			break
+		}
+		ts.decisions.Remove(e)
+		delete(ts.decided, id)
+	}
+	ts.mu.Unlock()
+
+	for _, s := range ready {
+		ts.export(s)
+	}
+	return len(ready)
+}
+
+func (ts *tailSampler) loop() {
+	defer close(ts.done)
+	interval := ts.o.DecisionWait / 4
+	if interval > time.Second {
+		interval = time.Second
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ts.stop:
+			return
+		case <-t.C:
+			ts.decide(false)
+		}
+	}
+}
+
+// flush makes the decision for all the traces held, and returns the number
+// of spans exported.
+func (ts *tailSampler) flush() int {
+	return ts.decide(true)
+}
+
+// close stops the background decisions and makes the decision for all the
+// traces held. It returns the number of spans exported.
+func (ts *tailSampler) close() int {
+	ts.stopOnce.Do(func() { close(ts.stop) })
+	<-ts.done
+	return ts.flush()
+}
@@ -0,0 +1,200 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+func tailTestSpan(tid byte, sid byte, d time.Duration, code int32) *trace.SpanData {
+	start := time.Unix(1000, 0)
+	return &trace.SpanData{
+		SpanContext: trace.SpanContext{
+			TraceID: trace.TraceID{tid},
+			SpanID:  trace.SpanID{sid},
+		},
+		Name:      "span",
+		StartTime: start,
+		EndTime:   start.Add(d),
+		Status:    trace.Status{Code: code},
+	}
+}
+
+func TestTailSamplingPolicies(t *testing.T) {
+	ok := tailTestSpan(1, 1, time.Millisecond, trace.StatusCodeOK)
+	failed := tailTestSpan(1, 2, time.Millisecond, trace.StatusCodeInternal)
+	late := tailTestSpan(1, 3, time.Millisecond, trace.StatusCodeOK)
+	late.StartTime = late.StartTime.Add(time.Second)
+	late.EndTime = late.EndTime.Add(time.Second)
+	withAttr := tailTestSpan(1, 4, time.Millisecond, trace.StatusCodeOK)
+	withAttr.Attributes = map[string]interface{}{"user": "alice"}
+
+	tests := []struct {
+		name   string
+		policy TailSamplingPolicy
+		spans  []*trace.SpanData
+		want   bool
+	}{
+		{"errors/none", TailSampleErrors(), []*trace.SpanData{ok}, false},
+		{"errors/one", TailSampleErrors(), []*trace.SpanData{ok, failed}, true},
+		{"latency/below", TailSampleLatencyAbove(100 * time.Millisecond), []*trace.SpanData{ok, failed}, false},
+		{"latency/across spans", TailSampleLatencyAbove(100 * time.Millisecond), []*trace.SpanData{ok, late}, true},
+		{"attribute/missing", TailSampleAttribute("user", nil), []*trace.SpanData{ok}, false},
+		{"attribute/any value", TailSampleAttribute("user", nil), []*trace.SpanData{ok, withAttr}, true},
+		{"attribute/value", TailSampleAttribute("user", "alice"), []*trace.SpanData{withAttr}, true},
+		{"attribute/other value", TailSampleAttribute("user", "bob"), []*trace.SpanData{withAttr}, false},
+		{"probability/all", TailSampleProbability(1), []*trace.SpanData{ok}, true},
+		{"probability/none", TailSampleProbability(0), []*trace.SpanData{ok}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.policy(tt.spans); got != tt.want {
+			t.Errorf("%s: policy() = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// The probability policy depends on the trace ID only.
+	half := TailSampleProbability(0.5)
+	low := []*trace.SpanData{{SpanContext: trace.SpanContext{TraceID: trace.TraceID{0x10}}}}
+	high := []*trace.SpanData{{SpanContext: trace.SpanContext{TraceID: trace.TraceID{0xf0}}}}
+	if !half(low) || half(high) {
+		t.Errorf("TailSampleProbability(0.5) = %v, %v; want true, false", half(low), half(high))
+	}
+}
+
+type tailRecorder struct {
+	mu    sync.Mutex
+	spans []*trace.SpanData
+}
+
+func (r *tailRecorder) export(s *trace.SpanData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, s)
+}
+
+func (r *tailRecorder) ids() []trace.SpanID {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var ids []trace.SpanID
+	for _, s := range r.spans {
+		ids = append(ids, s.SpanID)
+	}
+	return ids
+}
+
+func TestTailSampler(t *testing.T) {
+	var r tailRecorder
+	sm := newSelfMetrics()
+	ts := newTailSampler(TailSamplingOptions{
+		DecisionWait: time.Hour,
+		Policies:     []TailSamplingPolicy{TailSampleErrors()},
+	}, r.export, sm)
+	defer ts.close()
+
+	ts.add(tailTestSpan(1, 1, time.Millisecond, trace.StatusCodeOK))
+	ts.add(tailTestSpan(1, 2, time.Millisecond, trace.StatusCodeInternal))
+	ts.add(tailTestSpan(2, 3, time.Millisecond, trace.StatusCodeOK))
+	if got := r.ids(); len(got) != 0 {
+		t.Fatalf("spans exported before the decision: %v", got)
+	}
+
+	ts.decide(false)
+	if got := r.ids(); len(got) != 0 {
+		t.Fatalf("spans exported before DecisionWait: %v", got)
+	}
+
+	ts.flush()
+	if got := r.ids(); len(got) != 2 || got[0] != (trace.SpanID{1}) || got[1] != (trace.SpanID{2}) {
+		t.Fatalf("exported spans = %v; want the spans of the failed trace", got)
+	}
+
+	// Late spans follow the decision of their trace.
+	ts.add(tailTestSpan(1, 4, time.Millisecond, trace.StatusCodeOK))
+	ts.add(tailTestSpan(2, 5, time.Millisecond, trace.StatusCodeInternal))
+	if got := r.ids(); len(got) != 3 || got[2] != (trace.SpanID{4}) {
+		t.Errorf("exported spans = %v; want the late span of the sampled trace", got)
+	}
+
+	assertTailTraces(t, sm, map[string]int64{tailDecisionSampled: 1, tailDecisionNotSampled: 1})
+}
+
+func TestTailSamplerLimits(t *testing.T) {
+	var r tailRecorder
+	sm := newSelfMetrics()
+	ts := newTailSampler(TailSamplingOptions{
+		DecisionWait:     time.Hour,
+		MaxTraces:        2,
+		MaxSpansPerTrace: 3,
+	}, r.export, sm)
+	defer ts.close()
+
+	ts.add(tailTestSpan(1, 1, time.Millisecond, trace.StatusCodeOK))
+	ts.add(tailTestSpan(2, 2, time.Millisecond, trace.StatusCodeOK))
+	// A third trace forces the decision for the oldest one.
+	ts.add(tailTestSpan(3, 3, time.Millisecond, trace.StatusCodeOK))
+	if got := r.ids(); len(got) != 1 || got[0] != (trace.SpanID{1}) {
+		t.Fatalf("exported spans = %v; want the span of the oldest trace", got)
+	}
+
+	// Reaching MaxSpansPerTrace forces the decision for the trace.
+	ts.add(tailTestSpan(2, 4, time.Millisecond, trace.StatusCodeOK))
+	ts.add(tailTestSpan(2, 5, time.Millisecond, trace.StatusCodeOK))
+	if got := r.ids(); len(got) != 4 {
+		t.Fatalf("exported spans = %v; want the spans of the full trace", got)
+	}
+
+	var early int64
+	for _, m := range sm.Read() {
+		if m.Descriptor.Name == selfMetricTailEarlyDecisions {
+			early = m.TimeSeries[0].Points[0].Value.(int64)
+		}
+	}
+	if early != 2 {
+		t.Errorf("early decisions = %d; want 2", early)
+	}
+
+	// Only the MaxTraces latest decisions are remembered.
+	ts.flush()
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if len(ts.decided) != 2 || ts.decisions.Len() != 2 {
+		t.Errorf("remembered %d decisions; want 2", len(ts.decided))
+	}
+	if _, ok := ts.decided[trace.TraceID{1}]; ok {
+		t.Error("decision for the oldest trace remembered")
+	}
+}
+
+func assertTailTraces(t *testing.T, sm *selfMetrics, want map[string]int64) {
+	t.Helper()
+	got := make(map[string]int64)
+	for _, m := range sm.Read() {
+		if m.Descriptor.Name != selfMetricTailTraces {
+			continue
+		}
+		for _, ts := range m.TimeSeries {
+			got[ts.LabelValues[0].Value] = ts.Points[0].Value.(int64)
+		}
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("tail_sampling_traces{decision=%q} = %d; want %d", k, got[k], v)
+		}
+	}
+}
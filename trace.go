@@ -19,12 +19,14 @@ import (
 	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	tracingclient "cloud.google.com/go/trace/apiv2"
 	"cloud.google.com/go/trace/apiv2/tracepb"
 	"go.opencensus.io/trace"
 	"google.golang.org/api/support/bundler"
+	monitoredrespb "google.golang.org/genproto/googleapis/api/monitoredres"
 	"google.golang.org/protobuf/proto"
 
 	commonpb "github.com/census-instrumentation/opencensus-proto/gen-go/agent/common/v1"
@@ -36,16 +38,29 @@ import (
 type traceExporter struct {
 	o         Options
 	projectID string
-	bundler   *bundler.Bundler
+	bundler   *overflowBundler
 	// uploadFn defaults to uploadSpans; it can be replaced for tests.
 	uploadFn func(spans []*tracepb.Span)
 	overflowLogger
 	client *tracingclient.Client
+	// spool keeps the spans that could not be uploaded, if Options.DiskQueue is set.
+	spool *diskSpool
+	sm    *selfMetrics
+	// tail holds the spans until their trace is sampled, if Options.TailSampling is set.
+	tail *tailSampler
+	// limits are Options.TraceLimits with the defaults applied.
+	limits TraceLimits
+	// stacks converts the stack traces of spans, if Options.StackTraces is set.
+	stacks *stackTraces
+	// spanMetrics aggregates the exported spans, if Options.SpanMetrics is set.
+	spanMetrics *spanMetrics
+	// queued is the number of spans held by the bundler or being uploaded.
+	queued int64
 }
 
 var _ trace.Exporter = (*traceExporter)(nil)
 
-func newTraceExporter(o Options) (*traceExporter, error) {
+func newTraceExporter(o Options, sm *selfMetrics) (*traceExporter, error) {
 	ctx := o.Context
 	if ctx == nil {
 		ctx = context.Background()
@@ -54,7 +69,21 @@ func newTraceExporter(o Options) (*traceExporter, error) {
 	if err != nil {
 		return nil, fmt.Errorf("stackdriver: couldn't initialize trace client: %v", err)
 	}
-	return newTraceExporterWithClient(o, client), nil
+	e := newTraceExporterWithClient(o, client)
+	e.sm = sm
+	if o.DiskQueue != nil {
+		e.spool, err = newDiskSpool(o.DiskQueue, "trace", e.sendSpooledSpans, o.RetryPolicy.retryable, o.handleError)
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+		sm.addQueue("trace_disk", func() int64 { return int64(e.spool.q.Len()) })
+	}
+	sm.addQueue("trace", func() int64 { return atomic.LoadInt64(&e.queued) })
+	if o.TailSampling != nil {
+		e.tail = newTailSampler(*o.TailSampling, e.exportSpan, sm)
+	}
+	return e, nil
 }
 
 const defaultBufferedByteLimit = 8 * 1024 * 1024
@@ -64,62 +93,138 @@ func newTraceExporterWithClient(o Options, c *tracingclient.Client) *traceExport
 		projectID: o.ProjectID,
 		client:    c,
 		o:         o,
+		limits:    o.TraceLimits.withDefaults(),
 	}
-	b := bundler.NewBundler((*tracepb.Span)(nil), func(bundle interface{}) {
-		e.uploadFn(bundle.([]*tracepb.Span))
-	})
-	if o.BundleDelayThreshold > 0 {
-		b.DelayThreshold = o.BundleDelayThreshold
-	} else {
-		b.DelayThreshold = 2 * time.Second
+	if o.StackTraces != nil {
+		e.stacks = newStackTraces(*o.StackTraces)
 	}
-	if o.BundleCountThreshold > 0 {
-		b.BundleCountThreshold = o.BundleCountThreshold
-	} else {
-		b.BundleCountThreshold = 50
-	}
-	if o.NumberOfWorkers > 0 {
-		b.HandlerLimit = o.NumberOfWorkers
-	}
-	// The measured "bytes" are not really bytes, see exportReceiver.
-	b.BundleByteThreshold = b.BundleCountThreshold * 200
-	b.BundleByteLimit = b.BundleCountThreshold * 1000
-	if o.TraceSpansBufferMaxBytes > 0 {
-		b.BufferedByteLimit = o.TraceSpansBufferMaxBytes
-	} else {
-		b.BufferedByteLimit = defaultBufferedByteLimit
+	if o.SpanMetrics != nil {
+		e.spanMetrics = newSpanMetrics(*o.SpanMetrics)
 	}
-
-	e.bundler = b
+	b := o.traceBundleOptions().newBundler((*tracepb.Span)(nil), func(bundle interface{}) {
+		spans := bundle.([]*tracepb.Span)
+		e.uploadFn(spans)
+		atomic.AddInt64(&e.queued, -int64(len(spans)))
+	})
+	e.bundler = newOverflowBundler(b, &o, func(item interface{}) {
+		atomic.AddInt64(&e.queued, -1)
+		e.spanOverflowed(item.(*tracepb.Span))
+	})
 	e.uploadFn = e.uploadSpans
 	return e
 }
 
 // ExportSpan exports a SpanData to Stackdriver Trace.
 func (e *traceExporter) ExportSpan(s *trace.SpanData) {
-	protoSpan := protoFromSpanData(s, e.projectID, e.o.Resource, e.o.UserAgent)
+	processed := processSpan(s, e.o.SpanProcessors)
+	if processed == nil {
+		// The spans dropped by the processors are still counted, without
+		// the attributes the processors did not redact.
+		c := *s
+		c.Attributes = nil
+		e.spanMetrics.record(&c)
+		return
+	}
+	// The label values are taken from the processed span, so that the
+	// attributes redacted by the processors do not reach the metrics.
+	e.spanMetrics.record(processed)
+	s = processed
+	if e.stacks != nil {
+		// Spans are exported when they end, so this captures the stack
+		// where s was ended.
+		s = e.stacks.capture(s)
+	}
+	if e.tail != nil {
+		e.tail.add(s)
+		return
+	}
+	e.exportSpan(s)
+}
+
+// exportSpan converts s and adds it to the bundler.
+func (e *traceExporter) exportSpan(s *trace.SpanData) {
+	protoSpan := e.protoFromSpanData(s, e.o.Resource)
 	protoSize := proto.Size(protoSpan)
-	err := e.bundler.Add(protoSpan, protoSize)
+	// Count the span before adding it, as it can be evicted right away.
+	atomic.AddInt64(&e.queued, 1)
+	err := e.bundler.add(context.Background(), protoSpan, protoSize)
+	if err != nil {
+		atomic.AddInt64(&e.queued, -1)
+	}
 	switch err {
 	case nil:
 		return
 	case bundler.ErrOversizedItem:
+		e.sm.spansDroppedAdd(1, dropReasonOversized)
 	case bundler.ErrOverflow:
-		e.overflowLogger.log()
+		e.spanOverflowed(protoSpan)
 	default:
-		e.o.handleError(err)
+		e.sm.spansDroppedAdd(1, errorReason(err))
+		e.o.handleError(spansError([]*tracepb.Span{protoSpan}, err))
+	}
+}
+
+// spanOverflowed queues s on disk if Options.DiskQueue is set, or drops it,
+// when there is no room for it in the bundler.
+func (e *traceExporter) spanOverflowed(s *tracepb.Span) {
+	e.sm.spansOverflowedAdd(1)
+	if e.spool != nil && e.spoolSpans([]*tracepb.Span{s}) == nil {
+		return
 	}
+	e.sm.spansDroppedAdd(1, dropReasonBufferFull)
+	e.overflowLogger.log()
+}
+
+// protoFromSpanData converts s with the limits, stack trace options,
+// attribute converter and span display names of the exporter.
+func (e *traceExporter) protoFromSpanData(s *trace.SpanData, mr *monitoredrespb.MonitoredResource) *tracepb.Span {
+	var st *tracepb.StackTrace
+	if e.stacks != nil {
+		s, st = e.stacks.extract(s)
+	}
+	if e.o.AttributeConverter != nil {
+		s = convertAttributes(s, e.o.AttributeConverter)
+	}
+	sp := protoFromSpanDataWithLimits(s, e.projectID, mr, e.o.UserAgent, e.limits)
+	if e.o.GetSpanDisplayName != nil {
+		sp.DisplayName = trunc(e.o.GetSpanDisplayName(s), e.limits.MaxDisplayNameLength)
+	}
+	sp.StackTrace = st
+	return sp
 }
 
 // Flush waits for exported trace spans to be uploaded.
 //
 // This is useful if your program is ending and you do not want to lose recent
-// spans.
+// spans. The spans held for tail sampling are uploaded if their trace is
+// selected by the policies.
 func (e *traceExporter) Flush() {
-	e.bundler.Flush()
+	if e.tail != nil {
+		e.tail.flush()
+	}
+	e.bundler.flush()
 }
 
-func (e *traceExporter) close() error {
+// close closes the client. The spans selected by the last tail sampling
+// decisions are uploaded first, unless ctx is done.
+func (e *traceExporter) close(ctx context.Context) error {
+	if e.tail != nil && e.tail.close() > 0 {
+		flushed := make(chan struct{})
+		go func() {
+			defer close(flushed)
+			e.bundler.flush()
+		}()
+		select {
+		case <-flushed:
+		case <-ctx.Done():
+		}
+	}
+	e.bundler.close()
+	if e.spool != nil {
+		if err := e.spool.close(); err != nil {
+			e.o.handleError(err)
+		}
+	}
 	return e.client.Close()
 }
 
@@ -140,33 +245,42 @@ func (e *traceExporter) pushTraceSpans(ctx context.Context, node *commonpb.Node,
 	}
 
 	for _, span := range spans {
-		protoSpans = append(protoSpans, protoFromSpanData(span, e.projectID, res, e.o.UserAgent))
+		if span = processSpan(span, e.o.SpanProcessors); span != nil {
+			protoSpans = append(protoSpans, e.protoFromSpanData(span, res))
+		}
+	}
+	if len(protoSpans) == 0 {
+		return 0, nil
 	}
 
+	protoSpans = dedupStackTraces(protoSpans)
 	req := tracepb.BatchWriteSpansRequest{
 		Name:  "projects/" + e.projectID,
 		Spans: protoSpans,
 	}
-	// Create a never-sampled span to prevent traces associated with exporter.
-	ctx, cancel := newContextWithTimeout(ctx, e.o.Timeout)
-	defer cancel()
-
-	err := e.client.BatchWriteSpans(ctx, &req)
+	err := e.o.RetryPolicy.invoke(ctx, e.o.Timeout, func(ctx context.Context) error {
+		return e.batchWriteSpans(ctx, &req)
+	})
 	if err != nil {
-		return len(spans), err
+		e.sm.spansDroppedAdd(len(protoSpans), errorReason(err))
+		return len(protoSpans), spansError(protoSpans, err)
 	}
+	e.sm.spansExportedAdd(len(protoSpans))
 	return 0, nil
 }
 
 // uploadSpans uploads a set of spans to Stackdriver.
 func (e *traceExporter) uploadSpans(spans []*tracepb.Span) {
+	spans = dedupStackTraces(spans)
 	req := tracepb.BatchWriteSpansRequest{
 		Name:  "projects/" + e.projectID,
 		Spans: spans,
 	}
+	ctx := e.o.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
 	// Create a never-sampled span to prevent traces associated with exporter.
-	ctx, cancel := newContextWithTimeout(e.o.Context, e.o.Timeout)
-	defer cancel()
 	ctx, span := trace.StartSpan(
 		ctx,
 		"contrib.go.opencensus.io/exporter/stackdriver.uploadSpans",
@@ -175,11 +289,63 @@ func (e *traceExporter) uploadSpans(spans []*tracepb.Span) {
 	defer span.End()
 	span.AddAttributes(trace.Int64Attribute("num_spans", int64(len(spans))))
 
-	err := e.client.BatchWriteSpans(ctx, &req)
-	if err != nil {
+	err := e.o.RetryPolicy.invoke(ctx, e.o.Timeout, func(ctx context.Context) error {
+		return e.batchWriteSpans(ctx, &req)
+	})
+	if err == nil {
+		e.sm.spansExportedAdd(len(spans))
+	} else {
 		span.SetStatus(trace.Status{Code: 2, Message: err.Error()})
-		e.o.handleError(err)
+		var serr error
+		if e.spool != nil && e.o.RetryPolicy.retryable(err) {
+			if serr = e.spoolSpans(spans); serr == nil {
+				return
+			}
+			serr = fmt.Errorf("couldn't queue spans on disk: %w", serr)
+		}
+		e.sm.spansDroppedAdd(len(spans), errorReason(err))
+		ee := spansError(spans, err)
+		if serr != nil {
+			ee.Errs = append(ee.Errs, serr)
+		}
+		e.o.handleError(ee)
+	}
+}
+
+// spoolSpans writes spans to the disk queue, to be uploaded later.
+func (e *traceExporter) spoolSpans(spans []*tracepb.Span) error {
+	return e.spool.add(&tracepb.BatchWriteSpansRequest{
+		Name:  "projects/" + e.projectID,
+		Spans: spans,
+	})
+}
+
+// sendSpooledSpans uploads a request read from the disk queue.
+func (e *traceExporter) sendSpooledSpans(rec []byte) error {
+	var req tracepb.BatchWriteSpansRequest
+	if err := proto.Unmarshal(rec, &req); err != nil {
+		return newExportError(SignalTrace, []error{fmt.Errorf("couldn't decode spans read from disk queue: %v", err)})
+	}
+	ctx, cancel := newContextWithTimeout(e.o.Context, e.o.Timeout)
+	defer cancel()
+	err := e.batchWriteSpans(ctx, &req)
+	if err == nil {
+		e.sm.spansExportedAdd(len(req.Spans))
+		return nil
+	}
+	if e.o.RetryPolicy.retryable(err) {
+		return err
 	}
+	e.sm.spansDroppedAdd(len(req.Spans), errorReason(err))
+	return spansError(req.Spans, err)
+}
+
+// batchWriteSpans calls BatchWriteSpans and records its latency.
+func (e *traceExporter) batchWriteSpans(ctx context.Context, req *tracepb.BatchWriteSpansRequest) error {
+	start := time.Now()
+	err := e.client.BatchWriteSpans(ctx, req)
+	e.sm.recordRPC(methodBatchWriteSpans, start, err)
+	return err
 }
 
 // overflowLogger ensures that at most one overflow error log message is
@@ -0,0 +1,93 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import "sort"
+
+// TraceLimits controls how spans are trimmed when they are converted for
+// Stackdriver Trace. The data exceeding the limits is dropped, and counted
+// in the dropped counts of the uploaded spans.
+//
+// The zero value of the first five limits selects the defaults, which
+// match the quotas of Stackdriver Trace when they were introduced.
+type TraceLimits struct {
+	// MaxAnnotationEventsPerSpan is the maximum number of annotations of a
+	// span. If unset, a default of 32 is used.
+	MaxAnnotationEventsPerSpan int
+
+	// MaxMessageEventsPerSpan is the maximum number of message events of a
+	// span. If unset, a default of 128 is used.
+	MaxMessageEventsPerSpan int
+
+	// MaxAttributeStringValue is the length, in bytes, string attribute
+	// values and annotation descriptions are truncated to.
+	// If unset, a default of 256 is used.
+	MaxAttributeStringValue int
+
+	// MaxDisplayNameLength is the length, in bytes, span names are
+	// truncated to. If unset, a default of 128 is used.
+	MaxDisplayNameLength int
+
+	// MaxAttributeKeyLength is the maximum length, in bytes, of attribute
+	// keys. Attributes with longer keys are dropped.
+	// If unset, a default of 128 is used.
+	MaxAttributeKeyLength int
+
+	// MaxAttributesPerSpan is the maximum number of attributes of a span,
+	// annotation or link. When there are more, the ones whose keys come
+	// first in lexical order are kept. The attributes added by the exporter,
+	// such as g.co/agent and the monitored resource labels, are not counted.
+	// If unset, the number of attributes is not limited.
+	MaxAttributesPerSpan int
+
+	// MaxLinksPerSpan is the maximum number of links of a span. The first
+	// links are kept. If unset, the number of links is not limited.
+	MaxLinksPerSpan int
+}
+
+var defaultTraceLimits = TraceLimits{}.withDefaults()
+
+// withDefaults returns l with the defaults applied to its unset fields.
+func (l TraceLimits) withDefaults() TraceLimits {
+	if l.MaxAnnotationEventsPerSpan <= 0 {
+		l.MaxAnnotationEventsPerSpan = maxAnnotationEventsPerSpan
+	}
+	if l.MaxMessageEventsPerSpan <= 0 {
+		l.MaxMessageEventsPerSpan = maxMessageEventsPerSpan
+	}
+	if l.MaxAttributeStringValue <= 0 {
+		l.MaxAttributeStringValue = maxAttributeStringValue
+	}
+	if l.MaxDisplayNameLength <= 0 {
+		l.MaxDisplayNameLength = maxDisplayNameLength
+	}
+	if l.MaxAttributeKeyLength <= 0 {
+		l.MaxAttributeKeyLength = maxAttributeKeyLength
+	}
+	return l
+}
+
+// attributeKeys returns the keys of attrs. They are sorted if there are more
+// than max of them, so that the same attributes are kept for every span.
+func attributeKeys(attrs map[string]interface{}, max int) []string {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	if max > 0 && len(keys) > max {
+		sort.Strings(keys)
+	}
+	return keys
+}
@@ -0,0 +1,106 @@
+// Copyright 2020, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"strings"
+	"testing"
+
+	"go.opencensus.io/trace"
+)
+
+func TestTraceLimits(t *testing.T) {
+	l := TraceLimits{
+		MaxAnnotationEventsPerSpan: 1,
+		MaxMessageEventsPerSpan:    2,
+		MaxAttributeStringValue:    4,
+		MaxDisplayNameLength:       5,
+		MaxAttributeKeyLength:      6,
+		MaxAttributesPerSpan:       2,
+		MaxLinksPerSpan:            1,
+	}.withDefaults()
+
+	sd := &trace.SpanData{
+		Name: "long span name",
+		Attributes: map[string]interface{}{
+			"c":          "value",
+			"a":          "value",
+			"b":          int64(1),
+			"too_long_k": "value",
+		},
+		Annotations:   make([]trace.Annotation, 3),
+		MessageEvents: make([]trace.MessageEvent, 3),
+		Links:         make([]trace.Link, 3),
+	}
+	s := protoFromSpanDataWithLimits(sd, "testproject", nil, defaultUserAgent, l)
+
+	if got, want := s.DisplayName.Value, "long "; got != want {
+		t.Errorf("DisplayName = %q; want %q", got, want)
+	}
+	attrs := s.Attributes.AttributeMap
+	if _, ok := attrs["a"]; !ok {
+		t.Errorf("attribute a dropped: %v", attrs)
+	}
+	if _, ok := attrs["b"]; !ok {
+		t.Errorf("attribute b dropped: %v", attrs)
+	}
+	for _, k := range []string{"c", "too_long_k"} {
+		if _, ok := attrs[k]; ok {
+			t.Errorf("attribute %s not dropped", k)
+		}
+	}
+	if got := attrs["a"].GetStringValue().Value; got != "valu" {
+		t.Errorf("attribute a = %q; want %q", got, "valu")
+	}
+	if _, ok := attrs[agentLabel]; !ok {
+		t.Errorf("%s attribute dropped", agentLabel)
+	}
+	if got, want := s.Attributes.DroppedAttributesCount, int32(2); got != want {
+		t.Errorf("DroppedAttributesCount = %d; want %d", got, want)
+	}
+	if got, want := s.TimeEvents.DroppedAnnotationsCount, int32(2); got != want {
+		t.Errorf("DroppedAnnotationsCount = %d; want %d", got, want)
+	}
+	if got, want := s.TimeEvents.DroppedMessageEventsCount, int32(1); got != want {
+		t.Errorf("DroppedMessageEventsCount = %d; want %d", got, want)
+	}
+	if got, want := len(s.TimeEvents.TimeEvent), 3; got != want {
+		t.Errorf("len(TimeEvent) = %d; want %d", got, want)
+	}
+	if got, want := len(s.Links.Link), 1; got != want {
+		t.Errorf("len(Link) = %d; want %d", got, want)
+	}
+	if got, want := s.Links.DroppedLinksCount, int32(2); got != want {
+		t.Errorf("DroppedLinksCount = %d; want %d", got, want)
+	}
+}
+
+func TestTraceLimitsDefaults(t *testing.T) {
+	sd := &trace.SpanData{
+		Name:       strings.Repeat("x", 200),
+		Attributes: map[string]interface{}{strings.Repeat("k", 129): "v"},
+		Links:      make([]trace.Link, 200),
+	}
+	s := protoFromSpanData(sd, "testproject", nil, defaultUserAgent)
+	if got := len(s.DisplayName.Value); got != maxDisplayNameLength {
+		t.Errorf("len(DisplayName) = %d; want %d", got, maxDisplayNameLength)
+	}
+	if got := s.Attributes.DroppedAttributesCount; got != 1 {
+		t.Errorf("DroppedAttributesCount = %d; want 1", got)
+	}
+	if got := len(s.Links.Link); got != 200 {
+		t.Errorf("len(Link) = %d; want all the links", got)
+	}
+}
@@ -15,8 +15,10 @@
 package stackdriver
 
 import (
+	"encoding/json"
 	"fmt"
 	"math"
+	"reflect"
 	"strconv"
 	"time"
 	"unicode/utf8"
@@ -34,6 +36,8 @@ const (
 	maxAnnotationEventsPerSpan = 32
 	maxMessageEventsPerSpan    = 128
 	maxAttributeStringValue    = 256
+	maxDisplayNameLength       = 128
+	maxAttributeKeyLength      = 128
 	agentLabel                 = "g.co/agent"
 
 	labelHTTPHost       = `/http/host`
@@ -45,6 +49,12 @@ const (
 
 // proto returns a protocol buffer representation of a SpanData.
 func protoFromSpanData(s *trace.SpanData, projectID string, mr *monitoredrespb.MonitoredResource, userAgent string) *tracepb.Span {
+	return protoFromSpanDataWithLimits(s, projectID, mr, userAgent, defaultTraceLimits)
+}
+
+// protoFromSpanDataWithLimits is like protoFromSpanData, with the limits l
+// instead of the default ones. l must have its defaults applied.
+func protoFromSpanDataWithLimits(s *trace.SpanData, projectID string, mr *monitoredrespb.MonitoredResource, userAgent string, l TraceLimits) *tracepb.Span {
 	if s == nil {
 		return nil
 	}
@@ -52,18 +62,10 @@ func protoFromSpanData(s *trace.SpanData, projectID string, mr *monitoredrespb.M
 	traceIDString := s.SpanContext.TraceID.String()
 	spanIDString := s.SpanContext.SpanID.String()
 
-	name := s.Name
-	switch s.SpanKind {
-	case trace.SpanKindClient:
-		name = "Sent." + name
-	case trace.SpanKindServer:
-		name = "Recv." + name
-	}
-
 	sp := &tracepb.Span{
 		Name:                    "projects/" + projectID + "/traces/" + traceIDString + "/spans/" + spanIDString,
 		SpanId:                  spanIDString,
-		DisplayName:             trunc(name, 128),
+		DisplayName:             trunc(PrefixedSpanDisplayName(s), l.MaxDisplayNameLength),
 		StartTime:               timestampProto(s.StartTime),
 		EndTime:                 timestampProto(s.EndTime),
 		SameProcessAsParentSpan: &wrapperspb.BoolValue{Value: !s.HasRemoteParent},
@@ -76,19 +78,19 @@ func protoFromSpanData(s *trace.SpanData, projectID string, mr *monitoredrespb.M
 	}
 
 	var annotations, droppedAnnotationsCount, messageEvents, droppedMessageEventsCount int
-	copyAttributes(&sp.Attributes, s.Attributes)
+	copyAttributes(&sp.Attributes, s.Attributes, l)
 
 	// Copy MonitoredResources as span Attributes
-	sp.Attributes = copyMonitoredResourceAttributes(sp.Attributes, mr)
+	sp.Attributes = copyMonitoredResourceAttributes(sp.Attributes, mr, l)
 
 	as := s.Annotations
 	for i, a := range as {
-		if annotations >= maxAnnotationEventsPerSpan {
+		if annotations >= l.MaxAnnotationEventsPerSpan {
 			droppedAnnotationsCount = len(as) - i
 			break
 		}
-		annotation := &tracepb.Span_TimeEvent_Annotation{Description: trunc(a.Message, maxAttributeStringValue)}
-		copyAttributes(&annotation.Attributes, a.Attributes)
+		annotation := &tracepb.Span_TimeEvent_Annotation{Description: trunc(a.Message, l.MaxAttributeStringValue)}
+		copyAttributes(&annotation.Attributes, a.Attributes, l)
 		event := &tracepb.Span_TimeEvent{
 			Time:  timestampProto(a.Time),
 			Value: &tracepb.Span_TimeEvent_Annotation_{Annotation: annotation},
@@ -116,14 +118,14 @@ func protoFromSpanData(s *trace.SpanData, projectID string, mr *monitoredrespb.M
 	if _, hasAgent := sp.Attributes.AttributeMap[agentLabel]; !hasAgent {
 		sp.Attributes.AttributeMap[agentLabel] = &tracepb.AttributeValue{
 			Value: &tracepb.AttributeValue_StringValue{
-				StringValue: trunc(userAgent, maxAttributeStringValue),
+				StringValue: trunc(userAgent, l.MaxAttributeStringValue),
 			},
 		}
 	}
 
 	es := s.MessageEvents
 	for i, e := range es {
-		if messageEvents >= maxMessageEventsPerSpan {
+		if messageEvents >= l.MaxMessageEventsPerSpan {
 			droppedMessageEventsCount = len(es) - i
 			break
 		}
@@ -153,15 +155,20 @@ func protoFromSpanData(s *trace.SpanData, projectID string, mr *monitoredrespb.M
 	}
 
 	if len(s.Links) > 0 {
+		links := s.Links
 		sp.Links = &tracepb.Span_Links{}
-		sp.Links.Link = make([]*tracepb.Span_Link, 0, len(s.Links))
-		for _, l := range s.Links {
+		if l.MaxLinksPerSpan > 0 && len(links) > l.MaxLinksPerSpan {
+			sp.Links.DroppedLinksCount = clip32(len(links) - l.MaxLinksPerSpan)
+			links = links[:l.MaxLinksPerSpan]
+		}
+		sp.Links.Link = make([]*tracepb.Span_Link, 0, len(links))
+		for _, lk := range links {
 			link := &tracepb.Span_Link{
-				TraceId: l.TraceID.String(),
-				SpanId:  l.SpanID.String(),
-				Type:    tracepb.Span_Link_Type(l.Type),
+				TraceId: lk.TraceID.String(),
+				SpanId:  lk.SpanID.String(),
+				Type:    tracepb.Span_Link_Type(lk.Type),
 			}
-			copyAttributes(&link.Attributes, l.Attributes)
+			copyAttributes(&link.Attributes, lk.Attributes, l)
 			sp.Links.Link = append(sp.Links.Link, link)
 		}
 	}
@@ -178,7 +185,7 @@ func timestampProto(t time.Time) *timestamppb.Timestamp {
 
 // copyMonitoredResourceAttributes copies proto monitoredResource to proto map field (Span_Attributes)
 // it creates the map if it is nil.
-func copyMonitoredResourceAttributes(out *tracepb.Span_Attributes, mr *monitoredrespb.MonitoredResource) *tracepb.Span_Attributes {
+func copyMonitoredResourceAttributes(out *tracepb.Span_Attributes, mr *monitoredrespb.MonitoredResource, l TraceLimits) *tracepb.Span_Attributes {
 	if mr == nil {
 		return out
 	}
@@ -189,15 +196,16 @@ func copyMonitoredResourceAttributes(out *tracepb.Span_Attributes, mr *monitored
 		out.AttributeMap = make(map[string]*tracepb.AttributeValue)
 	}
 	for k, v := range mr.Labels {
-		av := attributeValue(v)
+		av := attributeValue(v, l.MaxAttributeStringValue)
 		out.AttributeMap[fmt.Sprintf("g.co/r/%s/%s", mr.Type, k)] = av
 	}
 	return out
 }
 
 // copyAttributes copies a map of attributes to a proto map field.
-// It creates the map if it is nil.
-func copyAttributes(out **tracepb.Span_Attributes, in map[string]interface{}) {
+// It creates the map if it is nil. The attributes exceeding the limits l
+// are dropped.
+func copyAttributes(out **tracepb.Span_Attributes, in map[string]interface{}, l TraceLimits) {
 	if len(in) == 0 {
 		return
 	}
@@ -208,9 +216,15 @@ func copyAttributes(out **tracepb.Span_Attributes, in map[string]interface{}) {
 		(*out).AttributeMap = make(map[string]*tracepb.AttributeValue)
 	}
 	var dropped int32
-	for key, value := range in {
-		av := attributeValue(value)
+	for _, key := range attributeKeys(in, l.MaxAttributesPerSpan) {
+		value := in[key]
+		av := attributeValue(value, l.MaxAttributeStringValue)
 		if av == nil {
+			dropped++
+			continue
+		}
+		if l.MaxAttributesPerSpan > 0 && len((*out).AttributeMap) >= l.MaxAttributesPerSpan {
+			dropped++
 			continue
 		}
 		switch key {
@@ -225,7 +239,7 @@ func copyAttributes(out **tracepb.Span_Attributes, in map[string]interface{}) {
 		case ochttp.StatusCodeAttribute:
 			(*out).AttributeMap[labelHTTPStatusCode] = av
 		default:
-			if len(key) > 128 {
+			if len(key) > l.MaxAttributeKeyLength {
 				dropped++
 				continue
 			}
@@ -235,8 +249,15 @@ func copyAttributes(out **tracepb.Span_Attributes, in map[string]interface{}) {
 	(*out).DroppedAttributesCount = dropped
 }
 
-func attributeValue(v interface{}) *tracepb.AttributeValue {
-	switch value := v.(type) {
+// attributeValue converts v to an attribute value, truncating strings to
+// maxStringValue bytes. It returns nil if v is of an unsupported type.
+//
+// Booleans and integers that fit in an int64 keep their type. Stackdriver
+// Trace has no floating point attribute values, so floats are formatted as
+// strings, as are durations, times, errors and fmt.Stringers. Slices and
+// arrays of supported values are formatted as JSON arrays.
+func attributeValue(v interface{}, maxStringValue int) *tracepb.AttributeValue {
+	switch value := scalarAttributeValue(v).(type) {
 	case bool:
 		return &tracepb.AttributeValue{
 			Value: &tracepb.AttributeValue_BoolValue{BoolValue: value},
@@ -245,22 +266,90 @@ func attributeValue(v interface{}) *tracepb.AttributeValue {
 		return &tracepb.AttributeValue{
 			Value: &tracepb.AttributeValue_IntValue{IntValue: value},
 		}
-	case float64:
-		// TODO: set double value if Stackdriver Trace support it in the future.
-		return &tracepb.AttributeValue{
-			Value: &tracepb.AttributeValue_StringValue{
-				StringValue: trunc(strconv.FormatFloat(value, 'f', -1, 64),
-					maxAttributeStringValue),
-			},
-		}
 	case string:
 		return &tracepb.AttributeValue{
-			Value: &tracepb.AttributeValue_StringValue{StringValue: trunc(value, maxAttributeStringValue)},
+			Value: &tracepb.AttributeValue_StringValue{StringValue: trunc(value, maxStringValue)},
 		}
 	}
+	rv := reflect.ValueOf(v)
+	if k := rv.Kind(); k != reflect.Slice && k != reflect.Array {
+		return nil
+	}
+	elems := make([]interface{}, rv.Len())
+	for i := range elems {
+		if elems[i] = scalarAttributeValue(rv.Index(i).Interface()); elems[i] == nil {
+			return nil
+		}
+	}
+	b, err := json.Marshal(elems)
+	if err != nil {
+		return nil
+	}
+	return &tracepb.AttributeValue{
+		Value: &tracepb.AttributeValue_StringValue{StringValue: trunc(string(b), maxStringValue)},
+	}
+}
+
+// scalarAttributeValue returns v as a bool, an int64 or a string, or nil if
+// it cannot be represented by one of them.
+func scalarAttributeValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case bool, int64, string:
+		return value
+	case int:
+		return int64(value)
+	case int8:
+		return int64(value)
+	case int16:
+		return int64(value)
+	case int32:
+		return int64(value)
+	case uint8:
+		return int64(value)
+	case uint16:
+		return int64(value)
+	case uint32:
+		return int64(value)
+	case uint:
+		return uintAttributeValue(uint64(value))
+	case uint64:
+		return uintAttributeValue(value)
+	case float32:
+		return strconv.FormatFloat(float64(value), 'f', -1, 32)
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case time.Duration:
+		return value.String()
+	case time.Time:
+		return value.Format(time.RFC3339Nano)
+	case error:
+		if isNilPointer(value) {
+			return nil
+		}
+		return value.Error()
+	case fmt.Stringer:
+		if isNilPointer(value) {
+			return nil
+		}
+		return value.String()
+	}
 	return nil
 }
 
+func isNilPointer(v interface{}) bool {
+	rv := reflect.ValueOf(v)
+	return rv.Kind() == reflect.Ptr && rv.IsNil()
+}
+
+// uintAttributeValue returns v as an int64, or as a decimal string if it
+// overflows.
+func uintAttributeValue(v uint64) interface{} {
+	if v > math.MaxInt64 {
+		return strconv.FormatUint(v, 10)
+	}
+	return int64(v)
+}
+
 // trunc returns a TruncatableString truncated to the given limit.
 func trunc(s string, limit int) *tracepb.TruncatableString {
 	if len(s) > limit {